@@ -0,0 +1,88 @@
+/*
+Usage:
+$ go run Admin.go [-cert file -key file -ca file] [serverAddr TCP ip:port] workers
+$ go run Admin.go [-cert file -key file -ca file] [serverAddr TCP ip:port] drain [workerId]
+
+-cert, -key, -ca: (optional) connect over TLS, with a certificate for
+            admin and the CA that signed the server's certificate.
+
+serverAddr: The client address of the Server.
+workers:    Lists the workers, and whether they are busy or draining.
+drain:      Takes the worker out of service. If it is in a job, its
+            partitions are moved to the rest of the job at the next
+            barrier; run workers until it is no longer busy before
+            stopping it.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"time"
+
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+)
+
+func checkErr(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// How long to wait for the server to accept a connection
+const dialTimeout = 5 * time.Second
+
+func main() {
+	// Parse Arguments:
+	certFile := flag.String("cert", "", "PEM certificate for admin; enables TLS")
+	keyFile := flag.String("key", "", "PEM key of the admin certificate")
+	caFile := flag.String("ca", "", "PEM certificate of the CA that signed the server's certificate")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	serverAddr := flag.Arg(0)
+	command := flag.Arg(1)
+
+	log.SetFlags(log.Lshortfile)
+
+	tlsConfig, err := msg.LoadTLS(*certFile, *keyFile, *caFile)
+	checkErr(err)
+	conn, err := tlsConfig.Dial(serverAddr, "", dialTimeout)
+	checkErr(err)
+	service := rpc.NewClient(conn)
+	defer service.Close()
+
+	switch {
+	case command == "workers":
+		var reply msg.WorkersResp
+		checkErr(service.Call("AdminService.Workers", msg.WorkersMsg{}, &reply))
+		for _, w := range reply.Workers {
+			fmt.Printf("%v\t%v\t%v", w.WorkerId, w.Address, w.State)
+			if w.Busy {
+				fmt.Print("\tbusy")
+			}
+			if w.Draining {
+				fmt.Print("\tdraining")
+			}
+			fmt.Println()
+		}
+	case command == "drain" && flag.NArg() == 3:
+		var reply msg.DrainWorkerResp
+		args := msg.DrainWorkerMsg{WorkerId: msg.WorkerId(flag.Arg(2))}
+		checkErr(service.Call("AdminService.DrainWorker", args, &reply))
+		if reply.InJob {
+			fmt.Printf("Draining %v; its job releases it at the next barrier.\n", args.WorkerId)
+		} else {
+			fmt.Printf("Drained %v.\n", args.WorkerId)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
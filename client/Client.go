@@ -1,22 +1,52 @@
 /*
 Usage:
-$ go run Client.go [serverAddr TCP ip:port] [clientId] [GraphInfoPath] [VertexValue]
-
-serverAddr: The address of the Server.
+$ go run Client.go [-cert file -key file -ca file] [-format name] [-out file] [-out-format name] [-fields list] [-top k] [-filter expr] [-store uri] [-db-name name] [-db-timeout duration] [serverAddr TCP ip:port] [clientId] [GraphInfoPath] [VertexValue] [NumWorkers] [Priority]
+
+-cert, -key, -ca: (optional) connect over TLS, with a certificate for
+            client-<clientId> and the CA that signed the server's certificate.
+-format: (optional) format of the graph file: edges, csv, tsv, adj, mtx or
+            metis, or auto (the default) to tell from the file name and
+            contents. It may be compressed with gzip. Edge weights are
+            checked, but dropped.
+-out: (optional) where to write the results, ../sampleData/<job>-out by
+            default, or - for the standard output.
+-out-format: (optional) format of the results: text (the default), tsv, csv
+            or jsonl.
+-fields: (optional) comma-separated fields of each vertex to write, of id,
+            value, degree, active and superstep. Defaults to id,value.
+-top: (optional) only write the k vertices of highest value, highest first.
+-filter: (optional) only write the vertices that match an expression such as
+            value>=0.01 or degree=0.
+-store: (optional) where the graph is uploaded and the results read from:
+            a mongodb:// URI ($PREGEL_STORE, or mongodb://localhost by
+            default), or file:<dir> for a directory that the server and
+            workers share.
+-db-name, -db-timeout: (optional) the MongoDB database ($PREGEL_DB_NAME),
+            and how long to wait for MongoDB ($PREGEL_DB_TIMEOUT).
+
+serverAddr: The address of the Server. Standby servers can be added as a
+            comma-separated list; the client fails over to them if the
+            server it is using goes away.
 clientId: ID of the client
 GraphInfoPath: the path to the text file containing the vertices
 VertexValue: starting value for each vertex
+NumWorkers: (optional) number of workers to run the job on. If omitted, the
+            server decides based on the graph size and other pending jobs.
+Priority: (optional) scheduling priority of the job, higher runs first. Defaults to 0.
 */
 
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net/rpc"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"project_c9f7_i5l8_o0p4_p0j8/db"
@@ -32,10 +62,29 @@ func checkErr(err error) {
 // TODO: add arguments for graph and data processing. Textfile maybe?
 func main() {
 	// Parse Arguments:
-	serverAddr := os.Args[1]
-	client := os.Args[2]
-	pathToGraph := os.Args[3]
-	value := os.Args[4]
+	certFile := flag.String("cert", "", "PEM certificate of this client, for client-<id>; enables TLS")
+	keyFile := flag.String("key", "", "PEM key of the client certificate")
+	caFile := flag.String("ca", "", "PEM certificate of the CA that signed the server's certificate")
+	dbConfig, err := db.ConfigFromEnv()
+	checkErr(err)
+	format := flag.String("format", "auto", fmt.Sprintf("format of the graph file: auto, or one of %v; edge weights are checked but dropped", db.Formats))
+	outFile := flag.String("out", "", "file to write the results to, or - for the standard output (default ../sampleData/<job>-out)")
+	outFormat := flag.String("out-format", "text", fmt.Sprintf("format of the results: one of %v", db.ExportFormats))
+	fields := flag.String("fields", "id,value", fmt.Sprintf("comma-separated fields of each vertex to write, of %v", db.ExportFields))
+	top := flag.Int("top", 0, "only write the k vertices of highest value, if k > 0")
+	filter := flag.String("filter", "", "only write the vertices that match, e.g. value>=0.01 or degree=0")
+	dbConfig.RegisterFlags()
+	flag.Parse()
+	if flag.NArg() < 4 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	serverAddrs := strings.Split(flag.Arg(0), ",")
+	client := flag.Arg(1)
+	pathToGraph := flag.Arg(2)
+	value := flag.Arg(3)
+	numWorkers := 0
+	priority := 0
 
 	log.SetFlags(log.Lshortfile)
 
@@ -43,21 +92,30 @@ func main() {
 	checkErr(err)
 	val, err := strconv.Atoi(value)
 	checkErr(err)
-
-	// Open connection to Server.
-	service, err := rpc.Dial("tcp", serverAddr)
+	if flag.NArg() > 4 {
+		numWorkers, err = strconv.Atoi(flag.Arg(4))
+		checkErr(err)
+	}
+	if flag.NArg() > 5 {
+		priority, err = strconv.Atoi(flag.Arg(5))
+		checkErr(err)
+	}
+	tlsConfig, err := msg.LoadTLS(*certFile, *keyFile, *caFile)
 	checkErr(err)
+	export := db.ExportOptions{Format: *outFormat, Fields: strings.Split(*fields, ","), Top: *top}
+	if *filter != "" {
+		export.Filter, err = db.ParseFilter(*filter)
+		checkErr(err)
+	}
 
-	var connectArgs msg.ClientConnectionMsg
-	var connectReply msg.ServerConnectionResp
-	connectArgs.ClientId = clientId
-	err = service.Call("ClientService.Connect", connectArgs, &connectReply)
-	checkErr(err)
-	fmt.Println("Server Connection Successful %b", connectReply.IsAccepted)
+	// Open connection to Server.
+	service := connectToServer(serverAddrs, tlsConfig, clientId)
 
 	// TODO also make a Secondary collection
 	jobname := createJobName(clientId)
-	access, err := db.CreateNewJob(jobname, pathToGraph, float64(val))
+	store, err := db.Open(dbConfig)
+	checkErr(err)
+	access, err := db.CreateNewJob(store, jobname, pathToGraph, *format, float64(val))
 	checkErr(err)
 
 	// TODO: Handle any pending jobs(?)
@@ -69,16 +127,94 @@ func main() {
 
 	requestArgs.ClientId = clientId
 	requestArgs.DBAccess = access
+	requestArgs.NumWorkers = numWorkers
+	requestArgs.Priority = priority
 	// TODO set Secondary collection
 
-	// TODO: this should come from the Server?
-	requestArgs.RequestId = 123
-	err = service.Call("ClientService.Request", requestArgs, &requestReply)
+	requestArgs.RequestId = createRequestId()
+	for {
+		call := service.Go("ClientService.Request", requestArgs, &requestReply, nil)
+		waitForRequest(service, clientId, call)
+		if call.Error == nil {
+			break
+		}
+
+		// The server went away. Ask whichever server took over for the same
+		// request; if it recovered the job, it resumes from its last checkpoint.
+		log.Println("Lost the server while waiting for the request:", call.Error)
+		service.Close()
+		service = connectToServer(serverAddrs, tlsConfig, clientId)
+	}
+	fmt.Printf("Request success %v\n", requestReply.Success)
+	if !requestReply.Success {
+		log.Fatalf("Request %v did not complete: %v", requestArgs.RequestId, requestReply.ReplyVal)
+	}
+
+	if *outFile == "" {
+		*outFile = "../sampleData/" + access.PrimaryKey() + "-out"
+	}
+	err = db.ExportToFile(store, access.PrimaryKey(), *outFile, export)
 	checkErr(err)
-	fmt.Println("Request success %b", requestReply.Success)
+}
+
+// The number of times to go through the server addresses before giving up.
+const maxConnectRounds = 30
+
+// How long to wait for a server to accept a connection
+const dialTimeout = 5 * time.Second
+
+// Connects to the first server in serverAddrs that accepts this client.
+func connectToServer(serverAddrs []string, tlsConfig *msg.TLS, clientId int) *rpc.Client {
+	for round := 0; round < maxConnectRounds; round++ {
+		for _, serverAddr := range serverAddrs {
+			conn, err := tlsConfig.Dial(serverAddr, "", dialTimeout)
+			if err != nil {
+				log.Printf("Could not connect to server %v: %v\n", serverAddr, err)
+				continue
+			}
+			service := rpc.NewClient(conn)
+
+			var connectArgs msg.ClientConnectionMsg
+			var connectReply msg.ServerConnectionResp
+			connectArgs.ClientId = clientId
+			err = service.Call("ClientService.Connect", connectArgs, &connectReply)
+			if err != nil || !connectReply.IsAccepted {
+				log.Printf("Server %v did not accept the connection: %v\n", serverAddr, err)
+				service.Close()
+				continue
+			}
+			fmt.Println("Server Connection Successful", serverAddr)
+			return service
+		}
+		time.Sleep(time.Second)
+	}
+	log.Fatal("Could not connect to any server.")
+	return nil
+}
 
-	outfile := "../sampleData/" + access.PrimaryKey() + "-out"
-	err = db.PrintToFile(access.PrimaryKey(), outfile)
+// Waits for the request to finish, printing where it is in the server's queue
+// every few seconds.
+func waitForRequest(service *rpc.Client, clientId int, call *rpc.Call) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-call.Done:
+			return
+		case <-ticker.C:
+			var statusReply msg.ServerStatusResp
+			err := service.Call("ClientService.Status", msg.ClientStatusMsg{ClientId: clientId}, &statusReply)
+			if err != nil {
+				log.Println("Status request failed:", err)
+			} else if statusReply.Running {
+				fmt.Println("Request is running.")
+			} else if statusReply.QueuePosition > 0 {
+				fmt.Printf("Request is queued at position %v of %v.\n",
+					statusReply.QueuePosition, statusReply.QueueLength)
+			}
+		}
+	}
 }
 
 func createJobName(clientId int) string {
@@ -90,6 +226,14 @@ func createJobName(clientId int) string {
 	return primary
 }
 
+// A positive id for a new request, so that the server can tell it from the
+// client's earlier requests.
+func createRequestId() int {
+	seed := rand.NewSource(time.Now().UnixNano())
+	randomNumber := rand.New(seed)
+	return randomNumber.Intn(math.MaxInt32) + 1
+}
+
 //PSEUDOCODE:
 
 /*
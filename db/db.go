@@ -1,18 +1,14 @@
 package db
 
 import (
-	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-
 	"project_c9f7_i5l8_o0p4_p0j8/vertices"
 )
 
@@ -26,8 +22,6 @@ import (
 // Use the NewAccess constructor to ensure the primary key is active first
 
 // TODO: Question: is the Primary where we are returning the completed graph? <- yes
-var DB_IP string = "";
-var DB_PORT string = "";
 // Access contains the primary and secondary collection names for a job
 type Access struct {
 	Primary        string // Key to a collection of vertices
@@ -68,19 +62,11 @@ func (a *Access) SwapKeys() {
 
 // ****************************************************************************
 
-var dialInfo = mgo.DialInfo{
-	Addrs:     []string{DB_IP},
-	Direct:    true,
-	Timeout:   10 * time.Second,
-	Service:   DB_IP + ":" + DB_PORT,
-	PoolLimit: 0,
-}
-
-const dbName = "test"
-
-// DbVertex is the vertex representation in the db
+// DbVertex is the vertex representation in the db. VertexID is the dense id
+// the vertex is given when its graph is loaded; Name is its id in the input.
 type DbVertex struct {
 	VertexID  int      `bson:"vertex_id"`
+	Name      string   `bson:"name"`
 	Value     float64  `bson:"value"`
 	Adjacent  []int    `bson:"adjacent"`
 	Messages  []string `bson:"msgs"`
@@ -94,283 +80,115 @@ func (v byVertexID) Len() int           { return len(v) }
 func (v byVertexID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
 func (v byVertexID) Less(i, j int) bool { return v[i].VertexID < v[j].VertexID }
 
-// CreateNewJob parses the file with the graph info and uploads it
-// to the DB specified by the jobname. It also sets the initial value
-// for each vertex to the specified initVal.
-func CreateNewJob(jobname string, filename string, initVal float64) (Access, error) {
-	fmt.Println("opening file")
-	inFile, err := os.Open(filename)
-	emptyAccess := NewAccess("", "")
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
-
-	m := make(map[int][]int)
-	fmt.Println("Scanning")
-	for scanner.Scan() {
-		str := scanner.Text()
-		if len(str) != 0 && str[0:1] != "#" {
-			vals := strings.Fields(str)
-			fromVertexString := vals[0]
-			toVertexString := vals[1]
-			fromVertex, _ := strconv.Atoi(fromVertexString)
-			toVertex, _ := strconv.Atoi(toVertexString)
-			_, exists := m[toVertex]
-			if !exists {
-				m[toVertex] = make([]int, 0)
-			}
-			m[fromVertex] = append(m[fromVertex], toVertex)
-		}
-	}
+// GraphStore keeps the graph of each job, as collections of vertices named by
+// the keys of the job's Access. MongoStore keeps them in MongoDB, DiskStore
+// in local files, and MemoryStore in this process, for tests.
+type GraphStore interface {
+	// CreateJob creates the primary and the secondary collection of a new
+	// job, both empty.
+	CreateJob(jobname string) (Access, error)
 
-	inFile.Close()
+	// Insert adds a batch of the vertices of a new job's graph to both of
+	// its collections. The graph is inserted in order of vertex id, and no
+	// vertex is inserted twice.
+	Insert(a Access, vs []DbVertex) error
 
-	fmt.Println("file closed")
+	// BatchGet gets the vertices of the collection with ids in
+	// [minVal, maxVal), including minVal but not maxVal.
+	BatchGet(key string, minVal int, maxVal int) (map[int]vertices.BaseVertex, error)
 
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
-	defer session.Close()
-
-	primKey := jobname
-	secKey := primKey + "-secondary"
-	prim := session.DB(dbName).C(primKey)
-	sec := session.DB(dbName).C(secKey)
-	index := mgo.Index{
-		Key:        []string{"vertex_id"},
-		Unique:     true,
-		DropDups:   true,
-		Background: true,
-		Sparse:     true,
-	}
-	err = prim.EnsureIndex(index)
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
+	// BatchUpdate saves the state of several vertices of the collection at
+	// once. Their out-edges are left as they were.
+	BatchUpdate(key string, vertices map[int]vertices.Vertex) error
 
-	err = sec.EnsureIndex(index)
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
-
-	bulkprim := prim.Bulk()
-	bulksec := sec.Bulk()
+	// NumVertices gets the number of vertices in the collection.
+	NumVertices(key string) (int, error)
 
-	fmt.Println("map size: ", len(m))
+	// Export calls emit with every vertex of the collection, in order of
+	// vertex id, and stops at the first error it returns.
+	Export(key string, emit func(DbVertex) error) error
 
-	for key, list := range m {
-		var msgs []string
+	// SaveStats keeps the statistics of a job's graph with the job.
+	SaveStats(a Access, stats *GraphStats) error
 
-		writeReq := DbVertex{
-			VertexID:  key,
-			Value:     initVal,
-			Adjacent:  list,
-			Messages:  msgs,
-			Active:    true,
-			Superstep: 0,
-		}
+	// Stats gets the statistics saved with a job, or nil if it has none.
+	Stats(a Access) (*GraphStats, error)
 
-		bulkprim.Insert(writeReq)
-		bulksec.Insert(writeReq)
-	}
-	_, err = bulkprim.Run()
-
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
-
-	_, err = bulksec.Run()
-
-	if err != nil {
-		fmt.Println(err)
-		return emptyAccess, err
-	}
-
-	fmt.Println("Completed puts of all vertices")
-	return NewAccess(jobname, secKey), err
+	// DeleteJob deletes both collections of a job, and its statistics.
+	DeleteJob(a Access) error
 }
 
-// BatchUpdate updates several vertices in the DB at once. It only updates one
-// collection specified by jobname, and updates the vertices in the slice
-func BatchUpdate(jobname string, vertices map[int]vertices.Vertex) error {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer session.Close()
+// Config says where a process keeps the graphs. The server, workers and
+// clients take it from their -store, -db-name and -db-timeout flags, which
+// default to $PREGEL_STORE, $PREGEL_DB_NAME and $PREGEL_DB_TIMEOUT.
+type Config struct {
+	Store    string        // A mongodb:// URI, or file:<dir> for a DiskStore in dir
+	Database string        // MongoDB database to use instead of the one in the URI
+	Timeout  time.Duration // How long to wait for MongoDB to connect or answer
+}
 
-	c := session.DB(dbName).C(jobname)
-	bulkc := c.Bulk()
+// DefaultStore is used when neither -store nor $PREGEL_STORE is given
+const DefaultStore = "mongodb://localhost"
 
-	for _, vertex := range vertices {
-		dbvertex := vertexToDBVertex(vertex)
-		query := bson.M{"vertex_id": dbvertex.VertexID}
-		change := bson.M{"$set": bson.M{"value": dbvertex.Value, "msgs": dbvertex.Messages, "active": dbvertex.Active, "step": dbvertex.Superstep}}
-		bulkc.Update(query, change)
+// ConfigFromEnv produces the Config given by the environment
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Store:    os.Getenv("PREGEL_STORE"),
+		Database: os.Getenv("PREGEL_DB_NAME"),
+		Timeout:  10 * time.Second,
 	}
-	_, err = bulkc.Run()
-
-	if err != nil {
-		fmt.Println(err)
-		return err
+	if config.Store == "" {
+		config.Store = DefaultStore
 	}
-	return err
-}
-
-// UpdateOne updates one vertex in the given collection
-func UpdateOne(jobname string, vertex vertices.Vertex) error {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(jobname)
-	dbvertex := vertexToDBVertex(vertex)
-	query := bson.M{"vertex_id": dbvertex.VertexID}
-	change := bson.M{"$set": bson.M{"value": dbvertex.Value, "msgs": dbvertex.Messages, "active": dbvertex.Active, "step": dbvertex.Superstep}}
-	err = c.Update(query, change)
-	if err != nil {
-		fmt.Println("Couldn't update", err)
-		return err
+	if timeout := os.Getenv("PREGEL_DB_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return config, fmt.Errorf("db: PREGEL_DB_TIMEOUT: %v", err)
+		}
+		config.Timeout = d
 	}
-	return err
+	return config, nil
 }
 
-// GetOne gets one vertex from the collection specified by jobname
-func GetOne(jobname string, vid int) (vertices.BaseVertex, error) {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		emptyBVertex := vertices.BaseVertex{}
-		return emptyBVertex, err
-	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(jobname)
-	result := DbVertex{}
-	err = c.Find(bson.M{"vertex_id": vid}).One(&result)
-	bvertex := vertexToBaseVertex(result)
-	if err != nil {
-		fmt.Println("Could not get item", err)
-		return bvertex, err
-	}
-	return bvertex, err
+// RegisterFlags adds the -store, -db-name and -db-timeout flags, which
+// override c, to the command line.
+func (c *Config) RegisterFlags() {
+	flag.StringVar(&c.Store, "store", c.Store,
+		"where the graphs are kept: a mongodb:// URI, or file:<dir> on a filesystem shared by the server, workers and clients")
+	flag.StringVar(&c.Database, "db-name", c.Database, "MongoDB database to keep the graphs in, instead of the one in the -store URI (test if neither names one)")
+	flag.DurationVar(&c.Timeout, "db-timeout", c.Timeout, "how long to wait for MongoDB to connect or answer")
 }
 
-// BatchGet gets a batch of vertices from the specified collection (jobname)
-// with ids [minVal, maxVal) including minVal but not maxVal
-func BatchGet(jobname string, minVal int, maxVal int) (map[int]vertices.BaseVertex, error) {
-	var results []DbVertex
-	bvertices := make(map[int]vertices.BaseVertex)
-
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return bvertices, err
+// Open produces the store that config names. A MongoStore connects at once,
+// and is shared by the whole process.
+func Open(config Config) (GraphStore, error) {
+	switch {
+	case strings.HasPrefix(config.Store, "mongodb://"):
+		return NewMongoStore(config.Store, config)
+	case strings.HasPrefix(config.Store, "file:"):
+		return NewDiskStore(strings.TrimPrefix(config.Store, "file:"))
 	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(jobname)
-
-	err = c.Find(bson.M{"vertex_id": bson.M{"$gt": minVal - 1, "$lt": maxVal}}).All(&results)
-	if err != nil {
-		fmt.Println("Could not get items in range specified", err)
-		return bvertices, err
-	}
-
-	for _, vertex := range results {
-		bvertex := vertexToBaseVertex(vertex)
-		bvertices[vertex.VertexID] = bvertex
-	}
-	return bvertices, err
+	return nil, fmt.Errorf("db: unknown store %q", config.Store)
 }
 
-// NumVertices gets the number of items in the colleciton specified by jobname
-func NumVertices(jobname string) (int, error) {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return 0, err
-	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(jobname)
-	count, err := c.Count()
-	if err != nil {
-		fmt.Println("Couldn't get number of vertices", err)
-		return 0, err
-	}
-	return count, err
+// PrintToFile outputs the vertex id, as it was in the input, and the value of
+// each vertex of the collection into the outfile, one vertex per row
+func PrintToFile(store GraphStore, key string, outfile string) error {
+	return ExportToFile(store, key, outfile, ExportOptions{})
 }
 
-// PrintToFile outpides the vertex id and the value of the
-// vertex into the outfile, one vertex per row
-func PrintToFile(jobname string, outfile string) error {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer session.Close()
-
-	c := session.DB(dbName).C(jobname)
-	var results []DbVertex
-	err = c.Find(nil).All(&results)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	sort.Sort(byVertexID(results))
-
-	file, err := os.Create(outfile)
-	defer file.Close()
-
-	for _, v := range results {
-		str := fmt.Sprintf("%d %g\n", v.VertexID, v.Value)
-		_, err := file.WriteString(str)
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
+// ExternalID produces the id of the vertex in the input. Graphs loaded before
+// vertices were renumbered kept the ids of the input.
+func (v DbVertex) ExternalID() string {
+	if v.Name == "" {
+		return strconv.Itoa(v.VertexID)
 	}
-	return err
+	return v.Name
 }
 
-// DeleteJob deletes the collections associated with a job
-func DeleteJob(a Access) error {
-	session, err := mgo.DialWithInfo(&dialInfo)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer session.Close()
-	primKey := a.Primary
-	secKey := a.Secondary
-	prim := session.DB(dbName).C(primKey)
-	sec := session.DB(dbName).C(secKey)
-	err = prim.DropCollection()
-	if err != nil {
-		fmt.Println("Collection couldn't be dropped", err)
-		return err
-	}
-	err = sec.DropCollection()
-	if err != nil {
-		fmt.Println("Collection couldn't be dropped", err)
-		return err
-	}
-	return err
+// The collections of a new job
+func jobKeys(jobname string) Access {
+	return NewAccess(jobname, jobname+"-secondary")
 }
 
 func createStringArray(vertexMsgs []vertices.VertexMessage) []string {
@@ -0,0 +1,510 @@
+package db
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+// DiskStore keeps the collections of vertices in files under a directory,
+// which the server, workers and client share through the filesystem.
+//
+// Each collection is a directory of segment files, each holding vertices
+// sorted by id. Each Insert writes a batch of the graph as a base segment,
+// and each BatchUpdate adds a segment with the new state of its vertices.
+// Segments are numbered in the order they are written, and the state in the
+// latest one wins. A segment is written to a temporary file first and then
+// linked to its number, so a reader never sees half of one.
+//
+// The manifest of a collection lists its segments in order, with their id
+// ranges, so a read only opens the segments that overlap it. Writers add to
+// it under the collection's lock, so two workers saving a checkpoint at once
+// never take the same number. Once the update segments hold as many vertices
+// as the graph, which is about once a checkpoint, they are compacted into
+// new base segments.
+type DiskStore struct {
+	dir string
+}
+
+// Heads every segment file, and is followed by its vertices.
+type segmentHeader struct {
+	Base  bool // The vertices of the graph, rather than updates to their state
+	Min   int  // Smallest vertex id in the segment
+	Max   int  // Largest vertex id in the segment
+	Count int
+}
+
+// A segment, as listed in the manifest
+type manifestEntry struct {
+	Name   string
+	Header segmentHeader
+}
+
+const manifestFile = "manifest.json"
+const lockFile = "lock"
+
+// How many times a read starts over when a compaction removes a segment
+// from under it.
+const maxReadRetries = 3
+
+// NewDiskStore produces a store keeping its collections under dir, which is
+// created if it doesn't exist.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// The directory of the collection
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key))
+}
+
+// Locks the collection against other writers, in this process or any other
+// sharing the directory, until the returned function is called.
+func (s *DiskStore) lock(key string) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(s.path(key), lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
+
+// Reads the manifest of the collection. A collection without one has no
+// segments.
+func (s *DiskStore) readManifest(key string) ([]manifestEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path(key), manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("db: %v of %v: %v", manifestFile, key, err)
+	}
+	return entries, nil
+}
+
+// Replaces the manifest of the collection. Must be called with the
+// collection locked.
+func (s *DiskStore) writeManifest(key string, entries []manifestEntry) error {
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return replaceFile(s.path(key), manifestFile, data)
+}
+
+// Writes the vertices, which are sorted by id, to a temporary segment file in
+// dir, and returns its path and header. The caller removes the file.
+func writeSegmentFile(dir string, base bool, vs []DbVertex) (string, segmentHeader, error) {
+	header := segmentHeader{Base: base, Min: vs[0].VertexID, Max: vs[len(vs)-1].VertexID, Count: len(vs)}
+	tmp, err := ioutil.TempFile(dir, "segment-*.tmp")
+	if err != nil {
+		return "", header, err
+	}
+
+	enc := gob.NewEncoder(tmp)
+	err = enc.Encode(header)
+	for i := 0; i < len(vs) && err == nil; i++ {
+		err = enc.Encode(vs[i])
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", header, err
+	}
+	return tmp.Name(), header, nil
+}
+
+// Links the temporary segment file in dir under the first free number after
+// the segment last, and returns its name. Must be called with the collection
+// locked.
+func linkSegment(dir string, tmp string, last string) (string, error) {
+	next := 0
+	if last != "" {
+		next, _ = strconv.Atoi(strings.TrimSuffix(last, ".seg"))
+		next++
+	}
+	for {
+		name := fmt.Sprintf("%010d.seg", next)
+		err := os.Link(tmp, filepath.Join(dir, name))
+		if !os.IsExist(err) {
+			return name, err
+		}
+		// Left behind by a writer that failed before adding it to the
+		// manifest
+		next++
+	}
+}
+
+// The name of the last segment in the manifest, if any
+func lastSegment(entries []manifestEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	return entries[len(entries)-1].Name
+}
+
+// Writes the vertices, which are sorted by id, as the next segment of the
+// collection.
+func (s *DiskStore) writeSegment(key string, base bool, vs []DbVertex) error {
+	dir := s.path(key)
+	tmp, header, err := writeSegmentFile(dir, base, vs)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	unlock, err := s.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := s.readManifest(key)
+	if err != nil {
+		return err
+	}
+	name, err := linkSegment(dir, tmp, lastSegment(entries))
+	if err != nil {
+		return err
+	}
+	return s.writeManifest(key, append(entries, manifestEntry{Name: name, Header: header}))
+}
+
+// Reads the header of the segment, and then passes its vertices with ids in
+// [minVal, maxVal) to fn. With maxVal <= minVal, only the header is read.
+func readSegment(path string, minVal int, maxVal int, fn func(v DbVertex, base bool)) (segmentHeader, error) {
+	var header segmentHeader
+	file, err := os.Open(path)
+	if err != nil {
+		return header, err
+	}
+	defer file.Close()
+
+	dec := gob.NewDecoder(file)
+	if err := dec.Decode(&header); err != nil {
+		return header, err
+	}
+	if header.Max < minVal || header.Min >= maxVal {
+		return header, nil
+	}
+	for i := 0; i < header.Count; i++ {
+		var v DbVertex
+		if err := dec.Decode(&v); err != nil {
+			return header, err
+		}
+		if v.VertexID >= minVal && v.VertexID < maxVal {
+			fn(v, header.Base)
+		}
+	}
+	return header, nil
+}
+
+// Gets the latest state of the vertices of the collection with ids in
+// [minVal, maxVal), from the segments in the manifest that overlap them.
+func (s *DiskStore) collect(key string, entries []manifestEntry, minVal int, maxVal int) (map[int]DbVertex, error) {
+	latest := make(map[int]DbVertex)
+	for _, entry := range entries {
+		if entry.Header.Max < minVal || entry.Header.Min >= maxVal {
+			continue
+		}
+		_, err := readSegment(filepath.Join(s.path(key), entry.Name), minVal, maxVal, func(v DbVertex, base bool) {
+			if base {
+				latest[v.VertexID] = v
+			} else if old, ok := latest[v.VertexID]; ok {
+				// Updates don't carry the edges, nor add vertices
+				v.Adjacent = old.Adjacent
+				v.Name = old.Name
+				latest[v.VertexID] = v
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// Like collect, with the current manifest. If a compaction removes a segment
+// before it is read, it starts over with the new manifest.
+func (s *DiskStore) readRange(key string, minVal int, maxVal int) (map[int]DbVertex, error) {
+	for attempt := 0; ; attempt++ {
+		entries, err := s.readManifest(key)
+		if err != nil {
+			return nil, err
+		}
+		latest, err := s.collect(key, entries, minVal, maxVal)
+		if os.IsNotExist(err) && attempt < maxReadRetries {
+			continue
+		}
+		return latest, err
+	}
+}
+
+// The base segments in the manifest, sorted by id.
+func baseSegments(entries []manifestEntry) []manifestEntry {
+	var bases []manifestEntry
+	for _, entry := range entries {
+		if entry.Header.Base {
+			bases = append(bases, entry)
+		}
+	}
+	sort.Sort(byMin(bases))
+	return bases
+}
+
+type byMin []manifestEntry
+
+func (h byMin) Len() int           { return len(h) }
+func (h byMin) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h byMin) Less(i, j int) bool { return h[i].Header.Min < h[j].Header.Min }
+
+// The latest state of the vertices, sorted by id
+func sortedVertices(latest map[int]DbVertex) []DbVertex {
+	vs := make([]DbVertex, 0, len(latest))
+	for _, v := range latest {
+		vs = append(vs, v)
+	}
+	sort.Sort(byVertexID(vs))
+	return vs
+}
+
+// Folds the update segments of the collection into new base segments, one
+// for each of the old ones, once the updates hold at least as many vertices
+// as the graph. The old segments are removed once the new manifest is in
+// place.
+func (s *DiskStore) compactIfDue(key string) error {
+	unlock, err := s.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := s.readManifest(key)
+	if err != nil {
+		return err
+	}
+	numBase, numUpdated := 0, 0
+	for _, entry := range entries {
+		if entry.Header.Base {
+			numBase += entry.Header.Count
+		} else {
+			numUpdated += entry.Header.Count
+		}
+	}
+	if numUpdated == 0 || numUpdated < numBase {
+		return nil
+	}
+
+	dir := s.path(key)
+	var compacted []manifestEntry
+	last := lastSegment(entries)
+	for _, base := range baseSegments(entries) {
+		latest, err := s.collect(key, entries, base.Header.Min, base.Header.Max+1)
+		if err != nil {
+			return err
+		}
+		tmp, header, err := writeSegmentFile(dir, true, sortedVertices(latest))
+		if err != nil {
+			return err
+		}
+		last, err = linkSegment(dir, tmp, last)
+		os.Remove(tmp)
+		if err != nil {
+			return err
+		}
+		compacted = append(compacted, manifestEntry{Name: last, Header: header})
+	}
+	if err := s.writeManifest(key, compacted); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		os.Remove(filepath.Join(dir, entry.Name))
+	}
+	return nil
+}
+
+// CreateJob creates the directories of both collections of the job, which
+// must not exist yet.
+func (s *DiskStore) CreateJob(jobname string) (Access, error) {
+	access := jobKeys(jobname)
+	for _, key := range []string{access.Primary, access.Secondary} {
+		if err := os.Mkdir(s.path(key), 0755); err != nil {
+			return NewAccess("", ""), err
+		}
+		if err := s.writeManifest(key, nil); err != nil {
+			return NewAccess("", ""), err
+		}
+	}
+	return access, nil
+}
+
+// Insert writes the vertices as a base segment of both collections
+func (s *DiskStore) Insert(a Access, vs []DbVertex) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	for _, key := range []string{a.Primary, a.Secondary} {
+		if err := s.writeSegment(key, true, vs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchGet gets the vertices with ids in [minVal, maxVal)
+func (s *DiskStore) BatchGet(key string, minVal int, maxVal int) (map[int]vertices.BaseVertex, error) {
+	bvertices := make(map[int]vertices.BaseVertex)
+	latest, err := s.readRange(key, minVal, maxVal)
+	if err != nil {
+		return bvertices, err
+	}
+	for vid, v := range latest {
+		bvertices[vid] = vertexToBaseVertex(v)
+	}
+	return bvertices, nil
+}
+
+// BatchUpdate writes the state of the vertices as a new segment, and
+// compacts the collection if it is due. Vertices that aren't in the graph are
+// ignored when it is read.
+func (s *DiskStore) BatchUpdate(key string, vertices map[int]vertices.Vertex) error {
+	if len(vertices) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(s.path(key)); err != nil {
+		return err
+	}
+	vs := make([]DbVertex, 0, len(vertices))
+	for _, vertex := range vertices {
+		v := vertexToDBVertex(vertex)
+		v.Adjacent = nil
+		v.Name = ""
+		vs = append(vs, v)
+	}
+	sort.Sort(byVertexID(vs))
+	if err := s.writeSegment(key, false, vs); err != nil {
+		return err
+	}
+	if err := s.compactIfDue(key); err != nil {
+		return fmt.Errorf("db: compacting %v: %v", key, err)
+	}
+	return nil
+}
+
+// NumVertices adds up the vertices of the base segments in the manifest
+func (s *DiskStore) NumVertices(key string) (int, error) {
+	entries, err := s.readManifest(key)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range baseSegments(entries) {
+		count += entry.Header.Count
+	}
+	return count, nil
+}
+
+// Export reads the collection one base segment at a time, along with the
+// updates that overlap it
+func (s *DiskStore) Export(key string, emit func(DbVertex) error) error {
+	entries, err := s.readManifest(key)
+	if err != nil {
+		return err
+	}
+	for _, base := range baseSegments(entries) {
+		latest, err := s.collect(key, entries, base.Header.Min, base.Header.Max+1)
+		if os.IsNotExist(err) {
+			// Compacted meanwhile
+			latest, err = s.readRange(key, base.Header.Min, base.Header.Max+1)
+		}
+		if err != nil {
+			return err
+		}
+		for _, v := range sortedVertices(latest) {
+			if err := emit(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The statistics of a job are kept as JSON in the directory of its primary
+// collection, beside the segments.
+const statsFile = "stats.json"
+
+// SaveStats writes the statistics to a temporary file and then renames it,
+// so a reader never sees half of them.
+func (s *DiskStore) SaveStats(a Access, stats *GraphStats) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return replaceFile(s.path(a.Primary), statsFile, data)
+}
+
+// Writes data to a temporary file in dir, and then renames it to name.
+func replaceFile(dir string, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Stats reads the saved statistics
+func (s *DiskStore) Stats(a Access) (*GraphStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path(a.Primary), statsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stats := &GraphStats{}
+	if err := json.Unmarshal(data, stats); err != nil {
+		return nil, fmt.Errorf("db: %v: %v", statsFile, err)
+	}
+	return stats, nil
+}
+
+// DeleteJob removes the directories of both collections, and the statistics
+// with them
+func (s *DiskStore) DeleteJob(a Access) error {
+	if err := os.RemoveAll(s.path(a.Primary)); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.path(a.Secondary))
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ****************************************************************************
+// The results of a job are exported from its collection as it is read, one
+// vertex at a time, in one of the ExportFormats. Only the top vertices by
+// value, or those a filter picks, may be exported; the top k are kept in a
+// heap of k vertices, so not even they need all the graph in memory.
+
+// ExportFormats are the names of the result formats:
+//
+//	text:  the fields separated by spaces, as PrintToFile writes them
+//	tsv:   tab separated, with a header of the field names
+//	csv:   comma separated, with a header of the field names
+//	jsonl: JSON Lines, an object of the fields for each vertex
+var ExportFormats = []string{"text", "tsv", "csv", "jsonl"}
+
+// ExportFields are the fields of a vertex's state that can be exported:
+// its id in the input, its value, its number of out-edges, whether it is
+// still active, and the superstep it was last saved at.
+var ExportFields = []string{"id", "value", "degree", "active", "superstep"}
+
+// ExportOptions say how to export the results of a job.
+type ExportOptions struct {
+	Format string   // One of the ExportFormats; text if empty
+	Fields []string // Some of the ExportFields, in order; id and value if empty
+	Top    int      // Only export the Top vertices by value, highest first, if > 0
+	Filter *Filter  // Only export the vertices that match, if not nil
+}
+
+// Export writes the vertices of the collection to w. Unless opts.Top is set,
+// they are written in order of vertex id.
+func Export(store GraphStore, key string, w io.Writer, opts ExportOptions) error {
+	if opts.Format == "" {
+		opts.Format = "text"
+	}
+	if len(opts.Fields) == 0 {
+		opts.Fields = []string{"id", "value"}
+	}
+	for _, field := range opts.Fields {
+		if !isExportField(field) {
+			return fmt.Errorf("db: unknown field %q, expected some of %v", field, ExportFields)
+		}
+	}
+	out, err := newVertexWriter(opts.Format, w, opts.Fields)
+	if err != nil {
+		return err
+	}
+
+	top := &topVertices{}
+	err = store.Export(key, func(v DbVertex) error {
+		if opts.Filter != nil && !opts.Filter.Match(v) {
+			return nil
+		}
+		if opts.Top <= 0 {
+			return out.write(v)
+		}
+		if top.Len() < opts.Top {
+			heap.Push(top, v)
+		} else if v.Value > (*top)[0].Value {
+			(*top)[0] = v
+			heap.Fix(top, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(sort.Reverse(top))
+	for _, v := range *top {
+		if err := out.write(v); err != nil {
+			return err
+		}
+	}
+	return out.flush()
+}
+
+// ExportToFile exports the vertices of the collection to the file outfile,
+// or to the standard output if outfile is "-".
+func ExportToFile(store GraphStore, key string, outfile string, opts ExportOptions) error {
+	if outfile == "-" {
+		return Export(store, key, os.Stdout, opts)
+	}
+	file, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	err = Export(store, key, file, opts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func isExportField(field string) bool {
+	for _, f := range ExportFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// The vertices of highest value seen so far, in a heap with the lowest
+// first. Vertices of equal value are ordered by id, lowest highest.
+type topVertices []DbVertex
+
+func (t topVertices) Len() int      { return len(t) }
+func (t topVertices) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t topVertices) Less(i, j int) bool {
+	return t[i].Value < t[j].Value || (t[i].Value == t[j].Value && t[i].VertexID > t[j].VertexID)
+}
+
+func (t *topVertices) Push(x interface{}) {
+	*t = append(*t, x.(DbVertex))
+}
+
+func (t *topVertices) Pop() interface{} {
+	old := *t
+	v := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return v
+}
+
+//============================================================
+// Formats
+
+// Writes vertices in one of the ExportFormats
+type vertexWriter struct {
+	format  string
+	fields  []string
+	w       *bufio.Writer
+	csv     *csv.Writer // For csv and tsv
+	started bool
+}
+
+func newVertexWriter(format string, w io.Writer, fields []string) (*vertexWriter, error) {
+	out := &vertexWriter{format: format, fields: fields, w: bufio.NewWriter(w)}
+	switch format {
+	case "text", "jsonl":
+	case "csv", "tsv":
+		out.csv = csv.NewWriter(out.w)
+		if format == "tsv" {
+			out.csv.Comma = '\t'
+		}
+	default:
+		return nil, fmt.Errorf("db: unknown export format %q, expected one of %v", format, ExportFormats)
+	}
+	return out, nil
+}
+
+// The value of a field of the vertex, as it is written in text
+func fieldText(v DbVertex, field string) string {
+	switch field {
+	case "id":
+		return v.ExternalID()
+	case "value":
+		return strconv.FormatFloat(v.Value, 'g', -1, 64)
+	case "degree":
+		return strconv.Itoa(len(v.Adjacent))
+	case "active":
+		return strconv.FormatBool(v.Active)
+	case "superstep":
+		return strconv.Itoa(v.Superstep)
+	}
+	return ""
+}
+
+// The value of a field of the vertex, as it is written in JSON
+func fieldValue(v DbVertex, field string) interface{} {
+	switch field {
+	case "id":
+		return v.ExternalID()
+	case "value":
+		return v.Value
+	case "degree":
+		return len(v.Adjacent)
+	case "active":
+		return v.Active
+	case "superstep":
+		return v.Superstep
+	}
+	return nil
+}
+
+func (out *vertexWriter) write(v DbVertex) error {
+	record := make([]string, len(out.fields))
+	for i, field := range out.fields {
+		record[i] = fieldText(v, field)
+	}
+	switch out.format {
+	case "text":
+		_, err := fmt.Fprintln(out.w, strings.Join(record, " "))
+		return err
+	case "jsonl":
+		// The fields are written in the order they were asked for, which a
+		// map wouldn't keep.
+		out.w.WriteByte('{')
+		for i, field := range out.fields {
+			if i > 0 {
+				out.w.WriteByte(',')
+			}
+			value, err := json.Marshal(fieldValue(v, field))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out.w, "%q:%s", field, value)
+		}
+		_, err := out.w.WriteString("}\n")
+		return err
+	}
+	if !out.started {
+		out.started = true
+		if err := out.csv.Write(out.fields); err != nil {
+			return err
+		}
+	}
+	return out.csv.Write(record)
+}
+
+// Writes whatever is buffered; a csv or tsv export with no vertices still
+// gets its header.
+func (out *vertexWriter) flush() error {
+	if out.csv != nil {
+		if !out.started {
+			out.started = true
+			out.csv.Write(out.fields)
+		}
+		out.csv.Flush()
+		if err := out.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return out.w.Flush()
+}
+
+//============================================================
+// Filters
+
+// Filter picks the vertices to export by comparing a field of each with a
+// number, e.g. value>=0.01 or degree=0. The active field is compared as 1 or
+// 0.
+type Filter struct {
+	Field string
+	Op    string
+	Value float64
+}
+
+// The comparisons of a Filter, longest first so that <= isn't read as <
+var filterOps = []string{"<=", ">=", "!=", "<", ">", "="}
+
+// ParseFilter parses a filter of the form <field><op><number>, where the
+// field is any of the ExportFields but id and op is one of <, <=, >, >=, =
+// or !=.
+func ParseFilter(expr string) (*Filter, error) {
+	for i := range expr {
+		for _, op := range filterOps {
+			if !strings.HasPrefix(expr[i:], op) {
+				continue
+			}
+			field := strings.TrimSpace(expr[:i])
+			if field == "id" || !isExportField(field) {
+				return nil, fmt.Errorf("db: filter %q: cannot filter on %q", expr, field)
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(expr[i+len(op):]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("db: filter %q: %v", expr, err)
+			}
+			return &Filter{Field: field, Op: op, Value: value}, nil
+		}
+	}
+	return nil, fmt.Errorf("db: filter %q: expected <field><op><number>", expr)
+}
+
+// Match says whether the vertex passes the filter
+func (f *Filter) Match(v DbVertex) bool {
+	var x float64
+	switch f.Field {
+	case "value":
+		x = v.Value
+	case "degree":
+		x = float64(len(v.Adjacent))
+	case "active":
+		if v.Active {
+			x = 1
+		}
+	case "superstep":
+		x = float64(v.Superstep)
+	}
+	switch f.Op {
+	case "<":
+		return x < f.Value
+	case "<=":
+		return x <= f.Value
+	case ">":
+		return x > f.Value
+	case ">=":
+		return x >= f.Value
+	case "=":
+		return x == f.Value
+	case "!=":
+		return x != f.Value
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A store with the results of a job on the graph a>b, a>c, b>c, c>a, d>a.
+func exportStore() (GraphStore, string) {
+	store := NewMemoryStore()
+	access, err := store.CreateJob("job")
+	test("create", nil, err)
+	vs := []DbVertex{
+		{VertexID: 0, Name: "a", Value: 0.4, Adjacent: []int{1, 2}, Active: true, Superstep: 3},
+		{VertexID: 1, Name: "b", Value: 0.1, Adjacent: []int{2}, Superstep: 3},
+		{VertexID: 2, Name: "c", Value: 0.3, Adjacent: []int{0}, Superstep: 3},
+		{VertexID: 3, Name: "d", Value: 0.1, Adjacent: []int{0}, Superstep: 3},
+	}
+	test("insert", nil, store.Insert(access, vs))
+	return store, access.Key()
+}
+
+func export(store GraphStore, key string, opts ExportOptions) string {
+	var out bytes.Buffer
+	test("export "+opts.Format, nil, Export(store, key, &out, opts))
+	return out.String()
+}
+
+func TestExport(tee *testing.T) {
+	t = tee
+	store, key := exportStore()
+
+	test("text", "a 0.4\nb 0.1\nc 0.3\nd 0.1\n", export(store, key, ExportOptions{}))
+	fields := []string{"id", "value", "degree", "active", "superstep"}
+	test("tsv", "id\tvalue\tdegree\tactive\tsuperstep\nb\t0.1\t1\tfalse\t3\nd\t0.1\t1\tfalse\t3\n",
+		export(store, key, ExportOptions{Format: "tsv", Fields: fields, Filter: &Filter{"value", "<", 0.2}}))
+	test("csv empty", "id,value\n", export(store, key, ExportOptions{Format: "csv", Filter: &Filter{"degree", ">", 5}}))
+	test("jsonl", `{"value":0.4,"id":"a","active":true}`+"\n"+`{"value":0.3,"id":"c","active":false}`+"\n",
+		export(store, key, ExportOptions{Format: "jsonl", Fields: []string{"value", "id", "active"}, Top: 2}))
+
+	// Ties are broken by the lower vertex id
+	test("top", "a 0.4\nc 0.3\nb 0.1\n", export(store, key, ExportOptions{Top: 3}))
+	test("top filtered", "c 0.3\nb 0.1\n", export(store, key, ExportOptions{Top: 2, Filter: &Filter{"degree", "=", 1}}))
+
+	var out bytes.Buffer
+	test("unknown format", true, Export(store, key, &out, ExportOptions{Format: "xml"}) != nil)
+	test("unknown field", true, Export(store, key, &out, ExportOptions{Fields: []string{"name"}}) != nil)
+
+	dir, _ := writeGraph("")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.csv")
+	test("to file", nil, ExportToFile(store, key, path, ExportOptions{Format: "csv", Top: 1}))
+	written, _ := ioutil.ReadFile(path)
+	test("written", "id,value\na,0.4\n", string(written))
+	test("no directory", true, ExportToFile(store, key, filepath.Join(dir, "none", "out"), ExportOptions{}) != nil)
+}
+
+func TestParseFilter(tee *testing.T) {
+	t = tee
+	for expr, want := range map[string]Filter{
+		"value>=0.01":  {"value", ">=", 0.01},
+		"degree = 0":   {"degree", "=", 0},
+		"active!=1":    {"active", "!=", 1},
+		"superstep<10": {"superstep", "<", 10},
+	} {
+		f, err := ParseFilter(expr)
+		test(expr, nil, err)
+		if err == nil {
+			test(expr, want, *f)
+		}
+	}
+	for _, expr := range []string{"value", "id>3", "name=1", "value>x"} {
+		_, err := ParseFilter(expr)
+		test(expr, true, err != nil && strings.HasPrefix(err.Error(), "db: filter"))
+	}
+}
@@ -0,0 +1,536 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ****************************************************************************
+// Graphs can be loaded from several formats. Each is read by an EdgeReader,
+// which turns it into a stream of edges between vertices named by their ids
+// in the input. Edge weights are checked but dropped, since vertex programs
+// don't use them.
+//
+// The format is not kept with the job. It only matters while the graph is
+// loaded: whatever it was, the store holds the same renumbered vertices with
+// their input ids, which is all the jobs and the results use.
+
+// Formats are the names of the graph formats, besides "auto":
+//
+//	edges: one "from to [weight]" edge per line, # comments (e.g. SNAP's Wiki-Vote)
+//	csv, tsv: comma or tab separated edges, with an optional header naming
+//	          the source, target and weight columns
+//	adj:   adjacency lists, a vertex and then its out-neighbours on each line
+//	mtx:   Matrix Market coordinate files, one edge per nonzero entry
+//	metis: METIS graph files, undirected, with vertices numbered from 1
+var Formats = []string{"edges", "csv", "tsv", "adj", "mtx", "metis"}
+
+// The longest line read, e.g. the adjacency list of a big vertex
+const maxLineLength = 64 << 20
+
+// EdgeReader reads the edges of a graph.
+type EdgeReader interface {
+	// Next produces the ids of the next edge's source and destination. A
+	// destination of "" only says that the source is a vertex, which may
+	// have no edges. After the last edge, Next returns io.EOF. A malformed
+	// line gives a *LineError, and reading can carry on after it.
+	Next() (from string, to string, err error)
+}
+
+// LineError is a malformed line of a graph file.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// NewEdgeReader produces a reader of the graph in r, in one of the Formats.
+func NewEdgeReader(format string, r io.Reader) (EdgeReader, error) {
+	switch format {
+	case "edges":
+		return &edgeListReader{lines: newLines(r)}, nil
+	case "csv":
+		return newCSVReader(r, ','), nil
+	case "tsv":
+		return newCSVReader(r, '\t'), nil
+	case "adj":
+		return &adjacencyReader{lines: newLines(r)}, nil
+	case "mtx":
+		return &matrixMarketReader{lines: newLines(r)}, nil
+	case "metis":
+		return &metisReader{lines: newLines(r)}, nil
+	}
+	return nil, fmt.Errorf("db: unknown graph format %q, expected one of %v", format, Formats)
+}
+
+// OpenGraph opens the graph file in the given format. With format "auto", the
+// format is guessed from the file's extension, or failing that its first
+// line. Files compressed with gzip are decompressed as they are read.
+func OpenGraph(filename string, format string) (EdgeReader, io.Closer, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = bufio.NewReader(file)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		r = bufio.NewReader(gz)
+	}
+	if format == "auto" {
+		format = detectFormat(filename, r.(*bufio.Reader))
+	}
+	edges, err := NewEdgeReader(format, r)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return edges, file, nil
+}
+
+var formatsByExtension = map[string]string{
+	".txt":     "edges",
+	".edges":   "edges",
+	".csv":     "csv",
+	".tsv":     "tsv",
+	".adj":     "adj",
+	".adjlist": "adj",
+	".mtx":     "mtx",
+	".graph":   "metis",
+	".metis":   "metis",
+}
+
+func detectFormat(filename string, r *bufio.Reader) string {
+	name := strings.TrimSuffix(strings.ToLower(filename), ".gz")
+	if format, ok := formatsByExtension[filepath.Ext(name)]; ok {
+		return format
+	}
+	if start, _ := r.Peek(len(mtxBanner)); strings.EqualFold(string(start), mtxBanner) {
+		return "mtx"
+	}
+	return "edges"
+}
+
+//============================================================
+// Line based formats
+
+// The lines of a graph file, counted from 1.
+type lines struct {
+	scanner *bufio.Scanner
+	num     int
+	pending [][2]string // Edges read but not yet returned
+}
+
+func newLines(r io.Reader) *lines {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	return &lines{scanner: scanner}
+}
+
+// Produces the next line, with surrounding space trimmed, or io.EOF. A
+// failure to read, such as a truncated gzip file or a line that is too long,
+// is returned as it is rather than as a *LineError, since reading can't
+// carry on after it.
+func (l *lines) next() (string, error) {
+	if !l.scanner.Scan() {
+		if err := l.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	l.num++
+	return strings.TrimSpace(l.scanner.Text()), nil
+}
+
+// Produces the next line that isn't empty or a comment.
+func (l *lines) nextContent(comment string) (string, error) {
+	for {
+		line, err := l.next()
+		if err != nil || (line != "" && !strings.HasPrefix(line, comment)) {
+			return line, err
+		}
+	}
+}
+
+func (l *lines) malformed(format string, args ...interface{}) error {
+	return &LineError{l.num, fmt.Errorf(format, args...)}
+}
+
+func (l *lines) add(from string, to string) {
+	l.pending = append(l.pending, [2]string{from, to})
+}
+
+// Returns the next pending edge, if there is one.
+func (l *lines) pop() (from string, to string, ok bool) {
+	if len(l.pending) == 0 {
+		return "", "", false
+	}
+	e := l.pending[0]
+	l.pending = l.pending[1:]
+	return e[0], e[1], true
+}
+
+// Parses a 1-based vertex number that is at most max.
+func parseIndex(field string, max int) error {
+	i, err := strconv.Atoi(field)
+	if err != nil || i < 1 || i > max {
+		return fmt.Errorf("%q is not a vertex from 1 to %d", field, max)
+	}
+	return nil
+}
+
+func parseWeight(field string) error {
+	if _, err := strconv.ParseFloat(field, 64); err != nil {
+		return fmt.Errorf("%q is not a weight", field)
+	}
+	return nil
+}
+
+type edgeListReader struct {
+	lines *lines
+}
+
+func (r *edgeListReader) Next() (string, string, error) {
+	line, err := r.lines.nextContent("#")
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return "", "", r.lines.malformed("expected two vertex ids and an optional weight, found %d fields", len(fields))
+	}
+	if len(fields) == 3 {
+		if err := parseWeight(fields[2]); err != nil {
+			return "", "", &LineError{r.lines.num, err}
+		}
+	}
+	return fields[0], fields[1], nil
+}
+
+type adjacencyReader struct {
+	lines *lines
+}
+
+func (r *adjacencyReader) Next() (string, string, error) {
+	for {
+		if from, to, ok := r.lines.pop(); ok {
+			return from, to, nil
+		}
+		line, err := r.lines.nextContent("#")
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(line)
+		r.lines.add(fields[0], "")
+		for _, to := range fields[1:] {
+			r.lines.add(fields[0], to)
+		}
+	}
+}
+
+// The first line of a Matrix Market file
+const mtxBanner = "%%MatrixMarket"
+
+// Reads a Matrix Market coordinate file as the graph with an edge from i to j
+// for each nonzero entry (i, j). A symmetric matrix has the edge both ways.
+// Every row and column is a vertex, even one without entries.
+type matrixMarketReader struct {
+	lines      *lines
+	symmetric  bool
+	numFields  int // Fields of an entry
+	size       int // Number of vertices, once the size line is read
+	rows, cols int
+	declared   int // Vertices returned so far on their own
+}
+
+func (r *matrixMarketReader) Next() (string, string, error) {
+	if r.lines.num == 0 {
+		if err := r.readHeader(); err != nil {
+			return "", "", err
+		}
+	}
+	if r.declared < r.size {
+		r.declared++
+		return strconv.Itoa(r.declared), "", nil
+	}
+	for {
+		if from, to, ok := r.lines.pop(); ok {
+			return from, to, nil
+		}
+		line, err := r.lines.nextContent("%")
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(line)
+		if len(fields) != r.numFields {
+			return "", "", r.lines.malformed("expected an entry of %d fields, found %d", r.numFields, len(fields))
+		}
+		if err := parseIndex(fields[0], r.rows); err != nil {
+			return "", "", r.lines.malformed("%v", err)
+		}
+		if err := parseIndex(fields[1], r.cols); err != nil {
+			return "", "", r.lines.malformed("%v", err)
+		}
+		for _, value := range fields[2:] {
+			if err := parseWeight(value); err != nil {
+				return "", "", r.lines.malformed("%v", err)
+			}
+		}
+		r.lines.add(fields[0], fields[1])
+		if r.symmetric && fields[0] != fields[1] {
+			r.lines.add(fields[1], fields[0])
+		}
+	}
+}
+
+// Reads the banner and the size line. Errors in them are fatal.
+func (r *matrixMarketReader) readHeader() error {
+	banner, err := r.lines.next()
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(strings.ToLower(banner))
+	if len(fields) != 5 || fields[0] != strings.ToLower(mtxBanner) || fields[1] != "matrix" {
+		return fmt.Errorf("line 1: not a Matrix Market file")
+	}
+	if fields[2] != "coordinate" {
+		return fmt.Errorf("line 1: only coordinate matrices are graphs, not %v", fields[2])
+	}
+	switch fields[3] {
+	case "pattern":
+		r.numFields = 2
+	case "real", "integer":
+		r.numFields = 3
+	case "complex":
+		r.numFields = 4
+	default:
+		return fmt.Errorf("line 1: unknown field %v", fields[3])
+	}
+	r.symmetric = fields[4] != "general"
+
+	line, err := r.lines.nextContent("%")
+	if err == io.EOF {
+		return fmt.Errorf("line %d: no size line", r.lines.num)
+	} else if err != nil {
+		return err
+	}
+	size := strings.Fields(line)
+	if len(size) != 3 {
+		return fmt.Errorf("line %d: expected rows, columns and entries", r.lines.num)
+	}
+	if r.rows, err = strconv.Atoi(size[0]); err == nil {
+		r.cols, err = strconv.Atoi(size[1])
+	}
+	if err != nil {
+		return fmt.Errorf("line %d: %v", r.lines.num, err)
+	}
+	r.size = r.rows
+	if r.cols > r.size {
+		r.size = r.cols
+	}
+	return nil
+}
+
+// Reads a METIS graph file: a header with the number of vertices, and then a
+// line for each vertex, numbered from 1, listing its neighbours.
+type metisReader struct {
+	lines       *lines
+	numVertices int
+	vertex      int // The vertex of the last line read
+	skip        int // Vertex size and weights at the start of each line
+	edgeWeights bool
+}
+
+func (r *metisReader) Next() (string, string, error) {
+	if r.lines.num == 0 {
+		if err := r.readHeader(); err != nil {
+			return "", "", err
+		}
+	}
+	for {
+		if from, to, ok := r.lines.pop(); ok {
+			return from, to, nil
+		}
+		line, err := r.lines.next()
+		if err == io.EOF && r.vertex < r.numVertices {
+			found := r.vertex
+			r.vertex = r.numVertices
+			return "", "", r.lines.malformed("expected %d vertices, found %d", r.numVertices, found)
+		} else if err != nil {
+			return "", "", err
+		}
+		if strings.HasPrefix(line, "%") {
+			continue
+		}
+		if r.vertex == r.numVertices {
+			if line != "" {
+				return "", "", r.lines.malformed("more lines than the %d vertices", r.numVertices)
+			}
+			continue
+		}
+
+		// An empty line is a vertex without neighbours
+		r.vertex++
+		from := strconv.Itoa(r.vertex)
+		r.lines.add(from, "")
+		fields := strings.Fields(line)
+		if len(fields) < r.skip {
+			return "", "", r.lines.malformed("expected %d vertex weights", r.skip)
+		}
+		step := 1
+		if r.edgeWeights {
+			step = 2
+		}
+		fields = fields[r.skip:]
+		if len(fields)%step != 0 {
+			return "", "", r.lines.malformed("expected a weight after every neighbour")
+		}
+		for i := 0; i < len(fields); i += step {
+			if err := parseIndex(fields[i], r.numVertices); err != nil {
+				return "", "", r.lines.malformed("%v", err)
+			}
+			if r.edgeWeights {
+				if err := parseWeight(fields[i+1]); err != nil {
+					return "", "", r.lines.malformed("%v", err)
+				}
+			}
+			r.lines.add(from, fields[i])
+		}
+	}
+}
+
+// Reads the header: n m [fmt [ncon]]. Errors in it are fatal.
+func (r *metisReader) readHeader() error {
+	line, err := r.lines.nextContent("%")
+	if err == io.EOF {
+		return fmt.Errorf("line %d: no header", r.lines.num)
+	} else if err != nil {
+		return err
+	}
+	header := strings.Fields(line)
+	if len(header) < 2 || len(header) > 4 {
+		return fmt.Errorf("line %d: expected a header of 2 to 4 fields", r.lines.num)
+	}
+	if r.numVertices, err = strconv.Atoi(header[0]); err != nil {
+		return fmt.Errorf("line %d: %v", r.lines.num, err)
+	}
+	format := "000"
+	if len(header) > 2 {
+		format = header[2]
+		if len(format) < 3 {
+			format = strings.Repeat("0", 3-len(format)) + format
+		}
+	}
+	if len(format) != 3 || strings.Trim(format, "01") != "" {
+		return fmt.Errorf("line %d: unknown format %v", r.lines.num, header[2])
+	}
+	ncon := 1
+	if len(header) > 3 {
+		if ncon, err = strconv.Atoi(header[3]); err != nil {
+			return fmt.Errorf("line %d: %v", r.lines.num, err)
+		}
+	}
+	if format[0] == '1' {
+		r.skip++
+	}
+	if format[1] == '1' {
+		r.skip += ncon
+	}
+	r.edgeWeights = format[2] == '1'
+	return nil
+}
+
+//============================================================
+// CSV and TSV
+
+// Names of the columns a header can give
+var (
+	sourceColumns = []string{"source", "src", "from", "from_id", "source_id"}
+	targetColumns = []string{"target", "dst", "dest", "destination", "to", "to_id", "target_id"}
+	weightColumns = []string{"weight", "w", "value"}
+)
+
+// Reads comma or tab separated edges. If the first record names a source and
+// a target column, it is the header; otherwise the first two columns are the
+// source and target, and the third, if there is one, the weight.
+type csvReader struct {
+	reader  *csv.Reader
+	started bool
+	source  int
+	target  int
+	weight  int // -1 for none
+}
+
+func newCSVReader(r io.Reader, delimiter rune) *csvReader {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+	return &csvReader{reader: reader, source: 0, target: 1, weight: 2}
+}
+
+func column(header []string, names []string) int {
+	for i, field := range header {
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (r *csvReader) Next() (string, string, error) {
+	for {
+		record, err := r.reader.Read()
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return "", "", &LineError{parseErr.Line, parseErr.Err}
+		} else if err != nil {
+			return "", "", err
+		}
+		line, _ := r.reader.FieldPos(0)
+		if !r.started {
+			r.started = true
+			source, target := column(record, sourceColumns), column(record, targetColumns)
+			if source >= 0 && target >= 0 {
+				r.source, r.target = source, target
+				r.weight = column(record, weightColumns)
+				continue
+			}
+		}
+
+		needed := r.source
+		if r.target > needed {
+			needed = r.target
+		}
+		if len(record) <= needed {
+			return "", "", &LineError{line, fmt.Errorf("expected %d fields, found %d", needed+1, len(record))}
+		}
+		if r.weight >= 0 && r.weight < len(record) {
+			if err := parseWeight(strings.TrimSpace(record[r.weight])); err != nil {
+				return "", "", &LineError{line, err}
+			}
+		}
+		from, to := strings.TrimSpace(record[r.source]), strings.TrimSpace(record[r.target])
+		if from == "" || to == "" {
+			return "", "", &LineError{line, fmt.Errorf("empty vertex id")}
+		}
+		return from, to, nil
+	}
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Reads every edge, as from>to or just the vertex, and every malformed line.
+func readAll(edges EdgeReader) (read []string, malformed []string) {
+	for {
+		from, to, err := edges.Next()
+		if err == io.EOF {
+			return read, malformed
+		} else if err != nil {
+			malformed = append(malformed, err.Error())
+			if _, ok := err.(*LineError); !ok {
+				return read, malformed
+			}
+		} else if to == "" {
+			read = append(read, from)
+		} else {
+			read = append(read, from+">"+to)
+		}
+	}
+}
+
+func readFormat(format string, input string) ([]string, []string) {
+	edges, err := NewEdgeReader(format, strings.NewReader(input))
+	test("format "+format, nil, err)
+	return readAll(edges)
+}
+
+func TestFormats(tee *testing.T) {
+	t = tee
+	var none []string
+
+	read, bad := readFormat("edges", "# from to\na b\n\nb  c\nc\n")
+	test("edges", []string{"a>b", "b>c"}, read)
+	test("edges malformed", []string{"line 5: expected two vertex ids and an optional weight, found 1 fields"}, bad)
+
+	read, bad = readFormat("edges", "a b 0.5\nb c 2\nc a x\na b c d\n")
+	test("weighted edges", []string{"a>b", "b>c"}, read)
+	test("weighted edges malformed", []string{`line 3: "x" is not a weight`,
+		"line 4: expected two vertex ids and an optional weight, found 4 fields"}, bad)
+
+	read, bad = readFormat("csv", "weight,Target,source\n0.5,b,a\n# comment\n1,\"c, d\",b\nx,a,c\n2,a\n")
+	test("csv", []string{"a>b", "b>c, d"}, read)
+	test("csv malformed", []string{`line 5: "x" is not a weight`, "line 6: expected 3 fields, found 2"}, bad)
+
+	read, bad = readFormat("tsv", "1\t2\t0.5\n2\t3\n")
+	test("tsv without header", []string{"1>2", "2>3"}, read)
+	test("tsv malformed", none, bad)
+
+	read, bad = readFormat("adj", "# vertex neighbours\n1 2 3\n2\n3 1\n")
+	test("adj", []string{"1", "1>2", "1>3", "2", "3", "3>1"}, read)
+	test("adj malformed", none, bad)
+
+	mtx := "%%MatrixMarket matrix coordinate real symmetric\n% comment\n4 4 3\n2 1 0.5\n3 3 1\n4 9 1\n1 2 x\n"
+	read, bad = readFormat("mtx", mtx)
+	test("mtx", []string{"1", "2", "3", "4", "2>1", "1>2", "3>3"}, read)
+	test("mtx malformed", []string{`line 6: "9" is not a vertex from 1 to 4`, `line 7: "x" is not a weight`}, bad)
+
+	_, bad = readFormat("mtx", "%%MatrixMarket matrix array real general\n2 2\n")
+	test("mtx array", []string{"line 1: only coordinate matrices are graphs, not array"}, bad)
+
+	// Vertex 3 has no neighbours, and the edges have weights
+	metis := "% comment\n3 2 001\n2 5 3 1\n1 5\n\n"
+	read, bad = readFormat("metis", metis)
+	test("metis", []string{"1", "1>2", "1>3", "2", "2>1", "3"}, read)
+	test("metis malformed", none, bad)
+
+	read, bad = readFormat("metis", "3 1 110\n1 2\n7 4 3\n")
+	test("metis vertex size and weight", []string{"1", "2", "2>3"}, read)
+	test("metis missing vertex", []string{"line 3: expected 3 vertices, found 2"}, bad)
+
+	_, err := NewEdgeReader("xml", strings.NewReader(""))
+	test("unknown format", true, err != nil)
+}
+
+// The format is told from the name, or the contents, of a file that may be
+// compressed.
+func TestOpenGraph(tee *testing.T) {
+	t = tee
+	dir, _ := writeGraph("")
+	defer os.RemoveAll(dir)
+
+	write := func(name string, contents string, compress bool) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		test("create", nil, err)
+		defer file.Close()
+		if compress {
+			gz := gzip.NewWriter(file)
+			io.WriteString(gz, contents)
+			test("compress", nil, gz.Close())
+		} else {
+			io.WriteString(file, contents)
+		}
+		return path
+	}
+	open := func(path string, format string) []string {
+		edges, closer, err := OpenGraph(path, format)
+		test("open "+path, nil, err)
+		if err != nil {
+			return nil
+		}
+		defer closer.Close()
+		read, _ := readAll(edges)
+		return read
+	}
+
+	test("by extension", []string{"1>2"}, open(write("g.csv.gz", "src,dst\n1,2\n", true), "auto"))
+	test("by contents", []string{"1", "2", "1>2"}, open(write("g", "%%MatrixMarket matrix coordinate pattern general\n2 2 1\n1 2\n", false), "auto"))
+	test("edge list", []string{"1>2"}, open(write("g.gz", "1 2\n", true), "auto"))
+	test("named", []string{"1", "1>2"}, open(write("g.txt", "1 2\n", false), "adj"))
+}
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ****************************************************************************
+// A graph is loaded without ever holding all of it in memory. Its edges are
+// sorted by source vertex in runs of up to runSize edges; runs that don't fit
+// are spilled to temporary files. The runs are then merged, and the vertices
+// come out in order of id with all their out-edges, to be inserted into the
+// store batchSize at a time.
+//
+// The vertices are renumbered as they are read, from 0 up to the number of
+// vertices, since the graph is partitioned by ranges of ids. The id each has
+// in the input can be anything, and is stored with it to write out the
+// results. Only this dictionary of ids is kept in memory.
+
+// The most edges sorted in memory at once
+const runSize = 1 << 20
+
+// The most vertices inserted into the store at once
+const batchSize = 10000
+
+// The most malformed lines listed in a MalformedError
+const maxReported = 10
+
+// How often to print how far loading has got
+const progressInterval = 5 * time.Second
+
+// An edge of the graph. An edge to noVertex only says that from is a vertex,
+// so that vertices without out-edges are loaded too.
+type edge struct {
+	from int
+	to   int
+}
+
+const noVertex = -1
+
+type byEdge []edge
+
+func (e byEdge) Len() int      { return len(e) }
+func (e byEdge) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byEdge) Less(i, j int) bool {
+	return e[i].from < e[j].from || (e[i].from == e[j].from && e[i].to < e[j].to)
+}
+
+// MalformedError is returned when lines of a graph file are malformed. None
+// of the graph is loaded then.
+type MalformedError struct {
+	Count int      // Number of malformed lines
+	Lines []string // The first few of them, with their line numbers
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("%d malformed lines in the graph:\n%s", e.Count, strings.Join(e.Lines, "\n"))
+}
+
+// Gives the vertices dense ids in the order they first appear, and remembers
+// the id each had in the input.
+type dictionary struct {
+	ids   map[string]int
+	names []string
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{ids: make(map[string]int)}
+}
+
+// The dense id of the vertex with the given input id. Numeric ids are the
+// same vertex however they are written, e.g. 7 and 007.
+func (d *dictionary) id(name string) int {
+	if n, err := strconv.Atoi(name); err == nil {
+		name = strconv.Itoa(n)
+	}
+	id, ok := d.ids[name]
+	if !ok {
+		id = len(d.names)
+		d.ids[name] = id
+		d.names = append(d.names, name)
+	}
+	return id
+}
+
+// Prints how far loading has got, at most every progressInterval.
+type progress struct {
+	last time.Time
+}
+
+func (p *progress) print(format string, args ...interface{}) {
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+//============================================================
+// Sorted runs of edges
+
+// Collects the edges, and spills them to a file in dir every runSize edges.
+type spiller struct {
+	dir     string
+	runSize int
+	edges   []edge
+	runs    []string
+}
+
+func (s *spiller) add(e edge) error {
+	s.edges = append(s.edges, e)
+	if len(s.edges) >= s.runSize {
+		return s.spill()
+	}
+	return nil
+}
+
+// Sorts the edges in memory and writes them as a run.
+func (s *spiller) spill() error {
+	sort.Sort(byEdge(s.edges))
+	path := filepath.Join(s.dir, fmt.Sprintf("run-%d", len(s.runs)))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	for _, e := range s.edges {
+		n := binary.PutVarint(buf, int64(e.from))
+		n += binary.PutVarint(buf[n:], int64(e.to))
+		if _, err := w.Write(buf[:n]); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	s.runs = append(s.runs, path)
+	s.edges = s.edges[:0]
+	return err
+}
+
+// A run being merged: a spilled one read from its file, or the last one,
+// still in memory.
+type run struct {
+	r     *bufio.Reader
+	edges []edge
+	head  edge
+}
+
+// Moves on to the next edge of the run. Returns false at its end.
+func (r *run) advance() (bool, error) {
+	if r.r == nil {
+		if len(r.edges) == 0 {
+			return false, nil
+		}
+		r.head, r.edges = r.edges[0], r.edges[1:]
+		return true, nil
+	}
+	from, err := binary.ReadVarint(r.r)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	to, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return false, err
+	}
+	r.head = edge{int(from), int(to)}
+	return true, nil
+}
+
+// The runs with edges left, by their next edge
+type runHeap []*run
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h runHeap) Less(i, j int) bool  { return byEdge{h[i].head, h[j].head}.Less(0, 1) }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// Passes every edge collected to fn, in order.
+func (s *spiller) merge(fn func(edge) error) error {
+	sort.Sort(byEdge(s.edges))
+	runs := runHeap{}
+	for _, path := range s.runs {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		runs = append(runs, &run{r: bufio.NewReader(file)})
+	}
+	runs = append(runs, &run{edges: s.edges})
+
+	live := runs[:0]
+	for _, r := range runs {
+		ok, err := r.advance()
+		if err != nil {
+			return err
+		} else if ok {
+			live = append(live, r)
+		}
+	}
+	heap.Init(&live)
+	for live.Len() > 0 {
+		r := live[0]
+		if err := fn(r.head); err != nil {
+			return err
+		}
+		ok, err := r.advance()
+		if err != nil {
+			return err
+		} else if ok {
+			heap.Fix(&live, 0)
+		} else {
+			heap.Pop(&live)
+		}
+	}
+	return nil
+}
+
+//============================================================
+// Loading
+
+// CreateNewJob parses the file with the graph info, in one of the Formats or
+// "auto", and uploads it to the store under the specified jobname. It also
+// sets the initial value for each vertex to the specified initVal. If any
+// lines of the file are malformed, nothing is uploaded and a *MalformedError
+// lists them. The statistics of the uploaded graph are printed and saved with
+// the job; if a job can't run on it, the job is deleted again and an
+// *InvalidGraphError says why.
+func CreateNewJob(store GraphStore, jobname string, filename string, format string, initVal float64) (Access, error) {
+	fmt.Println("opening file")
+	edges, inFile, err := OpenGraph(filename, format)
+	if err != nil {
+		fmt.Println(err)
+		return NewAccess("", ""), err
+	}
+	defer inFile.Close()
+
+	access, err := loadGraph(store, jobname, edges, initVal, runSize)
+	if err != nil {
+		fmt.Println(err)
+		return access, err
+	}
+	fmt.Println("Completed puts of all vertices")
+
+	stats, err := Validate(store, access)
+	if stats != nil {
+		fmt.Println(stats)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	if _, ok := err.(*InvalidGraphError); ok {
+		if deleteErr := store.DeleteJob(access); deleteErr != nil {
+			fmt.Println(deleteErr)
+		}
+	}
+	return access, err
+}
+
+// Loads the graph read from edges, sorting runSize edges in memory at once.
+func loadGraph(store GraphStore, jobname string, edges EdgeReader, initVal float64, runSize int) (Access, error) {
+	emptyAccess := NewAccess("", "")
+	dir, err := ioutil.TempDir("", "graph-"+jobname)
+	if err != nil {
+		return emptyAccess, err
+	}
+	defer os.RemoveAll(dir)
+	spill := &spiller{dir: dir, runSize: runSize}
+
+	// Read and sort the edges
+	status := progress{last: time.Now()}
+	malformed := &MalformedError{}
+	dict := newDictionary()
+	numEdges := 0
+	for {
+		from, to, err := edges.Next()
+		if err == io.EOF {
+			break
+		} else if lineErr, ok := err.(*LineError); ok {
+			malformed.Count++
+			if len(malformed.Lines) < maxReported {
+				malformed.Lines = append(malformed.Lines, lineErr.Error())
+			}
+			continue
+		} else if err != nil {
+			return emptyAccess, err
+		}
+		if malformed.Count > 0 {
+			// Only look for more malformed lines
+			continue
+		}
+		if to == "" {
+			err = spill.add(edge{dict.id(from), noVertex})
+		} else {
+			numEdges++
+			e := edge{dict.id(from), dict.id(to)}
+			err = spill.add(e)
+			if err == nil {
+				err = spill.add(edge{e.to, noVertex})
+			}
+		}
+		if err != nil {
+			return emptyAccess, err
+		}
+		status.print("Read %d edges", numEdges)
+	}
+	if malformed.Count > 0 {
+		return emptyAccess, malformed
+	}
+	fmt.Printf("Read %d edges between %d vertices, in %d runs\n", numEdges, len(dict.names), len(spill.runs)+1)
+
+	// Insert the vertices in order
+	access, err := store.CreateJob(jobname)
+	if err != nil {
+		return emptyAccess, err
+	}
+	batch := make([]DbVertex, 0, batchSize)
+	numVertices := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := store.Insert(access, batch)
+		numVertices += len(batch)
+		batch = batch[:0]
+		status.print("Inserted %d vertices", numVertices)
+		return err
+	}
+	err = spill.merge(func(e edge) error {
+		if len(batch) == 0 || batch[len(batch)-1].VertexID != e.from {
+			if len(batch) == batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, DbVertex{
+				VertexID:  e.from,
+				Name:      dict.names[e.from],
+				Value:     initVal,
+				Adjacent:  []int{},
+				Active:    true,
+				Superstep: 0,
+			})
+		}
+		if e.to != noVertex {
+			v := &batch[len(batch)-1]
+			v.Adjacent = append(v.Adjacent, e.to)
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		store.DeleteJob(access)
+		return emptyAccess, err
+	}
+	fmt.Printf("Inserted %d vertices\n", numVertices)
+	return access, nil
+}
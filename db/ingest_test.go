@@ -0,0 +1,152 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func edgeList(edges string) EdgeReader {
+	r, _ := NewEdgeReader("edges", strings.NewReader(edges))
+	return r
+}
+
+// The out-edges of each vertex, by the vertices' ids in the input.
+func edgesByName(store GraphStore, key string) map[string][]string {
+	var names []string
+	var adjacent [][]int
+	store.Export(key, func(v DbVertex) error {
+		test("dense ids", len(names), v.VertexID)
+		names = append(names, v.ExternalID())
+		adjacent = append(adjacent, v.Adjacent)
+		return nil
+	})
+	edges := make(map[string][]string)
+	for i, name := range names {
+		edges[name] = []string{}
+		for _, to := range adjacent[i] {
+			edges[name] = append(edges[name], names[to])
+		}
+	}
+	return edges
+}
+
+// Edges are sorted across runs spilled to disk, and every vertex is loaded
+// with all its out-edges.
+func TestLoadGraph(tee *testing.T) {
+	t = tee
+	store := NewMemoryStore()
+	edges := "# a comment\n5 1\n0 3\n\n3 0\n0 1\n5 3\n0 1\n  7 5  \n"
+	access, err := loadGraph(store, "job", edgeList(edges), 0.5, 3)
+	test("load", nil, err)
+
+	got, _ := store.BatchGet(access.Key(), 0, 10)
+	test("vertices", 5, len(got))
+	test("initial value", 0.5, got[4].Value)
+	secondary, _ := store.NumVertices(access.Secondary)
+	test("secondary", 5, secondary)
+	test("edges", map[string][]string{
+		"0": {"1", "1", "3"},
+		"1": {},
+		"3": {"0"},
+		"5": {"1", "3"},
+		"7": {"5"},
+	}, edgesByName(store, access.Key()))
+}
+
+// Sparse and non-numeric ids are renumbered densely, and the results are
+// written with the ids of the input.
+func TestRenumberIds(tee *testing.T) {
+	t = tee
+	store := NewMemoryStore()
+	edges := "alice bob\nbob 1000000\n007 alice\n7 -3\n"
+	access, err := loadGraph(store, "job", edgeList(edges), 1, runSize)
+	test("load", nil, err)
+	n, _ := store.NumVertices(access.Key())
+	test("vertices", 5, n)
+	test("edges", map[string][]string{
+		"alice":   {"bob"},
+		"bob":     {"1000000"},
+		"1000000": {},
+		"7":       {"alice", "-3"},
+		"-3":      {},
+	}, edgesByName(store, access.Key()))
+}
+
+// Malformed lines are reported with their line numbers, and nothing is loaded.
+func TestMalformedGraph(tee *testing.T) {
+	t = tee
+	store := NewMemoryStore()
+	edges := "0 1\n1\n1 x\n2 3\n1 2 x\n"
+	_, err := loadGraph(store, "job", edgeList(edges), 1, 3)
+	malformed, ok := err.(*MalformedError)
+	test("malformed", true, ok)
+	if !ok {
+		return
+	}
+	test("count", 2, malformed.Count)
+	test("lines", []string{
+		"line 2: expected two vertex ids and an optional weight, found 1 fields",
+		`line 5: "x" is not a weight`,
+	}, malformed.Lines)
+	n, _ := store.NumVertices("job")
+	test("nothing loaded", 0, n)
+}
+
+// A graph that no job can run on isn't left in the store.
+func TestInvalidUpload(tee *testing.T) {
+	t = tee
+	dir, path := writeGraph("# no edges\n")
+	defer os.RemoveAll(dir)
+	storeDir, err := ioutil.TempDir("", "store")
+	test("temp dir", nil, err)
+	defer os.RemoveAll(storeDir)
+	store, _ := NewDiskStore(storeDir)
+
+	access, err := CreateNewJob(store, "job", path, "edges", 1)
+	_, ok := err.(*InvalidGraphError)
+	test("invalid", true, ok)
+	stats, _ := store.Stats(access)
+	test("stats deleted", true, stats == nil)
+	_, err = store.CreateJob("job")
+	test("job deleted", nil, err)
+}
+
+// A graph file that can't be read to the end is an error, not a malformed
+// line to skip.
+func TestTruncatedGraph(tee *testing.T) {
+	t = tee
+	dir, err := ioutil.TempDir("", "graph")
+	test("temp dir", nil, err)
+	defer os.RemoveAll(dir)
+	var edges strings.Builder
+	for vid := 0; vid < 10000; vid++ {
+		fmt.Fprintf(&edges, "%d %d\n", vid, (vid+1)%10000)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	io.WriteString(gz, edges.String())
+	gz.Close()
+	path := filepath.Join(dir, "graph.txt.gz")
+	ioutil.WriteFile(path, compressed.Bytes()[:compressed.Len()/2], 0644)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := CreateNewJob(NewMemoryStore(), "job", path, "auto", 1)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		_, malformed := err.(*MalformedError)
+		test("read error", true, err != nil && !malformed)
+	case <-time.After(10 * time.Second):
+		t.Errorf("Still loading a truncated file")
+	}
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+// MemoryStore keeps the collections of vertices in this process. A whole job
+// can run on it when the server, workers and client share the process, as
+// they do in tests.
+type MemoryStore struct {
+	lock        sync.RWMutex
+	collections map[string]map[int]DbVertex
+	stats       map[string]GraphStats // By primary key
+}
+
+// NewMemoryStore produces an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: make(map[string]map[int]DbVertex), stats: make(map[string]GraphStats)}
+}
+
+// CreateJob creates both collections of the job
+func (s *MemoryStore) CreateJob(jobname string) (Access, error) {
+	access := jobKeys(jobname)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.collections[access.Primary] = make(map[int]DbVertex)
+	s.collections[access.Secondary] = make(map[int]DbVertex)
+	return access, nil
+}
+
+// Insert stores a copy of the vertices in both collections
+func (s *MemoryStore) Insert(a Access, vs []DbVertex) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range []string{a.Primary, a.Secondary} {
+		c, ok := s.collections[key]
+		if !ok {
+			return fmt.Errorf("db: no collection %v", key)
+		}
+		for _, v := range vs {
+			v.Adjacent = append([]int(nil), v.Adjacent...)
+			c[v.VertexID] = v
+		}
+	}
+	return nil
+}
+
+// BatchGet gets the vertices with ids in [minVal, maxVal)
+func (s *MemoryStore) BatchGet(key string, minVal int, maxVal int) (map[int]vertices.BaseVertex, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	bvertices := make(map[int]vertices.BaseVertex)
+	for vid, v := range s.collections[key] {
+		if vid >= minVal && vid < maxVal {
+			bvertices[vid] = vertexToBaseVertex(v)
+		}
+	}
+	return bvertices, nil
+}
+
+// BatchUpdate saves the state of the vertices that are in the collection;
+// like an update in MongoDB, it ignores the others.
+func (s *MemoryStore) BatchUpdate(key string, vertices map[int]vertices.Vertex) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.collections[key]
+	for _, vertex := range vertices {
+		update := vertexToDBVertex(vertex)
+		stored, ok := c[update.VertexID]
+		if !ok {
+			continue
+		}
+		stored.Value = update.Value
+		stored.Messages = update.Messages
+		stored.Active = update.Active
+		stored.Superstep = update.Superstep
+		c[update.VertexID] = stored
+	}
+	return nil
+}
+
+// NumVertices gets the number of vertices in the collection
+func (s *MemoryStore) NumVertices(key string) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.collections[key]), nil
+}
+
+// Export calls emit with a snapshot of the collection, in order of vertex id
+func (s *MemoryStore) Export(key string, emit func(DbVertex) error) error {
+	s.lock.RLock()
+	snapshot := make([]DbVertex, 0, len(s.collections[key]))
+	for _, v := range s.collections[key] {
+		snapshot = append(snapshot, v)
+	}
+	s.lock.RUnlock()
+
+	sort.Sort(byVertexID(snapshot))
+	for _, v := range snapshot {
+		if err := emit(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveStats keeps a copy of the statistics
+func (s *MemoryStore) SaveStats(a Access, stats *GraphStats) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved := *stats
+	saved.OutDegrees = append([]int(nil), stats.OutDegrees...)
+	s.stats[a.Primary] = saved
+	return nil
+}
+
+// Stats gets a copy of the saved statistics
+func (s *MemoryStore) Stats(a Access) (*GraphStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	saved, ok := s.stats[a.Primary]
+	if !ok {
+		return nil, nil
+	}
+	saved.OutDegrees = append([]int(nil), saved.OutDegrees...)
+	return &saved, nil
+}
+
+// DeleteJob deletes both collections of the job
+func (s *MemoryStore) DeleteJob(a Access) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.collections, a.Primary)
+	delete(s.collections, a.Secondary)
+	delete(s.stats, a.Primary)
+	return nil
+}
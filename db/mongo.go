@@ -0,0 +1,275 @@
+package db
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+// The database used when neither the URI nor Config names one
+const defaultDatabase = "test"
+
+// MongoStore keeps the collections of vertices in MongoDB. It holds one
+// session for the whole process, and each call copies it, so that calls share
+// its pool of connections instead of dialing the server every time.
+type MongoStore struct {
+	session  *mgo.Session
+	database string
+}
+
+// NewMongoStore connects to the MongoDB servers at uri, of the form
+// mongodb://[user:pass@]host[:port][,host[:port]...][/database][?options].
+// The database of config overrides the one in uri.
+func NewMongoStore(uri string, config Config) (*MongoStore, error) {
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	if config.Database != "" {
+		info.Database = config.Database
+	} else if info.Database == "" {
+		info.Database = defaultDatabase
+	}
+	if config.Timeout > 0 {
+		info.Timeout = config.Timeout
+	}
+
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		fmt.Println("Couldn't connect to", uri, err)
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		session.SetSocketTimeout(config.Timeout)
+	}
+	return &MongoStore{session: session, database: info.Database}, nil
+}
+
+// CreateJob indexes the primary and secondary collections of the job by
+// vertex id.
+func (s *MongoStore) CreateJob(jobname string) (Access, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	access := jobKeys(jobname)
+	index := mgo.Index{
+		Key:        []string{"vertex_id"},
+		Unique:     true,
+		DropDups:   true,
+		Background: true,
+		Sparse:     true,
+	}
+	for _, key := range []string{access.Primary, access.Secondary} {
+		err := session.DB(s.database).C(key).EnsureIndex(index)
+		if err != nil {
+			fmt.Println(err)
+			return NewAccess("", ""), err
+		}
+	}
+	return access, nil
+}
+
+// Insert bulk inserts the vertices into both collections
+func (s *MongoStore) Insert(a Access, vs []DbVertex) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	for _, key := range []string{a.Primary, a.Secondary} {
+		bulk := session.DB(s.database).C(key).Bulk()
+		bulk.Unordered()
+		for _, v := range vs {
+			bulk.Insert(v)
+		}
+		if _, err := bulk.Run(); err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchUpdate updates several vertices in the DB at once. It only updates one
+// collection specified by jobname, and updates the vertices in the slice
+func (s *MongoStore) BatchUpdate(jobname string, vertices map[int]vertices.Vertex) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+	bulkc := c.Bulk()
+
+	for _, vertex := range vertices {
+		dbvertex := vertexToDBVertex(vertex)
+		query := bson.M{"vertex_id": dbvertex.VertexID}
+		change := bson.M{"$set": bson.M{"value": dbvertex.Value, "msgs": dbvertex.Messages, "active": dbvertex.Active, "step": dbvertex.Superstep}}
+		bulkc.Update(query, change)
+	}
+	_, err := bulkc.Run()
+
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	return err
+}
+
+// UpdateOne updates one vertex in the given collection
+func (s *MongoStore) UpdateOne(jobname string, vertex vertices.Vertex) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+	dbvertex := vertexToDBVertex(vertex)
+	query := bson.M{"vertex_id": dbvertex.VertexID}
+	change := bson.M{"$set": bson.M{"value": dbvertex.Value, "msgs": dbvertex.Messages, "active": dbvertex.Active, "step": dbvertex.Superstep}}
+	err := c.Update(query, change)
+	if err != nil {
+		fmt.Println("Couldn't update", err)
+		return err
+	}
+	return err
+}
+
+// GetOne gets one vertex from the collection specified by jobname
+func (s *MongoStore) GetOne(jobname string, vid int) (vertices.BaseVertex, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+	result := DbVertex{}
+	err := c.Find(bson.M{"vertex_id": vid}).One(&result)
+	bvertex := vertexToBaseVertex(result)
+	if err != nil {
+		fmt.Println("Could not get item", err)
+		return bvertex, err
+	}
+	return bvertex, err
+}
+
+// BatchGet gets a batch of vertices from the specified collection (jobname)
+// with ids [minVal, maxVal) including minVal but not maxVal
+func (s *MongoStore) BatchGet(jobname string, minVal int, maxVal int) (map[int]vertices.BaseVertex, error) {
+	var results []DbVertex
+	bvertices := make(map[int]vertices.BaseVertex)
+
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+
+	err := c.Find(bson.M{"vertex_id": bson.M{"$gt": minVal - 1, "$lt": maxVal}}).All(&results)
+	if err != nil {
+		fmt.Println("Could not get items in range specified", err)
+		return bvertices, err
+	}
+
+	for _, vertex := range results {
+		bvertex := vertexToBaseVertex(vertex)
+		bvertices[vertex.VertexID] = bvertex
+	}
+	return bvertices, err
+}
+
+// NumVertices gets the number of items in the colleciton specified by jobname
+func (s *MongoStore) NumVertices(jobname string) (int, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+	count, err := c.Count()
+	if err != nil {
+		fmt.Println("Couldn't get number of vertices", err)
+		return 0, err
+	}
+	return count, err
+}
+
+// Export iterates over the collection sorted by vertex id, so that it never
+// has all of it in memory.
+func (s *MongoStore) Export(jobname string, emit func(DbVertex) error) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(jobname)
+	iter := c.Find(nil).Sort("vertex_id").Iter()
+	for {
+		var v DbVertex
+		if !iter.Next(&v) {
+			break
+		}
+		if err := emit(v); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	err := iter.Close()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// The collection of the statistics of every job's graph
+const statsCollection = "graphstats"
+
+// The statistics of a job's graph, under its primary key
+type statsDoc struct {
+	Key   string     `bson:"_id"`
+	Stats GraphStats `bson:",inline"`
+}
+
+// SaveStats upserts the statistics of the job into the statistics collection
+func (s *MongoStore) SaveStats(a Access, stats *GraphStats) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB(s.database).C(statsCollection)
+	_, err := c.UpsertId(a.Primary, statsDoc{Key: a.Primary, Stats: *stats})
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// Stats gets the statistics of the job from the statistics collection
+func (s *MongoStore) Stats(a Access) (*GraphStats, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc statsDoc
+	err := session.DB(s.database).C(statsCollection).FindId(a.Primary).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &doc.Stats, nil
+}
+
+// DeleteJob deletes the collections associated with a job, and its statistics
+func (s *MongoStore) DeleteJob(a Access) error {
+	session := s.session.Copy()
+	defer session.Close()
+	primKey := a.Primary
+	secKey := a.Secondary
+	prim := session.DB(s.database).C(primKey)
+	sec := session.DB(s.database).C(secKey)
+	err := prim.DropCollection()
+	if err != nil {
+		fmt.Println("Collection couldn't be dropped", err)
+		return err
+	}
+	err = sec.DropCollection()
+	if err != nil {
+		fmt.Println("Collection couldn't be dropped", err)
+		return err
+	}
+	err = session.DB(s.database).C(statsCollection).RemoveId(primKey)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
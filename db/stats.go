@@ -0,0 +1,219 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ****************************************************************************
+// A graph is checked once it is uploaded, and again when its job starts if it
+// was uploaded some other way. The statistics are gathered in
+// one pass over the collection, and kept with the job.
+//
+// The range partitioner splits the vertex ids [0, NumVertices) between the
+// workers, so a graph whose ids are anything else, or that has edges to
+// vertices it doesn't have, can't run. Everything else is only reported.
+
+// GraphStats are the statistics of a graph.
+type GraphStats struct {
+	NumVertices    int   `bson:"vertices" json:"vertices"`
+	NumEdges       int   `bson:"edges" json:"edges"`
+	MaxOutDegree   int   `bson:"max_out_degree" json:"max_out_degree"`
+	OutDegrees     []int `bson:"out_degrees" json:"out_degrees"` // Number of vertices by out-degree: 0, 1, 2-3, 4-7, ...
+	SelfLoops      int   `bson:"self_loops" json:"self_loops"`
+	DuplicateEdges int   `bson:"duplicate_edges" json:"duplicate_edges"` // Edges that repeat an earlier one
+	Dangling       int   `bson:"dangling" json:"dangling"`               // Vertices without out-edges
+	MissingTargets int   `bson:"missing_targets" json:"missing_targets"` // Vertices that edges lead to, but the graph doesn't have
+	MinID          int   `bson:"min_id" json:"min_id"`
+	MaxID          int   `bson:"max_id" json:"max_id"`
+	OutOfRange     int   `bson:"out_of_range" json:"out_of_range"` // Vertex and edge ids that are negative or far past NumVertices; not checked further
+}
+
+// InvalidGraphError is returned for a graph that a job can't run on.
+type InvalidGraphError struct {
+	Key      string
+	Problems []string
+}
+
+func (e *InvalidGraphError) Error() string {
+	return fmt.Sprintf("graph %v can't run: %s", e.Key, strings.Join(e.Problems, "; "))
+}
+
+// Problems lists what keeps a job from running on the graph, if anything.
+func (s *GraphStats) Problems() []string {
+	var problems []string
+	if s.NumVertices == 0 {
+		problems = append(problems, "it has no vertices")
+	}
+	if s.NumVertices > 0 && (s.MinID != 0 || s.MaxID != s.NumVertices-1) {
+		problems = append(problems, fmt.Sprintf("its vertex ids are %d to %d, not 0 to %d", s.MinID, s.MaxID, s.NumVertices-1))
+	}
+	if s.MissingTargets > 0 {
+		problems = append(problems, fmt.Sprintf("%d vertices that edges lead to are missing", s.MissingTargets))
+	}
+	if s.OutOfRange > 0 {
+		problems = append(problems, fmt.Sprintf("%d vertex and edge ids are negative or far past the %d vertices", s.OutOfRange, s.NumVertices))
+	}
+	return problems
+}
+
+// String reports the statistics, one per line.
+func (s *GraphStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Vertices: %d (ids %d to %d)\n", s.NumVertices, s.MinID, s.MaxID)
+	fmt.Fprintf(&b, "Edges: %d (%d self-loops, %d duplicates, %d to missing vertices)\n",
+		s.NumEdges, s.SelfLoops, s.DuplicateEdges, s.MissingTargets)
+	fmt.Fprintf(&b, "Dangling vertices: %d\n", s.Dangling)
+	fmt.Fprintf(&b, "Out-degrees (max %d):", s.MaxOutDegree)
+	for bucket, count := range s.OutDegrees {
+		if count == 0 {
+			continue
+		}
+		low, high := degreeRange(bucket)
+		if low == high {
+			fmt.Fprintf(&b, " %d: %d", low, count)
+		} else {
+			fmt.Fprintf(&b, " %d-%d: %d", low, high, count)
+		}
+	}
+	if s.OutOfRange > 0 {
+		fmt.Fprintf(&b, "\nIds out of range: %d", s.OutOfRange)
+	}
+	return b.String()
+}
+
+// The bucket of the out-degree histogram that a degree goes into
+func degreeBucket(degree int) int {
+	bucket := 0
+	for degree > 0 {
+		bucket++
+		degree >>= 1
+	}
+	return bucket
+}
+
+// The smallest and largest degree of a bucket
+func degreeRange(bucket int) (int, int) {
+	if bucket == 0 {
+		return 0, 0
+	}
+	return 1 << uint(bucket-1), 1<<uint(bucket) - 1
+}
+
+// A set of non-negative ids, a bit each
+type idSet []uint64
+
+func (s *idSet) add(id int) {
+	for id/64 >= len(*s) {
+		*s = append(*s, 0)
+	}
+	(*s)[id/64] |= 1 << uint(id%64)
+}
+
+func (s idSet) has(id int) bool {
+	return id/64 < len(s) && s[id/64]&(1<<uint(id%64)) != 0
+}
+
+// The ids below idSlack times the number of vertices are tracked, so that
+// the missing vertices of a graph that is only a little off can be found.
+// Anything past that, such as the raw ids of a graph that was never
+// renumbered, is only counted, rather than growing the bitsets without bound.
+const idSlack = 2
+
+// ComputeStats goes through the collection and gathers the statistics of its
+// graph. It holds a bit for each vertex id and each id edges lead to, but not
+// the graph.
+func ComputeStats(store GraphStore, key string) (*GraphStats, error) {
+	numVertices, err := store.NumVertices(key)
+	if err != nil {
+		return nil, err
+	}
+	limit := idSlack*numVertices + 64
+	inRange := func(id int) bool { return id >= 0 && id < limit }
+
+	stats := &GraphStats{}
+	var ids, targets idSet
+	var adjacent []int
+	err = store.Export(key, func(v DbVertex) error {
+		if stats.NumVertices == 0 || v.VertexID < stats.MinID {
+			stats.MinID = v.VertexID
+		}
+		if stats.NumVertices == 0 || v.VertexID > stats.MaxID {
+			stats.MaxID = v.VertexID
+		}
+		stats.NumVertices++
+		if inRange(v.VertexID) {
+			ids.add(v.VertexID)
+		} else {
+			stats.OutOfRange++
+		}
+
+		degree := len(v.Adjacent)
+		stats.NumEdges += degree
+		if degree > stats.MaxOutDegree {
+			stats.MaxOutDegree = degree
+		}
+		bucket := degreeBucket(degree)
+		for len(stats.OutDegrees) <= bucket {
+			stats.OutDegrees = append(stats.OutDegrees, 0)
+		}
+		stats.OutDegrees[bucket]++
+		if degree == 0 {
+			stats.Dangling++
+		}
+
+		adjacent = append(adjacent[:0], v.Adjacent...)
+		sort.Ints(adjacent)
+		for i, to := range adjacent {
+			if to == v.VertexID {
+				stats.SelfLoops++
+			}
+			if i > 0 && to == adjacent[i-1] {
+				stats.DuplicateEdges++
+			}
+			if inRange(to) {
+				targets.add(to)
+			} else {
+				stats.OutOfRange++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, word := range targets {
+		for bit := 0; word != 0; bit++ {
+			if word&1 != 0 && !ids.has(i*64+bit) {
+				stats.MissingTargets++
+			}
+			word >>= 1
+		}
+	}
+	return stats, nil
+}
+
+// Validate produces the statistics of the job's graph, computing and saving
+// them if the job doesn't have them yet. If a job can't run on the graph, it
+// also returns an *InvalidGraphError.
+func Validate(store GraphStore, a Access) (*GraphStats, error) {
+	stats, err := store.Stats(a)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		stats, err = ComputeStats(store, a.Primary)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.SaveStats(a, stats); err != nil {
+			return nil, err
+		}
+	}
+	if problems := stats.Problems(); len(problems) > 0 {
+		return stats, &InvalidGraphError{Key: a.Primary, Problems: problems}
+	}
+	return stats, nil
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestComputeStats(tee *testing.T) {
+	t = tee
+	store := NewMemoryStore()
+	access, err := loadGraph(store, "job", edgeList("a a\na b\na b\na c\nb c\nc a\nd c\n"), 1, runSize)
+	test("load", nil, err)
+
+	stats, err := Validate(store, access)
+	test("valid", nil, err)
+	test("stats", GraphStats{
+		NumVertices:    4,
+		NumEdges:       7,
+		MaxOutDegree:   4,
+		OutDegrees:     []int{0, 3, 0, 1},
+		SelfLoops:      1,
+		DuplicateEdges: 1,
+		MinID:          0,
+		MaxID:          3,
+	}, *stats)
+	saved, _ := store.Stats(access)
+	test("saved", stats, saved)
+	test("report", "Vertices: 4 (ids 0 to 3)\nEdges: 7 (1 self-loops, 1 duplicates, 0 to missing vertices)\n"+
+		"Dangling vertices: 0\nOut-degrees (max 4): 1: 3 4-7: 1", stats.String())
+}
+
+// A graph with ids the range partitioner can't split, loaded before vertices
+// were renumbered, is refused.
+func TestInvalidGraph(tee *testing.T) {
+	t = tee
+	store := NewMemoryStore()
+	access, _ := store.CreateJob("job")
+	store.Insert(access, []DbVertex{
+		{VertexID: 1, Adjacent: []int{3}},
+		{VertexID: 3, Adjacent: []int{7, 1}},
+		{VertexID: 4},
+	})
+
+	stats, err := Validate(store, access)
+	invalid, ok := err.(*InvalidGraphError)
+	test("invalid", true, ok)
+	if ok {
+		test("problems", []string{"its vertex ids are 1 to 4, not 0 to 2", "1 vertices that edges lead to are missing"}, invalid.Problems)
+	}
+	test("dangling", 1, stats.Dangling)
+
+	// Ids that were never renumbered are counted, not tracked
+	raw, _ := store.CreateJob("raw")
+	store.Insert(raw, []DbVertex{
+		{VertexID: 0, Adjacent: []int{1 << 40}},
+		{VertexID: 1 << 40, Adjacent: []int{0, -1}},
+	})
+	stats, err = Validate(store, raw)
+	invalid, ok = err.(*InvalidGraphError)
+	test("raw ids invalid", true, ok)
+	if ok {
+		test("raw id problems", []string{"its vertex ids are 0 to 1099511627776, not 0 to 1",
+			"3 vertex and edge ids are negative or far past the 2 vertices"}, invalid.Problems)
+	}
+	test("out of range", 3, stats.OutOfRange)
+	test("max id", 1<<40, stats.MaxID)
+
+	empty, _ := store.CreateJob("empty")
+	_, err = Validate(store, empty)
+	test("empty", true, err != nil)
+}
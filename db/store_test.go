@@ -0,0 +1,265 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+var t *testing.T
+
+func test(summary string, expect, actual interface{}) {
+	if !reflect.DeepEqual(expect, actual) {
+		_, _, line, _ := runtime.Caller(1)
+		t.Errorf("Line %d:: %s: Expected %v, Actual %v", line, summary, expect, actual)
+	}
+}
+
+// Writes the edge list to a file in a new temporary directory.
+func writeGraph(edges string) (dir string, path string) {
+	dir, err := ioutil.TempDir("", "graph")
+	test("temp dir", nil, err)
+	path = filepath.Join(dir, "graph.txt")
+	test("write graph", nil, ioutil.WriteFile(path, []byte(edges), 0644))
+	return dir, path
+}
+
+// A job goes through a store from its edge list to its results.
+func testStore(store GraphStore) {
+	dir, path := writeGraph("# comment\n0 1\n0 2\n1 2\n2 0\n3 0\n")
+	defer os.RemoveAll(dir)
+
+	access, err := CreateNewJob(store, "job", path, "auto", 0.5)
+	test("create", nil, err)
+	test("access", NewAccess("job", "job-secondary"), access)
+	n, err := store.NumVertices(access.Primary)
+	test("count", nil, err)
+	test("vertices", 4, n)
+	n, _ = store.NumVertices(access.Secondary)
+	test("secondary vertices", 4, n)
+	stats, err := store.Stats(access)
+	test("stats", true, err == nil && stats != nil)
+	if stats != nil {
+		test("stats saved", GraphStats{NumVertices: 4, NumEdges: 5, MaxOutDegree: 2, OutDegrees: []int{0, 3, 1}, MaxID: 3}, *stats)
+	}
+
+	got, err := store.BatchGet(access.Key(), 1, 3)
+	test("get", nil, err)
+	test("range", 2, len(got))
+	test("edges", []int{2}, got[1].OutVertices)
+	test("initial value", 0.5, got[2].Value)
+	test("active", true, got[2].Active)
+
+	// A checkpoint saves the state but not the edges
+	vertex := &vertices.PageRankVertex{BaseVertex: got[1], NumVertices: n}
+	vertex.Value = 0.25
+	vertex.Superstep = 3
+	vertex.IncMsgs = []vertices.VertexMessage{{FromID: 0, Value: 0.1, ToID: 1, Superstep: 3}}
+	update := map[int]vertices.Vertex{1: vertex}
+	test("update", nil, store.BatchUpdate(access.OtherKey(), update))
+	saved, _ := store.BatchGet(access.OtherKey(), 0, 4)
+	test("saved value", 0.25, saved[1].Value)
+	test("saved step", 3, saved[1].Superstep)
+	test("saved messages", vertex.IncMsgs, saved[1].IncMsgs)
+	test("edges kept", []int{2}, saved[1].OutVertices)
+	primary, _ := store.BatchGet(access.Key(), 1, 2)
+	test("other collection untouched", 0.5, primary[1].Value)
+
+	out := filepath.Join(dir, "out.txt")
+	test("print", nil, PrintToFile(store, access.OtherKey(), out))
+	printed, _ := ioutil.ReadFile(out)
+	test("printed in order", "0 0.5\n1 0.25\n2 0.5\n3 0.5\n", string(printed))
+
+	test("delete", nil, store.DeleteJob(access))
+	n, _ = store.NumVertices(access.Primary)
+	test("deleted", 0, n)
+	stats, _ = store.Stats(access)
+	test("stats deleted", true, stats == nil)
+}
+
+func TestMemoryStore(tee *testing.T) {
+	t = tee
+	testStore(NewMemoryStore())
+}
+
+func TestDiskStore(tee *testing.T) {
+	t = tee
+	dir, err := ioutil.TempDir("", "store")
+	test("temp dir", nil, err)
+	defer os.RemoveAll(dir)
+	store, err := Open(Config{Store: "file:" + dir})
+	test("open", nil, err)
+	testStore(store)
+}
+
+// Workers save their vertices of a checkpoint at the same time, and each
+// checkpoint replaces the state saved by the one before.
+func TestDiskStoreCheckpoints(tee *testing.T) {
+	t = tee
+	dir, err := ioutil.TempDir("", "store")
+	test("temp dir", nil, err)
+	defer os.RemoveAll(dir)
+	store, _ := NewDiskStore(dir)
+
+	const numVertices = 2*batchSize + 5
+	var edges strings.Builder
+	for vid := 0; vid < numVertices; vid++ {
+		fmt.Fprintf(&edges, "%d %d\n", vid, (vid+1)%numVertices)
+	}
+	access, err := loadGraph(store, "job", edgeList(edges.String()), 1, runSize)
+	test("create", nil, err)
+	_, err = store.CreateJob("job")
+	test("created twice", true, err != nil)
+	n, _ := store.NumVertices(access.Key())
+	test("vertices", numVertices, n)
+
+	const numWorkers = 4
+	for step := 1; step <= 3; step++ {
+		var wg sync.WaitGroup
+		for w := 0; w < numWorkers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				update := make(map[int]vertices.Vertex)
+				for vid := w; vid < numVertices; vid += numWorkers {
+					base := vertices.BaseVertex{ID: vid, Value: float64(step), Superstep: step}
+					update[vid] = &vertices.PageRankVertex{BaseVertex: base}
+				}
+				test("update", nil, store.BatchUpdate(access.Key(), update))
+			}(w)
+		}
+		wg.Wait()
+	}
+
+	got, err := store.BatchGet(access.Key(), batchSize-1, batchSize+1)
+	test("get", nil, err)
+	test("across segments", 2, len(got))
+	test("latest state", 3.0, got[batchSize].Value)
+	test("edges kept", []int{batchSize + 1}, got[batchSize].OutVertices)
+
+	count := 0
+	err = store.Export(access.Key(), func(v DbVertex) error {
+		test("exported in order", count, v.VertexID)
+		test("exported state", 3, v.Superstep)
+		test("name kept", fmt.Sprint(count), v.Name)
+		count++
+		return nil
+	})
+	test("export", nil, err)
+	test("exported all", numVertices, count)
+	n, _ = store.NumVertices(access.Key())
+	test("no vertices added", numVertices, n)
+	entries, _ := store.readManifest(access.Key())
+	test("compacted at each checkpoint", 3, len(entries))
+}
+
+// A range read only opens the segments that overlap it, and a full
+// checkpoint is compacted into the graph.
+func TestDiskStoreManifest(tee *testing.T) {
+	t = tee
+	dir, err := ioutil.TempDir("", "store")
+	test("temp dir", nil, err)
+	defer os.RemoveAll(dir)
+	store, _ := NewDiskStore(dir)
+
+	const numVertices = 2*batchSize + 5
+	var edges strings.Builder
+	for vid := 0; vid < numVertices; vid++ {
+		fmt.Fprintf(&edges, "%d %d\n", vid, (vid+1)%numVertices)
+	}
+	access, err := loadGraph(store, "job", edgeList(edges.String()), 1, runSize)
+	test("create", nil, err)
+	key := access.Key()
+	entries, err := store.readManifest(key)
+	test("manifest", nil, err)
+	test("base segments", 3, len(entries))
+
+	// Without the last segment, the others can still be read
+	last := filepath.Join(store.path(key), entries[2].Name)
+	saved, _ := ioutil.ReadFile(last)
+	os.Remove(last)
+	got, err := store.BatchGet(key, 0, batchSize)
+	test("other segments", nil, err)
+	test("read", batchSize, len(got))
+	_, err = store.BatchGet(key, 2*batchSize, numVertices)
+	test("missing segment", true, err != nil)
+	ioutil.WriteFile(last, saved, 0644)
+
+	update := func(from int, to int, step int) {
+		update := make(map[int]vertices.Vertex)
+		for vid := from; vid < to; vid++ {
+			base := vertices.BaseVertex{ID: vid, Value: float64(step), Superstep: step}
+			update[vid] = &vertices.PageRankVertex{BaseVertex: base}
+		}
+		test("update", nil, store.BatchUpdate(key, update))
+	}
+	update(0, numVertices/2, 1)
+	entries, _ = store.readManifest(key)
+	test("update segment", 4, len(entries))
+	update(numVertices/2, numVertices, 1)
+	entries, _ = store.readManifest(key)
+	test("compacted", 3, len(entries))
+	for _, entry := range entries {
+		test("into base segments", true, entry.Header.Base)
+	}
+	files, _ := filepath.Glob(filepath.Join(store.path(key), "*.seg"))
+	test("old segments removed", 3, len(files))
+	got, _ = store.BatchGet(key, batchSize-1, batchSize+1)
+	test("latest state", 1.0, got[batchSize].Value)
+	test("edges kept", []int{batchSize + 1}, got[batchSize].OutVertices)
+	n, _ := store.NumVertices(key)
+	test("no vertices added", numVertices, n)
+
+	// A segment that a failed writer left out of the manifest is passed over
+	number, _ := strconv.Atoi(strings.TrimSuffix(entries[2].Name, ".seg"))
+	orphan := fmt.Sprintf("%010d.seg", number+1)
+	ioutil.WriteFile(filepath.Join(store.path(key), orphan), []byte("half a segment"), 0644)
+	update(0, 1, 2)
+	entries, _ = store.readManifest(key)
+	test("orphan passed over", true, entries[3].Name > orphan)
+	got, _ = store.BatchGet(key, 0, 2)
+	test("orphan ignored", []float64{2, 1}, []float64{got[0].Value, got[1].Value})
+
+	// Without its manifest, a collection has no segments
+	os.Remove(filepath.Join(store.path(key), manifestFile))
+	n, err = store.NumVertices(key)
+	test("no manifest", nil, err)
+	test("empty", 0, n)
+}
+
+// The environment gives the defaults of the store flags.
+func TestConfigFromEnv(tee *testing.T) {
+	t = tee
+	for _, name := range []string{"PREGEL_STORE", "PREGEL_DB_NAME", "PREGEL_DB_TIMEOUT"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	config, err := ConfigFromEnv()
+	test("default", nil, err)
+	test("default config", Config{Store: DefaultStore, Timeout: 10 * time.Second}, config)
+
+	os.Setenv("PREGEL_STORE", "mongodb://db1,db2/graphs")
+	os.Setenv("PREGEL_DB_NAME", "pregel")
+	os.Setenv("PREGEL_DB_TIMEOUT", "3s")
+	config, err = ConfigFromEnv()
+	test("from env", nil, err)
+	test("config from env", Config{Store: "mongodb://db1,db2/graphs", Database: "pregel", Timeout: 3 * time.Second}, config)
+
+	os.Setenv("PREGEL_DB_TIMEOUT", "soon")
+	_, err = ConfigFromEnv()
+	test("bad timeout", true, err != nil)
+
+	_, err = Open(Config{Store: "mysql://localhost"})
+	test("unknown store", true, err != nil)
+}
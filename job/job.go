@@ -23,15 +23,47 @@ const checkpoint_rate = 10
 // If all nodes aren't yet inactive (i.e., having voted to halt), Pregel will stop after this supserstep
 const max_supersteps = 20
 
+// Give up and requeue the request if workers keep rejoining
+const max_rollbacks = 3
+
+// Raised (as a panic) when a worker reconnected in the middle of the job. It
+// may have lost messages, or its vertices if it restarted, so the job goes
+// back to its last checkpoint with the same workers instead of being requeued.
+type workerRejoined struct {
+	worker msg.WorkerId
+}
+
+// Raised (as a panic) when the job checkpointed and stopped because it was
+// asked to, so that the request is requeued from that checkpoint.
+type jobStopped struct{}
+
+// WorkerPool lends a running job more workers, so that workers that connect
+// in the middle of a long job can speed it up.
+type WorkerPool interface {
+	// Hands the job the idle workers it may grow onto, with the addresses
+	// their peers reach them at. The workers are the job's from then on.
+	MoreWorkers() map[msg.WorkerId]string
+}
+
+// Run runs the request on the workers until it completes, fails, or has to
+// be requeued. cControl asks the job to stop, or to drain one of its
+// workers; both happen at the next barrier, when the job can checkpoint.
+// After every checkpoint, the job takes on any workers pool has for it; a nil
+// pool keeps the job on the workers it started with. The graph is in store.
 func Run(
 	request msg.Request,
+	store db.GraphStore,
 	workers []msg.WorkerId,
+	addresses map[msg.WorkerId]string,
+	recoverable bool,
+	pool WorkerPool,
 	cIn chan msg.FromWorker,
+	cControl chan msg.FromWorker,
 	cOut chan msg.FromServer,
 	cDone chan msg.Result) {
 	log.Printf("Request started: %v", request)
 
-	num_vertices, err := db.NumVertices(request.DBAccess.Key())
+	num_vertices, err := store.NumVertices(request.DBAccess.Key())
 
 	if len(workers) == 0 || err != nil {
 		result := msg.Result{msg.Failure, request}
@@ -45,18 +77,28 @@ func Run(
 	// If something fails while communicating with workers, there will be a panic
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("%v: Requeuening Incomplete request %v", r, request)
+			if _, ok := r.(jobStopped); ok {
+				log.Printf("Stopped: Requeuening request %v from superstep %v", request, request.CheckpointStep)
+			} else {
+				log.Printf("%v: Requeuening Incomplete request %v", r, request)
+			}
 			// reset superstep to last checkpointstep
 			request.Superstep = request.CheckpointStep
 			cDone <- msg.Result{msg.Incomplete, request}
 		}
 	}()
 
+	rollbacks := 0
 	for {
 
-		assigns := mgr.Redistribute()
-		sendAssignments(assigns, request.DBAccess.Key(), cIn, cOut)
-		done := iterateSupersteps(&request, mgr, cIn, cOut) // Won't be done if needs redistribution to rebalance work
+		done, rolledBack := runRound(&request, mgr, addresses, recoverable, pool, cIn, cControl, cOut, cDone) // Won't be done if needs redistribution to rebalance work
+		if rolledBack {
+			rollbacks++
+			if rollbacks > max_rollbacks {
+				panic("Too many workers rejoined")
+			}
+			continue
+		}
 		if done || request.Superstep > max_supersteps {
 			log.Printf("Job COMPLETE: %v", request)
 			result := msg.Result{msg.Success, request}
@@ -67,6 +109,42 @@ func Run(
 
 }
 
+// Distributes the vertices and runs supersteps until the job is done, or needs
+// redistribution. If a worker rejoined, the request is rolled back to its last
+// checkpoint and rolledBack is true.
+func runRound(request *msg.Request, mgr manager.Manager, addresses map[msg.WorkerId]string, recoverable bool,
+	pool WorkerPool, cIn chan msg.FromWorker, cControl chan msg.FromWorker, cOut chan msg.FromServer,
+	cDone chan msg.Result) (done bool, rolledBack bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			rejoin, ok := r.(workerRejoined)
+			if !ok {
+				panic(r)
+			}
+			log.Printf("Worker %v rejoined: rolling back to superstep %v", rejoin.worker, request.CheckpointStep)
+			request.Superstep = request.CheckpointStep
+			done = false
+			rolledBack = true
+		}
+	}()
+
+	assigns := mgr.Redistribute()
+	// Messages the workers sent each other before this assignment are dropped
+	round := time.Now().UnixNano()
+	sendAssignments(assigns, peersOf(assigns, addresses), round, request.DBAccess.Key(), cIn, cOut)
+	return iterateSupersteps(request, mgr, addresses, recoverable, pool, nil, cIn, cControl, cOut, cDone), false
+}
+
+// The partition map sent to the workers, so they can send each other vertex
+// messages directly.
+func peersOf(assigns []manager.Assignment, addresses map[msg.WorkerId]string) []msg.Peer {
+	var peers []msg.Peer
+	for _, a := range assigns {
+		peers = append(peers, msg.Peer{Worker: a.Worker, Address: addresses[a.Worker], Partitions: a.Partitions})
+	}
+	return peers
+}
+
 func addWorkers(mgr manager.Manager, workers []msg.WorkerId) {
 	for _, worker := range workers {
 		mgr.AddWorker(worker)
@@ -83,10 +161,11 @@ func logMessageFS(fs msg.FromServer) {
 	log.Printf("Line %v -- SENDING msg Type %v; Data %v", line, msg.TypeStr(fs.Type), fs)
 }
 
-func sendAssignments(assigns []manager.Assignment, dbKey string, cIn chan msg.FromWorker, cOut chan msg.FromServer) {
+func sendAssignments(assigns []manager.Assignment, peers []msg.Peer, round int64, dbKey string,
+	cIn chan msg.FromWorker, cOut chan msg.FromServer) {
 	log.Printf("Sending %v Assignments to %v", len(assigns), dbKey)
 	for _, a := range assigns {
-		cOut <- msg.NewAssign(dbKey, a.Partitions, a.Worker)
+		cOut <- msg.NewAssign(dbKey, a.Partitions, peers, round, a.Worker)
 	}
 
 	acks := make(map[msg.WorkerId]struct{})
@@ -94,7 +173,16 @@ func sendAssignments(assigns []manager.Assignment, dbKey string, cIn chan msg.Fr
 		select {
 		case fw := <-cIn:
 			logMessageFW(fw)
-			if fw.Type == msg.PartitionAck {
+			checkWorkerDied(fw)
+			if fw.Type == msg.Rejoined {
+				// The assignment may have been lost, so send it again
+				for _, a := range assigns {
+					if a.Worker == fw.SrcWorker {
+						delete(acks, a.Worker)
+						cOut <- msg.NewAssign(dbKey, a.Partitions, peers, round, a.Worker)
+					}
+				}
+			} else if fw.Type == msg.PartitionAck {
 				if fw.Msg == 0 {
 					//db problems
 					panic("Workers Unable to load vertices from db.")
@@ -117,16 +205,30 @@ func sendAssignments(assigns []manager.Assignment, dbKey string, cIn chan msg.Fr
 
 // Returns True if completed Pregel
 // Returns False if needs redistribution of workers before continuing
-// Panics if incompmlete for some reason (worker died, or joined, so this needs to be restarted at checkpoint)
-func iterateSupersteps(request *msg.Request, mgr manager.Manager,
-	cIn chan msg.FromWorker, cOut chan msg.FromServer) bool {
+// Panics if incompmlete for some reason (worker rejoined, or recovery failed, so this needs to be restarted at checkpoint)
+// A superstep takes as long as the workers compute, which the server doesn't
+// hear about now that vertex messages go from worker to worker, so it has no
+// time limit. Instead, the server declares a worker that stops sending
+// heartbeats dead, and the job gets a WorkerDied for it.
+// A worker that dies is left out of the superstep, and its partitions are
+// recovered on the others once they are done. If some of the workers can't
+// recover partitions (recoverable is false), the job is restarted instead.
+// The workers send each other their vertex messages; expected has the number
+// each worker was sent in the previous superstep, so it can wait for them all.
+// Once a superstep is complete, a stop or drain asked for on cControl forces a
+// checkpoint. A drained worker is then released, and its partitions go to the
+// others when they are redistributed. So do some of theirs to the workers the
+// pool lends the job at a checkpoint.
+func iterateSupersteps(request *msg.Request, mgr manager.Manager, addresses map[msg.WorkerId]string, recoverable bool,
+	pool WorkerPool, expected map[msg.WorkerId]int, cIn chan msg.FromWorker, cControl chan msg.FromWorker,
+	cOut chan msg.FromServer, cDone chan msg.Result) bool {
 	log.Printf("Beginning SUPERSTEP %v", request.Superstep)
 
 	// Used for calculation elapsed times
 	startTimes := map[msg.WorkerId]time.Time{}
 
 	for _, w := range mgr.Workers() {
-		fs := msg.NewSuperstep(request.Superstep, w)
+		fs := msg.NewSuperstep(request.Superstep, expected[w], w)
 		startTimes[w] = time.Now()
 		logMessageFS(fs)
 		cOut <- fs
@@ -135,12 +237,49 @@ func iterateSupersteps(request *msg.Request, mgr manager.Manager,
 
 	// true means existance means finished; Type is Done or Inactive
 	dones := make(map[msg.WorkerId]msg.Type)
+	// Set if a worker rejoined during this superstep. Messages may have been
+	// lost, so once the others are done we roll back to the last checkpoint.
+	var rejoined *workerRejoined
+	// Fires timeout after a worker rejoins, in case it restarted and will
+	// never be done; nil until then
+	var rejoinTimeout <-chan time.Time
+	// The workers that died during this superstep
+	dead := make(map[msg.WorkerId]struct{})
+	// The vertex messages each worker sent to each other one
+	sentBy := make(map[msg.WorkerId]map[msg.WorkerId]int)
 	for {
 		halt := true
 		select {
 		case fw := <-cIn:
 			logMessageFW(fw)
+			if isStale(fw, request.Superstep) {
+				log.Printf("Ignoring message from superstep %v during superstep %v", fw.StepNum, request.Superstep)
+				continue
+			}
+			if _, ok := dead[fw.SrcWorker]; ok {
+				log.Printf("Ignoring message from dead worker %v", fw.SrcWorker)
+				continue
+			}
 			switch fw.Type {
+			case msg.WorkerDied:
+				if !hasWorker(mgr, fw.SrcWorker) {
+					break
+				}
+				log.Printf("Worker %v died during Superstep %v", fw.SrcWorker, request.Superstep)
+				if !recoverable {
+					panic(fmt.Sprintf("Worker %v died, and not all workers can recover its partitions", fw.SrcWorker))
+				}
+				dead[fw.SrcWorker] = struct{}{}
+				delete(dones, fw.SrcWorker)
+				delete(sentBy, fw.SrcWorker)
+				if len(dead) == mgr.NumWorkers() {
+					panic("All workers died")
+				}
+			case msg.Rejoined:
+				rejoined = &workerRejoined{fw.SrcWorker}
+				if rejoinTimeout == nil {
+					rejoinTimeout = time.After(timeout)
+				}
 			case msg.Inactive:
 				// Since it did no work, don't update elapsed time
 				dones[fw.SrcWorker] = msg.Inactive
@@ -152,18 +291,38 @@ func iterateSupersteps(request *msg.Request, mgr manager.Manager,
 				mgr.SetElapsedTime(wid, elapsedTime)
 				halt = false
 				dones[fw.SrcWorker] = msg.Done
+				sentBy[fw.SrcWorker] = fw.Sent
 			case msg.V2V:
 				halt = false
 				dstWorker := mgr.GetWorker(fw.DstVertex)
+				if _, ok := dead[dstWorker]; ok {
+					// The sender logged it, and replays it to the new owner
+					continue
+				}
 				fs := msg.NewV2VServer(fw.DstVertex, fw.Msg, dstWorker, fw.StepNum, fw.SrcVertex, fw.SrcWorker)
 				logMessageFS(fs)
 				cOut <- fs
+			case msg.V2VBatch:
+				halt = false
+				routeBatch(fw, mgr, dead, cOut)
 			default:
 				log.Printf("Error: Unexpected message during Superstep %v: %v",
 					request.Superstep, fw)
 			}
 
-			if len(dones) == mgr.NumWorkers() {
+			if len(dones) == mgr.NumWorkers()-len(dead) {
+				if rejoined != nil {
+					panic(*rejoined)
+				}
+				if len(dead) > 0 {
+					recoverWorkers(request, mgr, addresses, dead, cIn, cOut)
+				}
+				expected = make(map[msg.WorkerId]int)
+				for _, sent := range sentBy {
+					for w, count := range sent {
+						expected[w] += count
+					}
+				}
 				log.Printf("Completed Superstep %v", request.Superstep)
 				log.Printf("\tFastest to Slowest ratio: %v", mgr.FastestToSlowest())
 				log.Printf("\tIs in optimal range?: %v", mgr.IsOptimal())
@@ -173,48 +332,229 @@ func iterateSupersteps(request *msg.Request, mgr manager.Manager,
 				if request.Superstep >= max_supersteps {
 					halt = true
 				}
-				if (request.Superstep%checkpoint_rate == 0) || halt || !mgr.IsOptimal() {
-					saveCheckpoint(request.DBAccess.OtherKey(), mgr.Workers(), cIn, cOut)
+				stop, drains := readControl(cControl, mgr)
+				if (request.Superstep%checkpoint_rate == 0) || halt || !mgr.IsOptimal() || stop || len(drains) > 0 {
+					saveCheckpoint(request.DBAccess.OtherKey(), mgr.Workers(), request.Superstep-1, expected, cIn, cOut)
 					(&request.DBAccess).SwapKeys()
 					request.CheckpointStep = request.Superstep
+					// Let the server record where to resume from
+					cDone <- msg.Result{Val: msg.Checkpointed, Request: *request}
 
 					if halt {
 						if request.DBAccess.PrimaryKey() != request.DBAccess.Key() {
 							// It most recently saved into the Secondary key
 							// so we have to copy it to the primary key for the client
-							saveCheckpoint(request.DBAccess.OtherKey(), mgr.Workers(), cIn, cOut)
+							saveCheckpoint(request.DBAccess.OtherKey(), mgr.Workers(), request.Superstep-1, nil, cIn, cOut)
 						}
 						return true
-					} else if !mgr.IsOptimal() {
-						return false
-					} else {
-						return false
-						//panic("No problem. Just checking if there are any new workers.")
+					} else if stop {
+						panic(jobStopped{})
 					}
+					// Redistribute, to leave out drained workers, take on new
+					// ones, or rebalance if the workers are !mgr.IsOptimal()
+					releaseWorkers(mgr, drains, cOut)
+					joinWorkers(mgr, pool, addresses)
+					return false
 				}
 				mgr.ResetSpeeds()
-				return iterateSupersteps(request, mgr, cIn, cOut)
+				return iterateSupersteps(request, mgr, addresses, recoverable, pool, expected, cIn, cControl, cOut, cDone)
+			}
+		case <-rejoinTimeout:
+			// The rejoined worker may have restarted, and will never be done
+			panic(*rejoined)
+		}
+	}
+}
+
+// Takes what was asked for on cControl since the last barrier: whether to stop,
+// and which of the job's workers to drain. Draining every worker is stopping,
+// so that the request can go on elsewhere.
+func readControl(cControl chan msg.FromWorker, mgr manager.Manager) (stop bool, drains []msg.WorkerId) {
+	for {
+		select {
+		case fw := <-cControl:
+			logMessageFW(fw)
+			switch fw.Type {
+			case msg.Stop:
+				stop = true
+			case msg.Drain:
+				if hasWorker(mgr, fw.SrcWorker) && !hasId(drains, fw.SrcWorker) {
+					drains = append(drains, fw.SrcWorker)
+				}
+			default:
+				log.Printf("Error: Unexpected control message %v", fw)
+			}
+		default:
+			if len(drains) >= mgr.NumWorkers() {
+				stop = true
+			}
+			return stop, drains
+		}
+	}
+}
+
+// Takes the drained workers out of the job, and lets the server know it can
+// release them.
+func releaseWorkers(mgr manager.Manager, drains []msg.WorkerId, cOut chan msg.FromServer) {
+	for _, w := range drains {
+		log.Printf("Draining worker %v", w)
+		mgr.RemoveWorker(w)
+		fs := msg.NewRelease(w)
+		logMessageFS(fs)
+		cOut <- fs
+	}
+}
+
+// Adds the workers the pool has for the job, to be given partitions when they
+// are next redistributed.
+func joinWorkers(mgr manager.Manager, pool WorkerPool, addresses map[msg.WorkerId]string) {
+	if pool == nil {
+		return
+	}
+	for w, address := range pool.MoreWorkers() {
+		log.Printf("Worker %v joined the job", w)
+		mgr.AddWorker(w)
+		addresses[w] = address
+	}
+}
+
+// Hands the partitions of the dead workers to the others, which load them
+// from the last checkpoint and replay them up to the current superstep. The
+// inputs of the replayed vertices come from each other and from the messages
+// the others logged since the checkpoint, so no one else rolls back.
+// Panics if another worker dies or rejoins meanwhile.
+func recoverWorkers(request *msg.Request, mgr manager.Manager, addresses map[msg.WorkerId]string,
+	dead map[msg.WorkerId]struct{}, cIn chan msg.FromWorker, cOut chan msg.FromServer) {
+	gained := make(map[msg.WorkerId][]msg.Partition)
+	var lost []msg.Partition
+	for w := range dead {
+		for _, a := range mgr.ReassignWorker(w) {
+			gained[a.Worker] = append(gained[a.Worker], a.Partitions...)
+			lost = append(lost, a.Partitions...)
+		}
+	}
+	for w := range dead {
+		// Partitions passed on from one dead worker to another were
+		// passed on again when that one was reassigned
+		delete(gained, w)
+	}
+	log.Printf("Recovering %v partitions from superstep %v to %v",
+		len(lost), request.CheckpointStep, request.Superstep)
+
+	workers := mgr.Workers()
+	peers := peersOf(mgr.Assignments(), addresses)
+	for _, w := range workers {
+		fs := msg.NewRecover(request.DBAccess.Key(), gained[w], lost, peers, request.Superstep, w)
+		logMessageFS(fs)
+		cOut <- fs
+	}
+	waitForRecovery(msg.RecoverAck, -1, workers, dead, mgr, cIn, cOut)
+
+	for step := request.CheckpointStep; step <= request.Superstep; step++ {
+		for _, w := range workers {
+			fs := msg.NewReplay(step, request.Superstep, w)
+			logMessageFS(fs)
+			cOut <- fs
+		}
+		waitForRecovery(msg.ReplayDone, step, workers, dead, mgr, cIn, cOut)
+	}
+	log.Printf("Recovered %v partitions", len(lost))
+}
+
+// Waits for every worker to reply with ackType (for step, if it is a
+// ReplayDone), passing on their vertex messages meanwhile.
+func waitForRecovery(ackType msg.Type, step int, workers []msg.WorkerId, dead map[msg.WorkerId]struct{},
+	mgr manager.Manager, cIn chan msg.FromWorker, cOut chan msg.FromServer) {
+	acks := make(map[msg.WorkerId]struct{})
+	for len(acks) < len(workers) {
+		select {
+		case fw := <-cIn:
+			logMessageFW(fw)
+			if _, ok := dead[fw.SrcWorker]; ok {
+				continue
+			}
+			checkWorkerDied(fw)
+			switch fw.Type {
+			case msg.Rejoined:
+				panic(workerRejoined{fw.SrcWorker})
+			case msg.V2V:
+				dstWorker := mgr.GetWorker(fw.DstVertex)
+				fs := msg.NewV2VServer(fw.DstVertex, fw.Msg, dstWorker, fw.StepNum, fw.SrcVertex, fw.SrcWorker)
+				logMessageFS(fs)
+				cOut <- fs
+			case msg.V2VBatch:
+				routeBatch(fw, mgr, dead, cOut)
+			case ackType:
+				if fw.Type == msg.RecoverAck && fw.Msg == 0 {
+					//db problems
+					panic("Workers unable to load recovered vertices")
+				}
+				if fw.Type == msg.ReplayDone && fw.StepNum != step {
+					log.Printf("Error: Expected ReplayDone for superstep %v, Received %v", step, fw)
+					break
+				}
+				acks[fw.SrcWorker] = struct{}{}
+			default:
+				log.Printf("Error: Msg type expected %v, Received %v", msg.TypeStr(ackType), fw)
 			}
 		case <-time.After(timeout):
-			panic(fmt.Sprintf("Timed out during Superstep %v", request.Superstep))
+			panic(fmt.Sprintf("Timed out waiting for %v", msg.TypeStr(ackType)))
+		}
+	}
+}
+
+// Splits a batch of vertex messages by the worker that owns each destination
+// vertex, and passes each part on as a batch of its own. Messages for dead
+// workers are dropped; their senders logged them, and replay them.
+func routeBatch(fw msg.FromWorker, mgr manager.Manager, dead map[msg.WorkerId]struct{}, cOut chan msg.FromServer) {
+	byWorker := make(map[msg.WorkerId][]msg.VertexMsg)
+	for _, vm := range fw.Batch {
+		dstWorker := mgr.GetWorker(vm.Dst)
+		if _, ok := dead[dstWorker]; ok {
+			continue
+		}
+		byWorker[dstWorker] = append(byWorker[dstWorker], vm)
+	}
+	for dstWorker, batch := range byWorker {
+		fs := msg.NewV2VBatchServer(batch, dstWorker, fw.StepNum, fw.SrcWorker)
+		logMessageFS(fs)
+		cOut <- fs
+	}
+}
+
+func hasWorker(mgr manager.Manager, worker msg.WorkerId) bool {
+	return hasId(mgr.Workers(), worker)
+}
+
+func hasId(workers []msg.WorkerId, worker msg.WorkerId) bool {
+	for _, w := range workers {
+		if w == worker {
+			return true
 		}
 	}
+	return false
 }
 
-func saveCheckpoint(dbKey string, workers []msg.WorkerId, cIn chan msg.FromWorker, cOut chan msg.FromServer) {
+// The workers first wait for the expected messages of superstep expectedStep.
+func saveCheckpoint(dbKey string, workers []msg.WorkerId, expectedStep int, expected map[msg.WorkerId]int,
+	cIn chan msg.FromWorker, cOut chan msg.FromServer) {
 	log.Printf("Saving CHECKPOINTS in %v", dbKey)
 	for _, w := range workers {
-		fs := msg.NewSaveCheckpoint(dbKey, w)
+		fs := msg.NewSaveCheckpoint(dbKey, expectedStep, expected[w], w)
 		logMessageFS(fs)
 		cOut <- fs
 	}
 
 	acks := make(map[msg.WorkerId]struct{})
+	var rejoined *workerRejoined
 	for {
 		select {
 		case fw := <-cIn:
 			logMessageFW(fw)
-			if fw.Type == msg.SaveCheckpointAck {
+			checkWorkerDied(fw)
+			if fw.Type == msg.Rejoined {
+				rejoined = &workerRejoined{fw.SrcWorker}
+			} else if fw.Type == msg.SaveCheckpointAck {
 				if fw.Msg == 0 {
 					//db problems
 					panic("Workers unable to SaveCheckpoint")
@@ -229,7 +569,28 @@ func saveCheckpoint(dbKey string, workers []msg.WorkerId, cIn chan msg.FromWorke
 				return
 			}
 		case <-time.After(timeout):
+			if rejoined != nil {
+				// Nothing was swapped, so the last checkpoint is still good
+				panic(*rejoined)
+			}
 			panic("Timed out waiting for SaveCheckpointAck")
 		}
 	}
 }
+
+// Messages left over from a superstep that was rolled back
+func isStale(fw msg.FromWorker, superstep int) bool {
+	switch fw.Type {
+	case msg.Done, msg.Inactive, msg.V2V, msg.V2VBatch:
+		return fw.StepNum != superstep
+	}
+	return false
+}
+
+// Fails fast when the server has noticed that one of the workers died,
+// instead of waiting for the timeout
+func checkWorkerDied(fw msg.FromWorker) {
+	if fw.Type == msg.WorkerDied {
+		panic(fmt.Sprintf("Worker %v died", fw.SrcWorker))
+	}
+}
@@ -79,6 +79,14 @@ type Manager interface {
 	// Replaces current worker and parition info with these
 	// Returns the number of loaded vertices
 	LoadAssignments(assigns []Assignment) int
+
+	// Returns the partitions currently on each worker
+	Assignments() []Assignment
+
+	// Removes the worker and hands its partitions to the remaining workers,
+	// fastest first, without moving any other partition.
+	// Returns only the partitions each remaining worker gained.
+	ReassignWorker(worker msg.WorkerId) []Assignment
 }
 
 func New(numVertices int) Manager {
@@ -181,6 +181,56 @@ func TestUnequalDistribution(tee *testing.T) {
 		minP, midP, maxP, fast, slow, float64(maxP)/float64(minP), float64(slow)/float64(fast))
 }
 
+func TestReassignWorker(tee *testing.T) {
+	t = tee
+
+	m := New(numV)
+	for _, w := range workers {
+		m.AddWorker(w)
+	}
+	assigns := m.Redistribute()
+
+	var deadParts []msg.Partition
+	owners := map[msg.VertexId]msg.WorkerId{}
+	for _, a := range assigns {
+		for _, p := range a.Partitions {
+			owners[p.Start()] = a.Worker
+			if a.Worker == "w3" {
+				deadParts = append(deadParts, p)
+			}
+		}
+	}
+
+	gained := m.ReassignWorker("w3")
+	test("NumWorkers after reassign", numW-1, m.NumWorkers())
+
+	gainedCount := 0
+	for _, a := range gained {
+		test(fmt.Sprintf("gaining worker %v is not the dead one", a.Worker), false, a.Worker == "w3")
+		for _, p := range a.Partitions {
+			gainedCount++
+			test(fmt.Sprintf("partition %v now on %v", p.Start(), a.Worker), a.Worker, m.GetWorker(p.Start()))
+		}
+	}
+	test("all dead partitions reassigned", len(deadParts), gainedCount)
+
+	// The other partitions stay where they were
+	for start, owner := range owners {
+		if owner != "w3" {
+			test(fmt.Sprintf("partition %v unmoved", start), owner, m.GetWorker(start))
+		}
+	}
+
+	for _, a := range m.Assignments() {
+		test("dead worker has no assignment", false, a.Worker == "w3")
+		for _, p := range a.Partitions {
+			test(fmt.Sprintf("assignment of %v", p.Start()), a.Worker, m.GetWorker(p.Start()))
+		}
+	}
+
+	test("reassigning an unknown worker", 0, len(m.ReassignWorker("w3")))
+}
+
 func test(summary string, expect, actual interface{}) {
 	if !reflect.DeepEqual(expect, actual) {
 		_, _, line, _ := runtime.Caller(1)
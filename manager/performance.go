@@ -232,6 +232,41 @@ func (pm *performanceManager) LoadAssignments(assigns []Assignment) int {
 	return numVertices
 }
 
+func (pm *performanceManager) Assignments() (assigns []Assignment) {
+	for _, w := range pm.sortedWorkers() {
+		assigns = append(assigns, Assignment{w.id, w.partitions})
+	}
+	return assigns
+}
+
+func (pm *performanceManager) ReassignWorker(worker msg.WorkerId) (gained []Assignment) {
+	dead, exists := pm.workers[worker]
+	if !exists {
+		return nil
+	}
+	delete(pm.workers, worker)
+	if len(pm.workers) == 0 {
+		return nil
+	}
+
+	workers := pm.sortedWorkers()
+	gainedBy := make(map[msg.WorkerId][]msg.Partition)
+	for i, p := range dead.partitions {
+		w := workers[i%len(workers)]
+		w.partitions = append(w.partitions, p)
+		w.numVertices += p.Size()
+		pm.distribution.setWorker(w.id, p)
+		gainedBy[w.id] = append(gainedBy[w.id], p)
+	}
+
+	for _, w := range workers {
+		if parts, ok := gainedBy[w.id]; ok {
+			gained = append(gained, Assignment{w.id, parts})
+		}
+	}
+	return gained
+}
+
 func findPartitionSize(assigns []Assignment) int {
 	if len(assigns) == 0 {
 		return 0
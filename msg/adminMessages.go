@@ -3,16 +3,21 @@ package msg
 import (
 	"fmt"
 	"project_c9f7_i5l8_o0p4_p0j8/db"
+	"time"
 )
 
-// Represent a job request from a client. The OutChannel is used to indicate when this job has been handled and should be returned to the client (or stored if Client is unavailable) since Client<->Server is RPC.
+// Represent a job request from a client. Requests are persisted by the server,
+// so that they can be resumed from CheckpointStep after a restart.
 type Request struct {
 	ClientId       int
 	RequestId      int
 	DBAccess       db.Access
 	Superstep      int
-	OutChannel     chan Result
 	CheckpointStep int
+	NumWorkers     int // Requested number of workers; 0 lets the scheduler decide
+	Priority       int       // Higher runs first
+	Submitted      time.Time // When the request was first queued, for aging
+	QueueSeq       int       // Order of first submission; kept when requeued
 }
 
 // The result of a job operation
@@ -29,6 +34,7 @@ const (
 	Success              // Completed, can return to client
 	Incomplete           // Retry
 	Failure              // Fatal error, unfinishable
+	Checkpointed         // Progress report: a checkpoint was saved, keep running
 )
 
 func ResultStr(r Result) string {
@@ -41,6 +47,8 @@ func ResultStr(r Result) string {
 		return "Incomplete"
 	case Failure:
 		return "Failure"
+	case Checkpointed:
+		return "Checkpointed"
 	default:
 		return fmt.Sprintf("Illegal msg.ResultVal: %v", r.Val)
 
@@ -68,6 +76,21 @@ type ServerConnectionResp struct {
 	PendingJobs []int
 }
 
+// ClientStatusMsg The client sends this to ask about its request.
+type ClientStatusMsg struct {
+	ClientId int
+}
+
+// ServerStatusResp A server's reply to a status request.
+// QueuePosition is 1 for the next request to be scheduled, and 0 if the
+// client's request is not queued (either running or not submitted).
+type ServerStatusResp struct {
+	RequestId     int
+	QueuePosition int
+	QueueLength   int
+	Running       bool
+}
+
 // ServerRequestResp A server's reply to a request.
 // If the request was not completed, reply val will be the error string.
 // If the request was successfully completed, reply val will be the return data.
@@ -77,16 +100,67 @@ type ServerRequestResp struct {
 	ReplyVal  string
 }
 
+// Admin - Server Messages:
+
+// DrainWorkerMsg The admin sends this to take a worker out of service, for
+// maintenance of its host.
+type DrainWorkerMsg struct {
+	WorkerId WorkerId
+}
+
+// DrainWorkerResp A server's reply to a drain request. If the worker is in a
+// job, its partitions are moved to the rest of the job at the next barrier,
+// and it is released after that. Either way, it is given no new jobs.
+type DrainWorkerResp struct {
+	InJob bool
+}
+
+// WorkersMsg The admin sends this to list the connected workers.
+type WorkersMsg struct {
+}
+
+// WorkerStatus What the server knows about a worker.
+type WorkerStatus struct {
+	WorkerId WorkerId
+	Address  string
+	State    string
+	Busy     bool // In a job
+	Draining bool // Given no new jobs
+}
+
+// WorkersResp A server's reply to a WorkersMsg, ordered by WorkerId.
+type WorkersResp struct {
+	Workers []WorkerStatus
+}
+
 // Server <-> Worker Messages:
 
 // WorkerConnectionMsg Sent by worker when connecting to the server.
 type WorkerConnectionMsg struct {
-	WorkerId      WorkerId
-	WorkerAddress string
+	WorkerId        WorkerId
+	WorkerAddress   string
+	Codec           string   // How the rest of the messages are encoded; see CodecByName
+	VectorClocks    bool     // Whether to send every message through GoVector, for debugging
+	ProtocolVersion int      // The worker's ProtocolVersion; 0 for workers that predate it
+	Capabilities    []string // What the worker can do; see CapBatch and co.
+	Window          int      // How many messages the server may send before the worker returns credits
+	RejoinToken     string   // The token the server gave this worker when it last connected, if any
+}
+
+// PeerConnectionMsg Sent by a worker when it connects to another worker, to
+// send it vertex messages directly.
+type PeerConnectionMsg struct {
+	WorkerId WorkerId
+	Codec    string
 }
 
 // WorkerConnectionResp Response from server to a Worker Connection Requirest
 type WorkerConnectionResp struct {
-	WorkerId   WorkerId
-	IsAccepted bool
+	WorkerId        WorkerId
+	IsAccepted      bool
+	Reason          string // Why the worker was refused
+	Retry           bool   // The refusal is only for now; the worker should try again later
+	ProtocolVersion int    // The server's ProtocolVersion
+	Window          int    // How many messages the worker may send before the server returns credits
+	RejoinToken     string // Proves that a later connection with the same WorkerId is this worker's
 }
@@ -0,0 +1,296 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BinaryCodec is a hand-rolled encoding of FromServer and FromWorker, which
+// make up nearly all of the traffic. Integers are varints, strings and lists
+// are length-prefixed, and nothing describes the fields, so both sides must
+// be built from the same version of this file. Any other message is sent
+// with gob.
+type BinaryCodec struct{}
+
+// The first byte of each message says how the rest is encoded
+const (
+	binaryFromServer byte = 's'
+	binaryFromWorker byte = 'w'
+	binaryGob        byte = 'g'
+)
+
+var errShortMessage = errors.New("binary codec: message ends early")
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Encode(v interface{}) ([]byte, error) {
+	var w binaryWriter
+	switch m := v.(type) {
+	case FromServer:
+		w.encodeFromServer(&m)
+	case *FromServer:
+		w.encodeFromServer(m)
+	case FromWorker:
+		w.encodeFromWorker(&m)
+	case *FromWorker:
+		w.encodeFromWorker(m)
+	default:
+		data, err := GobCodec{}.Encode(v)
+		return append([]byte{binaryGob}, data...), err
+	}
+	return w.buf, nil
+}
+
+func (BinaryCodec) Decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errShortMessage
+	}
+	r := binaryReader{data: data[1:]}
+	switch data[0] {
+	case binaryFromServer:
+		m, ok := v.(*FromServer)
+		if !ok {
+			return fmt.Errorf("binary codec: cannot decode a FromServer into %T", v)
+		}
+		*m = r.decodeFromServer()
+	case binaryFromWorker:
+		m, ok := v.(*FromWorker)
+		if !ok {
+			return fmt.Errorf("binary codec: cannot decode a FromWorker into %T", v)
+		}
+		*m = r.decodeFromWorker()
+	case binaryGob:
+		return GobCodec{}.Decode(data[1:], v)
+	default:
+		return fmt.Errorf("binary codec: unknown message kind %q", data[0])
+	}
+	return r.err
+}
+
+// ===========================================================================
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *binaryWriter) int(i int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], i)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *binaryWriter) float(f float64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+	w.buf = append(w.buf, tmp[:]...)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.int(int64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) partitions(ps []Partition) {
+	w.int(int64(len(ps)))
+	for _, p := range ps {
+		w.int(int64(p.StartIdx))
+		w.int(int64(p.EndIdx))
+	}
+}
+
+func (w *binaryWriter) batch(vms []VertexMsg) {
+	w.int(int64(len(vms)))
+	for _, vm := range vms {
+		w.int(int64(vm.Src))
+		w.int(int64(vm.Dst))
+		w.float(vm.Val)
+	}
+}
+
+func (w *binaryWriter) encodeFromServer(m *FromServer) {
+	w.byte(binaryFromServer)
+	w.int(int64(m.Type))
+	w.string(string(m.SrcWorker))
+	w.string(string(m.DstWorker))
+	w.int(int64(m.SrcVertex))
+	w.int(int64(m.DstVertex))
+	w.float(m.Msg)
+	w.int(int64(m.StepNum))
+	w.partitions(m.Partitions)
+	w.string(m.DBKey)
+	w.partitions(m.LostPartitions)
+	w.int(int64(m.EndStep))
+	w.batch(m.Batch)
+	w.int(int64(len(m.Peers)))
+	for _, p := range m.Peers {
+		w.string(string(p.Worker))
+		w.string(p.Address)
+		w.partitions(p.Partitions)
+	}
+	w.int(m.Round)
+	w.int(int64(m.Expected))
+	w.int(int64(m.ExpectedStep))
+	w.int(int64(m.Credits))
+	w.int(int64(m.Mid))
+}
+
+func (w *binaryWriter) encodeFromWorker(m *FromWorker) {
+	w.byte(binaryFromWorker)
+	w.int(int64(m.Type))
+	w.string(string(m.SrcWorker))
+	w.string(string(m.DstWorker))
+	w.int(int64(m.DstVertex))
+	w.int(int64(m.SrcVertex))
+	w.float(m.Msg)
+	w.batch(m.Batch)
+	w.int(int64(len(m.Sent)))
+	for worker, count := range m.Sent {
+		w.string(string(worker))
+		w.int(int64(count))
+	}
+	w.int(m.Round)
+	w.int(int64(m.Credits))
+	w.int(int64(m.StepNum))
+}
+
+// ===========================================================================
+
+// binaryReader reads what binaryWriter wrote. After the first error it reads
+// only zeroes, and the error is checked once at the end.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	i, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errShortMessage
+		return 0
+	}
+	r.data = r.data[n:]
+	return i
+}
+
+// A length, which can't be more than the bytes left, each item taking at
+// least one byte.
+func (r *binaryReader) length() int {
+	n := r.int()
+	if n < 0 || n > int64(len(r.data)) {
+		if r.err == nil {
+			r.err = fmt.Errorf("binary codec: bad length %v", n)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) float() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = errShortMessage
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return f
+}
+
+func (r *binaryReader) string() string {
+	n := r.length()
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binaryReader) partitions() []Partition {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	ps := make([]Partition, n)
+	for i := range ps {
+		ps[i].StartIdx = int(r.int())
+		ps[i].EndIdx = int(r.int())
+	}
+	return ps
+}
+
+func (r *binaryReader) batch() []VertexMsg {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	vms := make([]VertexMsg, n)
+	for i := range vms {
+		vms[i].Src = VertexId(r.int())
+		vms[i].Dst = VertexId(r.int())
+		vms[i].Val = r.float()
+	}
+	return vms
+}
+
+func (r *binaryReader) decodeFromServer() FromServer {
+	var m FromServer
+	m.Type = Type(r.int())
+	m.SrcWorker = WorkerId(r.string())
+	m.DstWorker = WorkerId(r.string())
+	m.SrcVertex = VertexId(r.int())
+	m.DstVertex = VertexId(r.int())
+	m.Msg = r.float()
+	m.StepNum = int(r.int())
+	m.Partitions = r.partitions()
+	m.DBKey = r.string()
+	m.LostPartitions = r.partitions()
+	m.EndStep = int(r.int())
+	m.Batch = r.batch()
+	if n := r.length(); n > 0 {
+		m.Peers = make([]Peer, n)
+		for i := range m.Peers {
+			m.Peers[i].Worker = WorkerId(r.string())
+			m.Peers[i].Address = r.string()
+			m.Peers[i].Partitions = r.partitions()
+		}
+	}
+	m.Round = r.int()
+	m.Expected = int(r.int())
+	m.ExpectedStep = int(r.int())
+	m.Credits = int(r.int())
+	m.Mid = int(r.int())
+	return m
+}
+
+func (r *binaryReader) decodeFromWorker() FromWorker {
+	var m FromWorker
+	m.Type = Type(r.int())
+	m.SrcWorker = WorkerId(r.string())
+	m.DstWorker = WorkerId(r.string())
+	m.DstVertex = VertexId(r.int())
+	m.SrcVertex = VertexId(r.int())
+	m.Msg = r.float()
+	m.Batch = r.batch()
+	if n := r.length(); n > 0 {
+		m.Sent = make(map[WorkerId]int, n)
+		for i := 0; i < n; i++ {
+			worker := WorkerId(r.string())
+			m.Sent[worker] = int(r.int())
+		}
+	}
+	m.Round = r.int()
+	m.Credits = int(r.int())
+	m.StepNum = int(r.int())
+	return m
+}
@@ -0,0 +1,117 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// A Codec turns the messages between the server and workers into bytes and
+// back. Each frame on a connection holds one message encoded with the codec
+// agreed on when the connection was set up.
+type Codec interface {
+	Name() string
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// The codec used when none is asked for
+const DefaultCodec = "binary"
+
+var codecs = map[string]Codec{
+	"gob":     GobCodec{},
+	"msgpack": MsgpackCodec{},
+	"binary":  BinaryCodec{},
+}
+
+// CodecByName returns the codec with the given name.
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q, expected one of %v", name, CodecNames())
+	}
+	return codec, nil
+}
+
+// CodecNames returns the names of all the codecs, in order.
+func CodecNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The connection messages, which say which codec to use for the rest of the
+// connection, are always sent with this one.
+var HandshakeCodec Codec = GobCodec{}
+
+// ===========================================================================
+
+// GobCodec encodes each message with encoding/gob. Every message carries its
+// own type information, so it is the simplest and the largest.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	// gob leaves fields that were sent as zero alone, so clear them first
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ===========================================================================
+
+// VectorLogger is the part of a GoVector logger that wraps messages in a
+// vector clock. GoVector's *govec.GoLog satisfies it.
+type VectorLogger interface {
+	PrepareSend(msg string, buf interface{}) []byte
+	UnpackReceive(msg string, buf []byte, unpack interface{})
+}
+
+// LoggingCodec sends every message through GoVector, which adds a vector
+// clock to it and logs it, so that a run can be visualised. It is much
+// slower than the other codecs, and only meant for debugging.
+type LoggingCodec struct {
+	Logger VectorLogger
+}
+
+func (LoggingCodec) Name() string {
+	return "govec"
+}
+
+func (lc LoggingCodec) Encode(v interface{}) ([]byte, error) {
+	return lc.Logger.PrepareSend("Sending-"+describe(v), v), nil
+}
+
+func (lc LoggingCodec) Decode(data []byte, v interface{}) error {
+	lc.Logger.UnpackReceive("Received-"+describe(v), data, v)
+	return nil
+}
+
+func describe(v interface{}) string {
+	switch m := v.(type) {
+	case FromServer:
+		return TypeStr(m.Type) + "-Message"
+	case FromWorker:
+		return TypeStr(m.Type) + "-Message"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
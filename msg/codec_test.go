@@ -0,0 +1,138 @@
+package msg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func sampleBatch(n int) []VertexMsg {
+	batch := make([]VertexMsg, n)
+	for i := range batch {
+		batch[i] = VertexMsg{VertexId(i * 7), VertexId(1000000 + i), 0.15 / float64(i+1)}
+	}
+	return batch
+}
+
+func sampleFromServer() FromServer {
+	fs := NewAssign("graph-key", []Partition{NewPartition(0, 100), NewPartition(200, 300)},
+		[]Peer{{"w1", "127.0.0.1:9005", []Partition{NewPartition(0, 100)}},
+			{"w2", "127.0.0.1:9010", []Partition{NewPartition(100, 300)}}},
+		-123456789, "w1")
+	fs.Batch = sampleBatch(3)
+	fs.LostPartitions = []Partition{NewPartition(100, 200)}
+	fs.Expected = 42
+	fs.ExpectedStep = -1
+	fs.Credits = 128
+	fs.Msg = -1.5
+	return fs
+}
+
+func sampleFromWorker() FromWorker {
+	return FromWorker{
+		Type:      V2VBatch,
+		SrcWorker: "w2",
+		DstWorker: "w1",
+		SrcVertex: 5,
+		DstVertex: -6,
+		Msg:       0.25,
+		Batch:     sampleBatch(3),
+		Sent:      map[WorkerId]int{"w1": 3, "w3": 300},
+		Round:     99,
+		Credits:   64,
+		StepNum:   7,
+	}
+}
+
+func TestCodecRoundTrip(tee *testing.T) {
+	t = tee
+
+	for _, name := range CodecNames() {
+		codec, err := CodecByName(name)
+		test("codec "+name, nil, err)
+
+		fs := sampleFromServer()
+		data, err := codec.Encode(fs)
+		test(name+" encoding FromServer", nil, err)
+		var fsOut FromServer
+		test(name+" decoding FromServer", nil, codec.Decode(data, &fsOut))
+		test(name+" FromServer", fs, fsOut)
+
+		fw := sampleFromWorker()
+		data, err = codec.Encode(fw)
+		test(name+" encoding FromWorker", nil, err)
+		var fwOut FromWorker
+		test(name+" decoding FromWorker", nil, codec.Decode(data, &fwOut))
+		test(name+" FromWorker", fw, fwOut)
+
+		// Decoding replaces what was there before
+		data, _ = codec.Encode(NewSuperstep(3, 0, "w1"))
+		test(name+" decoding over a message", nil, codec.Decode(data, &fsOut))
+		test(name+" no leftover batch", 0, len(fsOut.Batch))
+
+		conn := WorkerConnectionMsg{WorkerId: "w1", WorkerAddress: "127.0.0.1:9005"}
+		data, err = codec.Encode(conn)
+		test(name+" encoding other messages", nil, err)
+		var connOut WorkerConnectionMsg
+		test(name+" decoding other messages", nil, codec.Decode(data, &connOut))
+		test(name+" other messages", conn, connOut)
+	}
+
+	_, err := CodecByName("json")
+	test("unknown codec", true, err != nil)
+}
+
+func TestCodecTruncated(tee *testing.T) {
+	t = tee
+
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		data, _ := codec.Encode(sampleFromServer())
+		var fs FromServer
+		err := codec.Decode(data[:len(data)/2], &fs)
+		test(name+" truncated message is an error", true, err != nil)
+	}
+}
+
+func benchmarkMessages() []interface{} {
+	return []interface{}{
+		NewV2VBatchServer(sampleBatch(MaxBatchSize), "w1", 3, "w2"),
+		FromWorker{Type: V2VBatch, SrcWorker: "w2", StepNum: 3, Batch: sampleBatch(MaxBatchSize)},
+		NewSuperstep(3, 1000, "w1"),
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		for _, m := range benchmarkMessages() {
+			data, _ := codec.Encode(m)
+			b.Run(fmt.Sprintf("%v/%T/%v", name, m, describe(m)), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					codec.Encode(m)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		for _, m := range benchmarkMessages() {
+			data, _ := codec.Encode(m)
+			b.Run(fmt.Sprintf("%v/%T/%v", name, m, describe(m)), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					if _, ok := m.(FromServer); ok {
+						var fs FromServer
+						codec.Decode(data, &fs)
+					} else {
+						var fw FromWorker
+						codec.Decode(data, &fw)
+					}
+				}
+			})
+		}
+	}
+}
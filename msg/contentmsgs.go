@@ -6,6 +6,8 @@ package msg
 import (
 	"fmt"
 	"project_c9f7_i5l8_o0p4_p0j8/db"
+	"sync/atomic"
+	"time"
 )
 
 //import "../db"
@@ -19,26 +21,94 @@ import (
 type Type int
 
 // The comments on each line indicate which special fields are expected to be filled
+// The values are part of the protocol, so they are written out: never change
+// or reuse one, and give a new type the next value.
 const (
+	// The zero value, which no message is sent with; a message whose type was
+	// never set shows up as NilType
+	NilType Type = 0
+
 	// Server -> Worker message types
-	NilType        Type = iota // can't start with 0 or else message Decoding fails
-	Assign                     // DBKey, Partition, DstWorker
-	Superstep                  // StepNum, DstWorker
-	SaveCheckpoint             // DBKey, DstWorker
-	LoadCheckpoint             // DBKey, DstWorker
+	Assign         Type = 1 // DBKey, Partition, Peers, Round, DstWorker
+	Superstep      Type = 2 // StepNum, Expected, ExpectedStep, DstWorker
+	SaveCheckpoint Type = 3 // DBKey, Expected, ExpectedStep, DstWorker
+	LoadCheckpoint Type = 4 // DBKey, DstWorker
 
 	// Worker->Server messsage types
-	PartitionAck      // SrcWorker
-	Done              // SrcWorker
-	Inactive          // SrcWorker
-	SaveCheckpointAck // SrcWorker
-	LoadCheckpointAck // SrcWorker
+	PartitionAck      Type = 5 // SrcWorker
+	Done              Type = 6 // SrcWorker, StepNum, Sent
+	Inactive          Type = 7 // SrcWorker
+	SaveCheckpointAck Type = 8 // SrcWorker
+	LoadCheckpointAck Type = 9 // SrcWorker
+
+	// Both Server->Worker and Worker->Server
+	V2V Type = 10 // DstVertex, Msg, [DstWorker (FromServer only)], (SrcVertex, SrcWorker, StepNum)
+
+	// Both Server->Worker and Worker->Server, every HeartbeatInterval
+	Heartbeat Type = 11 // [DstWorker (FromServer only)], [SrcWorker (FromWorker only)]
+
+	// Server -> Worker, to recover the partitions of a dead worker
+	Recover Type = 12 // DBKey, Partitions, LostPartitions, Peers, StepNum, DstWorker
+	Replay  Type = 13 // StepNum, EndStep, DstWorker
+
+	// Worker -> Server, in reply to the above
+	RecoverAck Type = 14 // SrcWorker
+	ReplayDone Type = 15 // StepNum, SrcWorker
 
 	// Both Server->Worker and Worker->Server
-	V2V // DstVertex, Msg, [DstWorker (FromServer only)], (SrcVertex, SrcWorker, StepNum)
+	V2VBatch Type = 16 // Batch, StepNum, SrcWorker, [DstWorker (FromServer only)]
+
+	// Both Server->Worker and Worker->Server; lets the other side send more
+	Credit Type = 17 // Credits, [DstWorker (FromServer only)], [SrcWorker (FromWorker only)]
+
+	// Server -> Worker, when the server shuts down
+	Disconnect Type = 18 // DstWorker; reconnect to whichever server leads next
+)
+
+// Internal types, passed between the worker manager, the jobs and the
+// scheduler, but never sent over the network. They start at
+// FirstInternalType, so that new wire types never run into them; the server
+// drops a message from a worker with one of them.
+const (
+	FirstInternalType Type = 1000
+
+	// Server -> Job
+	Rejoined   Type = 1000 // SrcWorker; the worker reconnected in the middle of the job
+	WorkerDied Type = 1001 // SrcWorker; the worker stopped responding and was removed
+
+	// Server -> Job; acted on at the next barrier
+	Drain Type = 1002 // SrcWorker; move the worker's partitions to the others, and release it
+	Stop  Type = 1003 // checkpoint and stop, so the request can be resumed later
 
+	// Job -> Server
+	Release Type = 1004 // DstWorker; the job no longer uses the worker
 )
 
+// Whether messages of this type stay inside the server.
+func IsInternal(t Type) bool {
+	return t >= FirstInternalType
+}
+
+// The most vertex messages put in one V2VBatch
+const MaxBatchSize = 1000
+
+// How long a worker holds on to a partly filled V2VBatch before sending it
+const BatchFlushInterval = 20 * time.Millisecond
+
+// How often the server and workers send each other a Heartbeat
+const HeartbeatInterval = time.Second
+
+// The flow control window used when none is configured: how many messages
+// one side of a connection may send before the other returns credits. A
+// window of 0 means no limit.
+const DefaultWindow = 256
+
+// Whether sending a message of this type uses up a credit. Heartbeats and
+// credits always get through, so that a full window can't stall either.
+func NeedsCredit(t Type) bool {
+	return t != Heartbeat && t != Credit
+}
+
 func TypeStr(t Type) string {
 	switch t {
 	case Assign:
@@ -61,6 +131,32 @@ func TypeStr(t Type) string {
 		return "LoadCheckpointAck"
 	case V2V:
 		return "V2V"
+	case Rejoined:
+		return "Rejoined"
+	case Heartbeat:
+		return "Heartbeat"
+	case WorkerDied:
+		return "WorkerDied"
+	case Recover:
+		return "Recover"
+	case Replay:
+		return "Replay"
+	case RecoverAck:
+		return "RecoverAck"
+	case ReplayDone:
+		return "ReplayDone"
+	case V2VBatch:
+		return "V2VBatch"
+	case Credit:
+		return "Credit"
+	case Drain:
+		return "Drain"
+	case Stop:
+		return "Stop"
+	case Release:
+		return "Release"
+	case Disconnect:
+		return "Disconnect"
 	default:
 		return fmt.Sprintf("Illegal msg.State: %v", t)
 	}
@@ -87,32 +183,57 @@ type FromServer struct {
 	// PartitionsEnd   []int
 	DBKey string // This will be one of the two db.Access keys
 
+	// For recovering a dead worker: all of its partitions, and the superstep
+	// that was running when it died
+	LostPartitions []Partition
+	EndStep        int
+
+	Batch []VertexMsg // The vertex messages of a V2VBatch
+
+	// Workers send each other their vertex messages directly, so they are
+	// told who owns each partition, and how many messages to wait for
+	// before starting a superstep or saving a checkpoint.
+	Peers        []Peer
+	Round        int64 // Identifies the assignment; older messages are dropped
+	Expected     int   // Vertex messages sent to DstWorker during ExpectedStep
+	ExpectedStep int
+
+	Credits int // With a Credit: how many more messages the worker may send
+
 	Mid int //message id (for debugging)
 }
 
-var mcounter int = 0 // counter ti give Message Ids; only for hacky debugging
+var mcounter int64 = 0 // counter ti give Message Ids; only for hacky debugging
 
-func NewAssign(dbKey string, partitions []Partition, dstWorker WorkerId) FromServer {
+// Messages are made by many goroutines at once
+func nextMid() int {
+	return int(atomic.AddInt64(&mcounter, 1) - 1)
+}
+
+func NewAssign(dbKey string, partitions []Partition, peers []Peer, round int64, dstWorker WorkerId) FromServer {
 	var fs FromServer
 	fs.Type = Assign
 	fs.DBKey = dbKey
 	fs.Partitions = partitions
+	fs.Peers = peers
+	fs.Round = round
 
 	fs.DstWorker = dstWorker
 
-	fs.Mid = mcounter
-	mcounter++
+	fs.Mid = nextMid()
 	return fs
 }
 
-func NewSuperstep(stepNum int, dstWorker WorkerId) FromServer {
+// The worker waits for the expected messages of the previous superstep
+func NewSuperstep(stepNum int, expected int, dstWorker WorkerId) FromServer {
 	var fs FromServer
 	fs.Type = Superstep
 	fs.StepNum = stepNum
+	fs.Expected = expected
+	fs.ExpectedStep = stepNum - 1
 	fs.DstWorker = dstWorker
 
-	fs.Mid = mcounter
-	mcounter++
+	fs.Mid = nextMid()
 	return fs
 }
 
@@ -128,19 +249,89 @@ func NewV2VServer(dst VertexId, msg float64, dstWorker WorkerId, stepNum int,
 	fs.SrcVertex = src
 	fs.SrcWorker = srcWorker
 
-	fs.Mid = mcounter
-	mcounter++
+	fs.Mid = nextMid()
+	return fs
+}
+
+func NewV2VBatchServer(batch []VertexMsg, dstWorker WorkerId, stepNum int, srcWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = V2VBatch
+	fs.Batch = batch
+	fs.DstWorker = dstWorker
+	fs.StepNum = stepNum
+	fs.SrcWorker = srcWorker
+
+	fs.Mid = nextMid()
+	return fs
+}
+
+func NewRecover(dbKey string, partitions []Partition, lost []Partition, peers []Peer,
+	stepNum int, dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Recover
+	fs.DBKey = dbKey
+	fs.Partitions = partitions
+	fs.LostPartitions = lost
+	fs.Peers = peers
+	fs.StepNum = stepNum
+	fs.DstWorker = dstWorker
+
+	fs.Mid = nextMid()
+	return fs
+}
+
+func NewReplay(stepNum int, endStep int, dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Replay
+	fs.StepNum = stepNum
+	fs.EndStep = endStep
+	fs.DstWorker = dstWorker
+
+	fs.Mid = nextMid()
+	return fs
+}
+
+func NewCredit(credits int, dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Credit
+	fs.Credits = credits
+	fs.DstWorker = dstWorker
+	return fs
+}
+
+func NewHeartbeat(dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Heartbeat
+	fs.DstWorker = dstWorker
+	return fs
+}
+
+func NewRelease(dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Release
+	fs.DstWorker = dstWorker
+	return fs
+}
+
+func NewDisconnect(dstWorker WorkerId) FromServer {
+	var fs FromServer
+	fs.Type = Disconnect
+	fs.DstWorker = dstWorker
+
+	fs.Mid = nextMid()
 	return fs
 }
 
-func NewSaveCheckpoint(dbKey string, dstWorker WorkerId) FromServer {
+// The worker saves after it has the expected messages of superstep expectedStep
+func NewSaveCheckpoint(dbKey string, expectedStep int, expected int, dstWorker WorkerId) FromServer {
 	var fs FromServer
 	fs.Type = SaveCheckpoint
 	fs.DBKey = dbKey
+	fs.Expected = expected
+	fs.ExpectedStep = expectedStep
 	fs.DstWorker = dstWorker
 
-	fs.Mid = mcounter
-	mcounter++
+	fs.Mid = nextMid()
 	return fs
 }
 
@@ -157,10 +348,25 @@ type FromWorker struct {
 
 	Msg float64 // TBD: Should this really be []byte to allow for diff job types?
 
+	Batch []VertexMsg // The vertex messages of a V2VBatch
+
+	Sent  map[WorkerId]int // With Done: the vertex messages sent to each peer
+	Round int64            // With a V2VBatch sent to a peer: the assignment it belongs to
+
+	Credits int // With a Credit: how many more messages the server may send
+
 	// The rest are only for debugging purposes
 	StepNum int
 }
 
+// A single vertex to vertex message inside a V2VBatch. All the messages of a
+// batch belong to the same superstep.
+type VertexMsg struct {
+	Src VertexId
+	Dst VertexId
+	Val float64
+}
+
 // ===========================================================================
 // Client->Server messages
 
@@ -169,6 +375,12 @@ type ClientRequestMsg struct {
 	ClientId  int
 	RequestId int
 	DBAccess  db.Access
+	// The number of workers to run the job on. If 0, the server picks a
+	// number based on the size of the graph and the other pending requests.
+	NumWorkers int
+	// Requests with a higher priority are scheduled first. Waiting requests
+	// slowly gain priority, so low priority work still runs eventually.
+	Priority int
 	// TODO: Parameters needed for passing and processing the graph data
 	// For example:
 	// GraphBinary []byte (or other format)
@@ -187,6 +399,13 @@ func (vid VertexId) Int() int {
 	return int(vid)
 }
 
+// A worker, where other workers can reach it, and the partitions it owns
+type Peer struct {
+	Worker     WorkerId
+	Address    string
+	Partitions []Partition
+}
+
 /////////////////////////// Partition ///////////////////
 
 /// As in slices, startIdx is first index, and the last index is one before endIdx
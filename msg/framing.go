@@ -0,0 +1,57 @@
+package msg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Messages between the server and workers are sent over TCP as frames: a
+// 4 byte little-endian length, followed by that many bytes of encoded message.
+
+// The largest message either side will send or accept. Anything bigger is a
+// bug or a corrupt stream, and it is better to drop the connection than to
+// try to allocate it.
+const MaxFrameSize = 64 << 20
+
+const frameHeaderSize = 4
+
+// WriteFrame writes payload to w as a single frame.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %v bytes exceeds the maximum of %v", len(payload), MaxFrameSize)
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	// A single write, so that frames from different goroutines never interleave
+	_, err := w.Write(frame)
+	if err != nil {
+		return fmt.Errorf("writing frame of %v bytes: %v", len(payload), err)
+	}
+	return nil
+}
+
+// ReadFrame reads a single frame from r and returns its payload, however the
+// frame was split up on the way. A stream that ends between frames returns
+// io.EOF; one that ends in the middle of a frame returns an error.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reading frame header: %v", err)
+	}
+
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %v bytes exceeds the maximum of %v", size, MaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading frame of %v bytes: %v", size, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,129 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+var t *testing.T
+
+// An Assign far too big for the old 512 byte buffer
+func bigAssign() FromServer {
+	var partitions []Partition
+	for i := 0; i < 5000; i++ {
+		partitions = append(partitions, NewPartition(i*100, (i+1)*100))
+	}
+	return NewAssign("graph-key", partitions, nil, 1, "w1")
+}
+
+func TestLargeMessage(tee *testing.T) {
+	t = tee
+
+	sent := bigAssign()
+	payload, err := json.Marshal(sent)
+	test("encoding", nil, err)
+	test("message is large", true, len(payload) > 1<<16)
+
+	client, server := net.Pipe()
+	go func() {
+		WriteFrame(client, payload)
+		client.Close()
+	}()
+
+	frame, err := ReadFrame(server)
+	test("reading frame", nil, err)
+	var received FromServer
+	test("decoding", nil, json.Unmarshal(frame, &received))
+	test("received message", sent, received)
+
+	_, err = ReadFrame(server)
+	test("end of stream", io.EOF, err)
+}
+
+func TestFragmentedMessages(tee *testing.T) {
+	t = tee
+
+	var stream bytes.Buffer
+	var sent [][]byte
+	for _, size := range []int{0, 1, 511, 512, 513, 70000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		sent = append(sent, payload)
+		test("writing frame", nil, WriteFrame(&stream, payload))
+	}
+
+	// Deliver the frames a few bytes at a time, splitting headers and payloads
+	client, server := net.Pipe()
+	go func() {
+		data := stream.Bytes()
+		for len(data) > 0 {
+			n := 3
+			if n > len(data) {
+				n = len(data)
+			}
+			client.Write(data[:n])
+			data = data[n:]
+		}
+		client.Close()
+	}()
+
+	for _, payload := range sent {
+		frame, err := ReadFrame(server)
+		test("reading frame", nil, err)
+		test("frame size", len(payload), len(frame))
+		test("frame contents", true, bytes.Equal(payload, frame))
+	}
+	_, err := ReadFrame(server)
+	test("end of stream", io.EOF, err)
+}
+
+func TestTruncatedFrame(tee *testing.T) {
+	t = tee
+
+	client, server := net.Pipe()
+	go func() {
+		var header [frameHeaderSize]byte
+		binary.LittleEndian.PutUint32(header[:], 100)
+		client.Write(header[:])
+		client.Write(make([]byte, 10))
+		client.Close()
+	}()
+
+	_, err := ReadFrame(server)
+	test("truncated frame is an error", true, err != nil && err != io.EOF)
+
+	client, server = net.Pipe()
+	go func() {
+		client.Write([]byte{1, 0})
+		client.Close()
+	}()
+	_, err = ReadFrame(server)
+	test("truncated header is an error", true, err != nil && err != io.EOF)
+}
+
+func TestOversizedFrame(tee *testing.T) {
+	t = tee
+
+	var stream bytes.Buffer
+	err := WriteFrame(&stream, make([]byte, MaxFrameSize+1))
+	test("oversized write is an error", true, err != nil)
+	test("nothing written", 0, stream.Len())
+
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], MaxFrameSize+1)
+	stream.Write(header[:])
+	_, err = ReadFrame(&stream)
+	test("oversized read is an error", true, err != nil)
+}
+
+func test(summary string, expect, actual interface{}) {
+	if !reflect.DeepEqual(expect, actual) {
+		_, _, line, _ := runtime.Caller(1)
+		t.Errorf("Line %d:: %s: Expected %v, Actual %v", line, summary, expect, actual)
+	}
+}
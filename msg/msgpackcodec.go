@@ -0,0 +1,379 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// MsgpackCodec encodes messages in the MessagePack format. Structs are maps
+// from field name to value, so unlike BinaryCodec both sides can add or drop
+// fields, at the cost of sending the field names with every message. Only
+// the kinds of values that messages are made of are supported: booleans,
+// integers, floats, strings, slices, maps and structs.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) Encode(v interface{}) (data []byte, err error) {
+	var w msgpackWriter
+	err = w.value(reflect.ValueOf(v))
+	return w.buf, err
+}
+
+func (MsgpackCodec) Decode(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: cannot decode into %T", v)
+	}
+	r := msgpackReader{data: data}
+	return r.value(rv.Elem())
+}
+
+var errMsgpackShort = errors.New("msgpack: message ends early")
+
+// ===========================================================================
+
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) header(fix byte, fixMax int, codes [3]byte, n int) {
+	switch {
+	case n <= fixMax:
+		w.buf = append(w.buf, fix|byte(n))
+	case n <= math.MaxUint8 && codes[0] != 0:
+		w.buf = append(w.buf, codes[0], byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, codes[1], byte(n>>8), byte(n))
+	default:
+		w.buf = append(w.buf, codes[2], byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func (w *msgpackWriter) int(i int64) {
+	if i >= 0 && i <= 127 {
+		w.buf = append(w.buf, byte(i))
+	} else if i < 0 && i >= -32 {
+		w.buf = append(w.buf, byte(i))
+	} else {
+		w.buf = append(w.buf, 0xd3)
+		w.buf = appendUint64(w.buf, uint64(i))
+	}
+}
+
+func (w *msgpackWriter) string(s string) {
+	w.header(0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}, len(s))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		w.buf = append(w.buf, 0xc0)
+	case reflect.Bool:
+		if v.Bool() {
+			w.buf = append(w.buf, 0xc3)
+		} else {
+			w.buf = append(w.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.buf = append(w.buf, 0xcf)
+		w.buf = appendUint64(w.buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.buf = append(w.buf, 0xcb)
+		w.buf = appendUint64(w.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		w.string(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			w.buf = append(w.buf, 0xc0)
+			return nil
+		}
+		return w.value(v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.buf = append(w.buf, 0xc0)
+			return nil
+		}
+		w.header(0x90, 15, [3]byte{0, 0xdc, 0xdd}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := w.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.buf = append(w.buf, 0xc0)
+			return nil
+		}
+		w.header(0x80, 15, [3]byte{0, 0xde, 0xdf}, v.Len())
+		for _, key := range v.MapKeys() {
+			if err := w.value(key); err != nil {
+				return err
+			}
+			if err := w.value(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		var fields []int
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" { // exported
+				fields = append(fields, i)
+			}
+		}
+		w.header(0x80, 15, [3]byte{0, 0xde, 0xdf}, len(fields))
+		for _, i := range fields {
+			w.string(t.Field(i).Name)
+			if err := w.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode a %v", v.Type())
+	}
+	return nil
+}
+
+func appendUint64(buf []byte, u uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], u)
+	return append(buf, tmp[:]...)
+}
+
+// ===========================================================================
+
+type msgpackReader struct {
+	data []byte
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data) < n {
+		return nil, errMsgpackShort
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// Reads the next value into v, which must be settable. A nil leaves v at its
+// zero value.
+func (r *msgpackReader) value(v reflect.Value) error {
+	b, err := r.next(1)
+	if err != nil {
+		return err
+	}
+	code := b[0]
+
+	switch {
+	case code == 0xc0:
+		if v.IsValid() {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	case code == 0xc2 || code == 0xc3:
+		return r.set(v, code == 0xc3)
+	case code <= 0x7f:
+		return r.set(v, int64(code))
+	case code >= 0xe0:
+		return r.set(v, int64(int8(code)))
+	case code == 0xd3:
+		u, err := r.uint(8)
+		if err != nil {
+			return err
+		}
+		return r.set(v, int64(u))
+	case code == 0xcf:
+		u, err := r.uint(8)
+		if err != nil {
+			return err
+		}
+		return r.set(v, u)
+	case code == 0xcb:
+		u, err := r.uint(8)
+		if err != nil {
+			return err
+		}
+		return r.set(v, math.Float64frombits(u))
+	}
+
+	if n, ok, err := r.length(code, 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}); ok {
+		if err != nil {
+			return err
+		}
+		s, err := r.next(n)
+		if err != nil {
+			return err
+		}
+		return r.set(v, string(s))
+	}
+	if n, ok, err := r.length(code, 0x90, 15, [3]byte{0, 0xdc, 0xdd}); ok {
+		if err != nil {
+			return err
+		}
+		return r.array(v, n)
+	}
+	if n, ok, err := r.length(code, 0x80, 15, [3]byte{0, 0xde, 0xdf}); ok {
+		if err != nil {
+			return err
+		}
+		return r.mapOrStruct(v, n)
+	}
+	return fmt.Errorf("msgpack: unsupported type code 0x%x", code)
+}
+
+// If code is the header of the kind with the given codes, returns its length.
+func (r *msgpackReader) length(code byte, fix byte, fixMax int, codes [3]byte) (int, bool, error) {
+	if code >= fix && code <= fix+byte(fixMax) {
+		return int(code - fix), true, nil
+	}
+	sizes := [3]int{1, 2, 4}
+	for i, c := range codes {
+		if c != 0 && code == c {
+			n, err := r.uint(sizes[i])
+			if n > uint64(len(r.data)) {
+				err = errMsgpackShort
+			}
+			return int(n), true, err
+		}
+	}
+	return 0, false, nil
+}
+
+// Sets v to x, converting between the numeric kinds. Nothing is set when v
+// is the invalid Value, which is how unknown fields are skipped.
+func (r *msgpackReader) set(v reflect.Value, x interface{}) error {
+	if !v.IsValid() {
+		return nil
+	}
+	xv := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := x.(type) {
+		case int64:
+			v.SetInt(n)
+		case uint64:
+			v.SetInt(int64(n))
+		default:
+			return fmt.Errorf("msgpack: cannot decode %T into %v", x, v.Type())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch n := x.(type) {
+		case int64:
+			v.SetUint(uint64(n))
+		case uint64:
+			v.SetUint(n)
+		default:
+			return fmt.Errorf("msgpack: cannot decode %T into %v", x, v.Type())
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := x.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		default:
+			return fmt.Errorf("msgpack: cannot decode %T into %v", x, v.Type())
+		}
+	case reflect.Interface:
+		v.Set(xv)
+	default:
+		if !xv.Type().ConvertibleTo(v.Type()) || xv.Kind() != v.Kind() {
+			return fmt.Errorf("msgpack: cannot decode %T into %v", x, v.Type())
+		}
+		v.Set(xv.Convert(v.Type()))
+	}
+	return nil
+}
+
+func (r *msgpackReader) array(v reflect.Value, n int) error {
+	if !v.IsValid() {
+		for i := 0; i < n; i++ {
+			if err := r.value(reflect.Value{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	case reflect.Array:
+		if v.Len() != n {
+			return fmt.Errorf("msgpack: cannot decode %v items into %v", n, v.Type())
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode an array into %v", v.Type())
+	}
+	for i := 0; i < n; i++ {
+		if err := r.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *msgpackReader) mapOrStruct(v reflect.Value, n int) error {
+	if !v.IsValid() {
+		for i := 0; i < 2*n; i++ {
+			if err := r.value(reflect.Value{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := r.value(key); err != nil {
+				return err
+			}
+			if err := r.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		v.Set(reflect.Zero(v.Type()))
+		for i := 0; i < n; i++ {
+			var name string
+			if err := r.value(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			// Fields this side doesn't know about are skipped
+			field := v.FieldByName(name)
+			if field.IsValid() && !field.CanSet() {
+				field = reflect.Value{}
+			}
+			if err := r.value(field); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode a map into %v", v.Type())
+	}
+	return nil
+}
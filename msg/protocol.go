@@ -0,0 +1,72 @@
+package msg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The version of the protocol between the server and workers. It goes up
+// whenever a change means that the two sides could no longer understand each
+// other, such as a change to the meaning of a message type or to how the
+// messages are encoded. Workers that sent no version at all predate it.
+//
+//	1: the first versioned protocol
+//	2: the Credit message, only used with workers that have CapCredit
+//	3: the Disconnect message
+const ProtocolVersion = 3
+
+// The oldest worker protocol version the server still works with.
+const MinProtocolVersion = 1
+
+// The oldest protocol version that knows the Credit message.
+const CreditVersion = 2
+
+// The oldest worker protocol version that knows the Disconnect message.
+// Older workers just lose their connection when the server shuts down.
+const DisconnectVersion = 3
+
+// Capabilities are the features a worker may or may not have. Workers list
+// the ones they have when they connect, so that the server can work around
+// the optional ones that a worker is missing.
+const (
+	CapBatch   = "batch"   // Sends and receives V2VBatch messages
+	CapPeers   = "peers"   // Sends vertex messages straight to other workers
+	CapRecover = "recover" // Can take over the partitions of a dead worker
+	CapCredit  = "credit"  // Takes part in flow control, with Window and Credit messages
+)
+
+// The capabilities of workers built from this version
+var Capabilities = []string{CapBatch, CapPeers, CapRecover, CapCredit}
+
+// The capabilities the server can't do without. A worker that is only
+// missing others is accepted, and the server does without them.
+var RequiredCapabilities = []string{CapBatch, CapPeers}
+
+// CheckWorkerProtocol returns why the server can't work with a worker that
+// connected with wcm, or nil if it can.
+func CheckWorkerProtocol(wcm WorkerConnectionMsg) error {
+	if wcm.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("worker speaks protocol version %v, the server needs at least %v",
+			wcm.ProtocolVersion, MinProtocolVersion)
+	}
+	var missing []string
+	for _, capability := range RequiredCapabilities {
+		if !HasCapability(wcm.Capabilities, capability) {
+			missing = append(missing, capability)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("worker is missing required capabilities: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// HasCapability returns whether capability is in capabilities.
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
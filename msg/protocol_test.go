@@ -0,0 +1,56 @@
+package msg
+
+import (
+	"testing"
+)
+
+// The message types are numbered on the wire, so they must never change.
+func TestTypeValues(tee *testing.T) {
+	t = tee
+
+	values := map[Type]int{
+		NilType: 0, Assign: 1, Superstep: 2, SaveCheckpoint: 3, LoadCheckpoint: 4,
+		PartitionAck: 5, Done: 6, Inactive: 7, SaveCheckpointAck: 8, LoadCheckpointAck: 9,
+		V2V: 10, Heartbeat: 11, Recover: 12, Replay: 13, RecoverAck: 14, ReplayDone: 15,
+		V2VBatch: 16, Credit: 17, Disconnect: 18,
+	}
+	test("number of types", 19, len(values))
+	for typ, value := range values {
+		test(TypeStr(typ), value, int(typ))
+		test(TypeStr(typ)+" is sent", false, IsInternal(typ))
+	}
+}
+
+// The internal types can change, but must stay out of the wire types' way.
+func TestInternalTypes(tee *testing.T) {
+	t = tee
+
+	seen := make(map[Type]bool)
+	for _, typ := range []Type{Rejoined, WorkerDied, Drain, Stop, Release} {
+		test(TypeStr(typ)+" is internal", true, IsInternal(typ))
+		test(TypeStr(typ)+" is unique", false, seen[typ])
+		seen[typ] = true
+	}
+}
+
+func TestCheckWorkerProtocol(tee *testing.T) {
+	t = tee
+
+	current := WorkerConnectionMsg{WorkerId: "w1", ProtocolVersion: ProtocolVersion, Capabilities: Capabilities}
+	test("current worker", nil, CheckWorkerProtocol(current))
+
+	old := WorkerConnectionMsg{WorkerId: "w1"}
+	test("worker without a version refused", true, CheckWorkerProtocol(old) != nil)
+
+	first := WorkerConnectionMsg{WorkerId: "w1", ProtocolVersion: 1, Capabilities: []string{CapBatch, CapPeers}}
+	test("first versioned worker accepted", nil, CheckWorkerProtocol(first))
+
+	noPeers := current
+	noPeers.Capabilities = []string{CapBatch, CapRecover}
+	test("worker without a required capability refused", true, CheckWorkerProtocol(noPeers) != nil)
+
+	noRecover := current
+	noRecover.Capabilities = []string{CapPeers, CapBatch}
+	test("worker without an optional capability accepted", nil, CheckWorkerProtocol(noRecover))
+	test("missing capability", false, HasCapability(noRecover.Capabilities, CapRecover))
+}
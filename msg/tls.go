@@ -0,0 +1,128 @@
+package msg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TLS holds what a server, worker or client needs to talk over mutually
+// authenticated TLS: its own certificate, and the CA that signed everyone's
+// certificates. A nil *TLS means plaintext, so callers don't need to check.
+//
+// The identity of a worker or client is the common name of its certificate,
+// see WorkerCertName and ClientCertName. Workers also accept connections from
+// each other, so their certificates must be valid for both client and server
+// authentication, and carry their common name as a DNS name too.
+type TLS struct {
+	Cert tls.Certificate
+	CAs  *x509.CertPool
+}
+
+// LoadTLS reads a PEM certificate and key, and the PEM certificate of the CA.
+// Returns nil, and no error, if no certificate is given.
+func LoadTLS(certFile, keyFile, caFile string) (*TLS, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("TLS needs a certificate, a key and a CA certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %v", caFile)
+	}
+	return &TLS{Cert: cert, CAs: cas}, nil
+}
+
+// The common name of the certificate of the worker with the given id
+func WorkerCertName(id WorkerId) string {
+	return "worker-" + string(id)
+}
+
+// The common name of the certificate of the client with the given id
+func ClientCertName(id int) string {
+	return fmt.Sprintf("client-%v", id)
+}
+
+// The common name of the certificate for administering the server, such as
+// draining workers
+const AdminCertName = "admin"
+
+// ServerConfig is the configuration for accepting connections, which must
+// present a certificate signed by the CA.
+func (t *TLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.Cert},
+		ClientCAs:    t.CAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientConfig is the configuration for connecting to serverName, which must
+// present a certificate for that name signed by the CA.
+func (t *TLS) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.Cert},
+		RootCAs:      t.CAs,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// Listen listens at addr, over TLS unless t is nil.
+func (t *TLS) Listen(addr string) (net.Listener, error) {
+	if t == nil {
+		return net.Listen("tcp", addr)
+	}
+	return tls.Listen("tcp", addr, t.ServerConfig())
+}
+
+// Dial connects to addr, over TLS unless t is nil. The other side's
+// certificate must be for serverName, or for the host in addr if serverName
+// is empty.
+func (t *TLS) Dial(addr string, serverName string, timeout time.Duration) (net.Conn, error) {
+	if t == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, t.ClientConfig(serverName))
+}
+
+// CertName completes the TLS handshake on conn and returns the common name of
+// the certificate the other side presented. For a plaintext connection it
+// returns "" and no error.
+func CertName(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no certificate")
+	}
+	return certs[0].Subject.CommonName, nil
+}
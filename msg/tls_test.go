@@ -0,0 +1,216 @@
+package msg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A CA and the certificates it signs, generated for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var serialNumber int64
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkTestErr(err)
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serialNumber),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	checkTestErr(err)
+	cert, err := x509.ParseCertificate(der)
+	checkTestErr(err)
+	return &testCA{cert, key, der}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issues a certificate for name, good for both ends of a connection, the way
+// worker certificates must be.
+func (ca *testCA) issue(name string) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkTestErr(err)
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	checkTestErr(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	checkTestErr(err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	checkTestErr(err)
+	return cert, certPEM, keyPEM
+}
+
+func (ca *testCA) tls(name string) *TLS {
+	cert, _, _ := ca.issue(name)
+	return &TLS{Cert: cert, CAs: ca.pool()}
+}
+
+func checkTestErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Accepts one connection on a listener for server, and returns the name on
+// the certificate of the other side, and the frame it sent.
+func acceptOne(server *TLS) (string, chan string, chan error) {
+	listener, err := server.Listen("127.0.0.1:0")
+	checkTestErr(err)
+	names := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		name, err := CertName(conn)
+		if err == nil {
+			_, err = ReadFrame(conn)
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+		names <- name
+	}()
+	return listener.Addr().String(), names, errs
+}
+
+func TestMutualTLS(tee *testing.T) {
+	t = tee
+	ca := newTestCA()
+
+	addr, names, errs := acceptOne(ca.tls("server"))
+	conn, err := ca.tls(WorkerCertName("w1")).Dial(addr, "", time.Second)
+	test("dial error", nil, err)
+	test("write error", nil, WriteFrame(conn, []byte("hello")))
+	select {
+	case name := <-names:
+		test("identity", "worker-w1", name)
+	case err := <-errs:
+		t.Errorf("Server side failed: %v", err)
+	}
+	conn.Close()
+
+	// A worker can check that a peer is the worker it meant to reach
+	addr, names, errs = acceptOne(ca.tls(WorkerCertName("w2")))
+	conn, err = ca.tls(WorkerCertName("w1")).Dial(addr, WorkerCertName("w2"), time.Second)
+	test("peer dial error", nil, err)
+	WriteFrame(conn, []byte("hello"))
+	test("peer identity", "worker-w1", <-names)
+	conn.Close()
+
+	addr, names, errs = acceptOne(ca.tls(WorkerCertName("w2")))
+	_, err = ca.tls(WorkerCertName("w1")).Dial(addr, WorkerCertName("w3"), time.Second)
+	test("dial to the wrong peer fails", true, err != nil)
+	<-errs
+}
+
+func TestTLSRefusesStrangers(tee *testing.T) {
+	t = tee
+	ca := newTestCA()
+	otherCA := newTestCA()
+
+	// A certificate from another CA
+	addr, _, errs := acceptOne(ca.tls("server"))
+	conn, err := otherCA.tls(WorkerCertName("w1")).Dial(addr, "", time.Second)
+	if err == nil {
+		// The server's verdict only arrives once the client reads
+		_, err = ReadFrame(conn)
+		conn.Close()
+	}
+	test("stranger refused", true, err != nil)
+	test("stranger refused by server", true, <-errs != nil)
+
+	// No certificate at all
+	addr, _, errs = acceptOne(ca.tls("server"))
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: "127.0.0.1"})
+	if err == nil {
+		_, err = ReadFrame(conn)
+		conn.Close()
+	}
+	test("missing certificate refused", true, err != nil)
+	test("missing certificate refused by server", true, <-errs != nil)
+
+	// A plaintext connection
+	addr, _, errs = acceptOne(ca.tls("server"))
+	var plain *TLS
+	conn, err = plain.Dial(addr, "", time.Second)
+	test("plaintext dial error", nil, err)
+	WriteFrame(conn, []byte("hello"))
+	conn.Close()
+	test("plaintext refused by server", true, <-errs != nil)
+}
+
+func TestLoadTLS(tee *testing.T) {
+	t = tee
+	ca := newTestCA()
+
+	dir, err := ioutil.TempDir("", "tls")
+	checkTestErr(err)
+	defer os.RemoveAll(dir)
+	_, certPEM, keyPEM := ca.issue(ClientCertName(7))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der})
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	checkTestErr(ioutil.WriteFile(certFile, certPEM, 0600))
+	checkTestErr(ioutil.WriteFile(keyFile, keyPEM, 0600))
+	checkTestErr(ioutil.WriteFile(caFile, caPEM, 0600))
+
+	loaded, err := LoadTLS(certFile, keyFile, caFile)
+	test("load error", nil, err)
+	addr, names, _ := acceptOne(ca.tls("server"))
+	conn, err := loaded.Dial(addr, "", time.Second)
+	test("dial error", nil, err)
+	WriteFrame(conn, []byte("hello"))
+	test("identity", "client-7", <-names)
+	conn.Close()
+
+	none, err := LoadTLS("", "", "")
+	test("no TLS", true, none == nil && err == nil)
+	_, err = LoadTLS(certFile, "", caFile)
+	test("missing key", true, err != nil)
+}
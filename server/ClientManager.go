@@ -1,82 +1,292 @@
 package main
 
 import (
-	"container/list"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
-	"project_c9f7_i5l8_o0p4_p0j8/db"
 	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sync"
 	// "github.com/arcaneiceman/GoVector/govec"
 )
 
 //====================================================================
-// Data Structures
+// Keeps track of the clients' requests, from when they are submitted until
+// they complete. It is used by the RPC goroutines and by every running job at
+// once, so all of its state is behind lock.
+type ClientManager struct {
+	lock sync.Mutex
 
-// All the Client Requests that are not yet completed. Used as a FIFO queue.
-// TODO: this could probably be changed to a channel.
-var PendingRequests list.List
+	// All the Client Requests that are waiting to be scheduled, ordered by
+	// priority and fair share between clients.
+	pending RequestQueue
 
-// TODO: add constraints on the RequestId to be non-negative.
-// The Requests that have been accepted for each client. Indexed by ClientId. If the entry exists and is a positive integer, there is an accepted request.
-var ClientRequests map[int]int
+	// TODO: add constraints on the RequestId to be non-negative.
+	// The Requests that have been accepted for each client. Indexed by ClientId. If the entry exists and is a positive integer, there is an accepted request.
+	requests map[int]int
 
-// Stores the last completed request for a ClientId.
-// TODO: make this the appropriate data type for the result. Maybe we can cache the result on a temp file.
-var CompletedRequests map[int]msg.Result
+	// Stores the last completed request for a ClientId.
+	// TODO: make this the appropriate data type for the result. Maybe we can cache the result on a temp file.
+	completed map[int]msg.Result
 
-//====================================================================
-//====================================================================
-type ClientManager int
+	// The requests currently being run, as of their last checkpoint. Indexed by ClientId.
+	running map[int]msg.Request
+
+	// The RPC calls waiting for their client's request to complete. Indexed by ClientId.
+	// A request recovered after a restart has no waiter until its client asks again.
+	waiters map[int]chan msg.Result
+
+	// Where the job table is persisted after every change.
+	store *JobStore
+
+	// The workers the admin manages
+	workers *WorkerManager
+
+	listener net.Listener
+	stopping bool // Shutting down; no new requests are accepted
+}
 
-func (cm *ClientManager) Initialize(serviceAddr string) {
-	// Initialize the data structures.
-	ClientRequests = make(map[int]int)
-	CompletedRequests = make(map[int]msg.Result)
+// Why a request is refused while the server shuts down. The client retries
+// on whichever server leads next.
+var errShuttingDown = errors.New("server is shutting down")
 
+// Creates a ClientManager, recovering the jobs from before a restart from the
+// job table at statePath. An empty statePath disables persistence.
+func NewClientManager(statePath string) *ClientManager {
+	cm := &ClientManager{
+		requests:  make(map[int]int),
+		completed: make(map[int]msg.Result),
+		running:   make(map[int]msg.Request),
+		waiters:   make(map[int]chan msg.Result),
+		store:     NewJobStore(statePath),
+	}
+	cm.recoverJobs()
+	return cm
+}
+
+// Serves clients, and the admin, at serviceAddr. If tlsConfig is not nil,
+// clients must connect over TLS, and can only act as the client their
+// certificate is for; only msg.AdminCertName can administer the workers.
+func (cm *ClientManager) Initialize(serviceAddr string, tlsConfig *msg.TLS, workerManager *WorkerManager) {
 	// Initialize the RPC Service.
-	clientRPCService := new(ClientService)
-	rpc.Register(clientRPCService)
-	clientListener, err := net.Listen("tcp", serviceAddr)
+	clientListener, err := tlsConfig.Listen(serviceAddr)
 	checkErr(err)
 	log.Println("ClientService: listening for clients at %v", serviceAddr)
-	go handleRPC(clientListener.(*net.TCPListener))
+	cm.lock.Lock()
+	cm.workers = workerManager
+	cm.listener = clientListener
+	cm.lock.Unlock()
+	go cm.handleRPC(clientListener)
+}
+
+// Stops accepting requests and clients. The requests already accepted are
+// kept, to be run by whichever server leads next.
+func (cm *ClientManager) StopAccepting() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.stopping = true
+	if cm.listener != nil {
+		cm.listener.Close()
+	}
+}
+
+func (cm *ClientManager) isStopping() bool {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.stopping
+}
+
+// Persists the job table one last time, and returns how many requests are
+// left for the next server.
+func (cm *ClientManager) Persist() int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.saveJobs()
+	return cm.pending.Len() + len(cm.running)
+}
+
+// Loads the persisted job table. Jobs that were running are requeued from
+// their last checkpoint, and will start once workers are available.
+func (cm *ClientManager) recoverJobs() {
+	table, err := cm.store.Load()
+	checkErr(err)
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.pending = RequestQueue{nextSeq: table.NextSeq, usage: table.Usage}
+	for _, request := range table.Pending {
+		cm.pending.Push(request)
+		cm.requests[request.ClientId] = request.RequestId
+	}
+	for _, request := range table.Running {
+		request.Superstep = request.CheckpointStep
+		cm.pending.Push(request)
+		cm.requests[request.ClientId] = request.RequestId
+	}
+	if table.Completed != nil {
+		cm.completed = table.Completed
+	}
+
+	if cm.pending.Len() > 0 {
+		log.Printf("Recovered %v pending and %v running requests.\n", len(table.Pending), len(table.Running))
+	}
+	cm.saveJobs()
+}
+
+// Persists the job table. Must be called with lock held.
+func (cm *ClientManager) saveJobs() {
+	table := jobTable{
+		Pending:   cm.pending.Requests(),
+		Completed: cm.completed,
+		Usage:     cm.pending.usage,
+		NextSeq:   cm.pending.nextSeq,
+	}
+	for _, request := range cm.running {
+		table.Running = append(table.Running, request)
+	}
+	cm.store.Save(table)
+}
+
+// The number of requests waiting to be scheduled.
+func (cm *ClientManager) NumPending() int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.pending.Len()
 }
 
 func (cm *ClientManager) GetRequest() (msg.Request, bool) {
-	if PendingRequests.Len() == 0 {
-		defer captureDroppedClient()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 
-		c := make(chan msg.Result)
-		var d db.Access
-		return msg.Request{0, 0, d, 0, c, 0}, false
+	if cm.pending.Len() == 0 {
+		return msg.Request{}, false
 	} else {
-		// TODO: update ClientRequests?
-		front := PendingRequests.Front()
-		request := front.Value.(msg.Request)
-		PendingRequests.Remove(front)
-		return request, true
+		request, ok := cm.pending.Pop()
+		cm.running[request.ClientId] = request
+		cm.saveJobs()
+		return request, ok
 	}
 }
 
+// Records the progress of a running request, so it can be resumed from its
+// latest checkpoint if the server restarts.
+func (cm *ClientManager) UpdateRunning(request msg.Request) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.running[request.ClientId] = request
+	cm.saveJobs()
+}
+
 func (cm *ClientManager) CompletedRequest(request msg.Request, result msg.Result) {
 	defer captureDroppedClient()
 
 	log.Printf("Completed Request %v, result: %v\n", request, result)
 
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	delete(cm.running, request.ClientId)
 	if result.Val == msg.Incomplete {
-		PendingRequests.PushBack(result.Request)
+		// The request keeps its place in the queue.
+		cm.pending.Push(result.Request)
 	} else {
+		cm.pending.AddUsage(request.ClientId)
+
 		// Store the request result
-		CompletedRequests[request.ClientId] = result
+		cm.completed[request.ClientId] = result
 
 		// Indicate that we are done processing the request for this client
-		ClientRequests[request.ClientId] = 0
+		cm.requests[request.ClientId] = 0
+
+		// Continue the RPC call, if the client is still waiting on one.
+		c, ok := cm.waiters[request.ClientId]
+		if ok {
+			c <- msg.Result{}
+			delete(cm.waiters, request.ClientId)
+		}
+	}
+	cm.saveJobs()
+}
+
+// The request the client has been accepted for, or 0 if none.
+func (cm *ClientManager) currentRequest(clientId int) int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.requests[clientId]
+}
+
+// The request the client has been accepted for, whether it is running or
+// still queued. Must be called with lock held.
+func (cm *ClientManager) acceptedRequest(clientId int) (msg.Request, bool) {
+	if request, ok := cm.running[clientId]; ok {
+		return request, true
+	}
+	for _, request := range cm.pending.Requests() {
+		if request.ClientId == clientId {
+			return request, true
+		}
+	}
+	return msg.Request{}, false
+}
 
-		// Continue the RPC call.
-		request.OutChannel <- msg.Result{}
+// Queues the client's request, unless the client already has a different
+// one, or is already waiting on this one. A request is only the same one if
+// it has the same id and is for the same graph. Returns a channel on which
+// the caller can wait for the request to complete, or nil if it was refused.
+// While the server shuts down, requests are refused with errShuttingDown.
+func (cm *ClientManager) submit(request msg.Request) (chan msg.Result, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.stopping {
+		return nil, errShuttingDown
 	}
+	currentlyHandling, ok := cm.requests[request.ClientId]
+	_, waiting := cm.waiters[request.ClientId]
+	accepted, found := cm.acceptedRequest(request.ClientId)
+	sameRequest := currentlyHandling == request.RequestId && found &&
+		accepted.DBAccess.PrimaryKey() == request.DBAccess.PrimaryKey()
+	if ok && currentlyHandling > 0 && (!sameRequest || waiting) {
+		log.Println("Client requested a new job while we are processing one already.")
+		return nil, nil
+	}
+	if ok && currentlyHandling > 0 {
+		// The request was recovered after a restart, and the client is
+		// asking for it again. Wait on it rather than starting over.
+		log.Printf("Client %v reattached to request %v.\n", request.ClientId, request.RequestId)
+	} else {
+		cm.pending.Push(request)
+		cm.requests[request.ClientId] = request.RequestId
+		cm.saveJobs()
+	}
+	c := make(chan msg.Result, 1)
+	cm.waiters[request.ClientId] = c
+	return c, nil
+}
+
+// The result of the client's last completed request.
+func (cm *ClientManager) lastResult(clientId int) msg.Result {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.completed[clientId]
+}
+
+// Where the client's request is in the queue, or whether it is running.
+func (cm *ClientManager) status(clientId int) msg.ServerStatusResp {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	var reply msg.ServerStatusResp
+	reply.RequestId = cm.requests[clientId]
+	reply.QueueLength = cm.pending.Len()
+	reply.QueuePosition = cm.pending.Position(clientId)
+	reply.Running = reply.RequestId > 0 && reply.QueuePosition == 0
+	return reply
 }
 
 func captureDroppedClient() {
@@ -87,11 +297,27 @@ func captureDroppedClient() {
 
 //====================================================================
 //====================================================================
-type ClientService int
+// Each client connection gets its own ClientService.
+type ClientService struct {
+	cm       *ClientManager
+	certName string // The common name of the client's certificate; "" without TLS
+}
+
+// Over TLS, a client can only make calls as the client its certificate is for.
+func (cs *ClientService) checkClient(clientId int) error {
+	if cs.certName != "" && cs.certName != msg.ClientCertName(clientId) {
+		return fmt.Errorf("certificate is for %v, not %v", cs.certName, msg.ClientCertName(clientId))
+	}
+	return nil
+}
 
 // TODO: check valid args
 func (cs *ClientService) Connect(args *msg.ClientConnectionMsg, reply *msg.ServerConnectionResp) error {
-	validArgs := true
+	err := cs.checkClient(args.ClientId)
+	if err != nil {
+		log.Printf("ClientService refusing connection from %v: %v\n", args.ClientId, err)
+	}
+	validArgs := err == nil
 	if validArgs {
 		Logger.LogLocalEvent(fmt.Sprintf("Client-%v-Connecting", args.ClientId))
 		log.Printf("ClientService accepting connection from: %v\n", args.ClientId)
@@ -100,6 +326,9 @@ func (cs *ClientService) Connect(args *msg.ClientConnectionMsg, reply *msg.Serve
 		// if (ok) {
 		// } else {
 		// }
+		if requestId := cs.cm.currentRequest(args.ClientId); requestId > 0 {
+			reply.PendingJobs = []int{requestId}
+		}
 		reply.IsAccepted = true
 	} else {
 		reply.IsAccepted = false
@@ -109,6 +338,9 @@ func (cs *ClientService) Connect(args *msg.ClientConnectionMsg, reply *msg.Serve
 }
 
 func (cs *ClientService) Request(args *msg.ClientRequestMsg, reply *msg.ServerRequestResp) error {
+	if err := cs.checkClient(args.ClientId); err != nil {
+		return err
+	}
 	Logger.LogLocalEvent(fmt.Sprintf("ClientRequest-%v-Start", args.RequestId))
 	// Check args.
 	if args.RequestId <= 0 {
@@ -117,26 +349,34 @@ func (cs *ClientService) Request(args *msg.ClientRequestMsg, reply *msg.ServerRe
 		return nil
 	}
 
-	// Check whether we are currently handling a request.
-	currentlyHandling, ok := ClientRequests[args.ClientId]
-	if ok && currentlyHandling > 0 {
-		log.Println("Client requested a new job while we are processing one already.")
+	if args.NumWorkers < 0 {
+		log.Println("Client requested a negative number of workers.")
 		reply.Success = false
-	} else {
-		// Create and store the request.
-		c := make(chan msg.Result)
-		request := msg.Request{args.ClientId, args.RequestId, args.DBAccess, 0, c, 0}
-		PendingRequests.PushBack(request)
-		ClientRequests[args.ClientId] = args.RequestId
+		return nil
+	}
 
+	// Create and store the request, unless we are currently handling one.
+	c, err := cs.cm.submit(msg.Request{
+		ClientId:   args.ClientId,
+		RequestId:  args.RequestId,
+		DBAccess:   args.DBAccess,
+		NumWorkers: args.NumWorkers,
+		Priority:   args.Priority,
+	})
+	if err != nil {
+		return err
+	} else if c == nil {
+		reply.Success = false
+	} else {
 		// Wait for the request to be completed.
 		<-c
 
-		result := CompletedRequests[args.ClientId]
+		result := cs.cm.lastResult(args.ClientId)
 		log.Printf("Request completed with result: %v\n", result)
 
-		// TODO: add result as a field of reply
-		reply.Success = true
+		reply.RequestId = args.RequestId
+		reply.Success = result.Val == msg.Success
+		reply.ReplyVal = msg.ResultStr(result)
 	}
 
 	Logger.LogLocalEvent(fmt.Sprintf("ClientRequest-%v-Done", args.RequestId))
@@ -144,10 +384,72 @@ func (cs *ClientService) Request(args *msg.ClientRequestMsg, reply *msg.ServerRe
 	return nil
 }
 
-func handleRPC(l *net.TCPListener) {
+// Reports where the client's request is in the queue, or whether it is running.
+func (cs *ClientService) Status(args *msg.ClientStatusMsg, reply *msg.ServerStatusResp) error {
+	if err := cs.checkClient(args.ClientId); err != nil {
+		return err
+	}
+	*reply = cs.cm.status(args.ClientId)
+	return nil
+}
+
+func (cm *ClientManager) handleRPC(l net.Listener) {
 	for {
 		conn, err := l.Accept()
+		if err != nil && cm.isStopping() {
+			return
+		}
 		checkErr(err)
-		go rpc.ServeConn(conn)
+		go cm.serveClient(conn)
+	}
+}
+
+// Serves the RPCs of one client connection.
+func (cm *ClientManager) serveClient(conn net.Conn) {
+	certName, err := msg.CertName(conn)
+	if err != nil {
+		log.Printf("ClientService: TLS handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	server := rpc.NewServer()
+	server.Register(&ClientService{cm: cm, certName: certName})
+	server.Register(&AdminService{wm: cm.workers, certName: certName})
+	server.ServeConn(conn)
+}
+
+//====================================================================
+//====================================================================
+// Each connection also gets an AdminService, for operators.
+type AdminService struct {
+	wm       *WorkerManager
+	certName string // The common name of the certificate; "" without TLS
+}
+
+// Over TLS, only the admin certificate can administer the server.
+func (as *AdminService) checkAdmin() error {
+	if as.certName != "" && as.certName != msg.AdminCertName {
+		return fmt.Errorf("certificate is for %v, not %v", as.certName, msg.AdminCertName)
+	}
+	return nil
+}
+
+// Takes a worker out of service, for maintenance of its host.
+func (as *AdminService) DrainWorker(args *msg.DrainWorkerMsg, reply *msg.DrainWorkerResp) error {
+	if err := as.checkAdmin(); err != nil {
+		return err
+	}
+	log.Printf("AdminService: draining worker %v\n", args.WorkerId)
+	inJob, err := as.wm.Drain(args.WorkerId)
+	reply.InJob = inJob
+	return err
+}
+
+// Lists the workers, and whether they are busy or draining.
+func (as *AdminService) Workers(args *msg.WorkersMsg, reply *msg.WorkersResp) error {
+	if err := as.checkAdmin(); err != nil {
+		return err
 	}
+	reply.Workers = as.wm.WorkerStatuses()
+	return nil
 }
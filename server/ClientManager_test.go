@@ -0,0 +1,102 @@
+package main
+
+import (
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sync"
+	"testing"
+)
+
+// Clients submit requests and ask about them while jobs run and complete.
+func TestConcurrentRequests(tee *testing.T) {
+	t = tee
+	cm := NewClientManager("")
+	const numClients = 20
+
+	// Runs every request as soon as it is queued
+	quit := make(chan bool)
+	scheduled := make(chan bool)
+	go func() {
+		defer close(scheduled)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			request, ok := cm.GetRequest()
+			if !ok {
+				continue
+			}
+			go func() {
+				request.CheckpointStep = 1
+				cm.UpdateRunning(request)
+				cm.CompletedRequest(request, msg.Result{Val: msg.Success, Request: request})
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	replies := make([]msg.ServerRequestResp, numClients)
+	for i := 0; i < numClients; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			cs := &ClientService{cm: cm}
+			args := msg.ClientRequestMsg{ClientId: i + 1, RequestId: 1}
+			test("request error", nil, cs.Request(&args, &replies[i]))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			cs := &ClientService{cm: cm}
+			var status msg.ServerStatusResp
+			cs.Status(&msg.ClientStatusMsg{ClientId: i + 1}, &status)
+			var conn msg.ServerConnectionResp
+			cs.Connect(&msg.ClientConnectionMsg{ClientId: i + 1}, &conn)
+			test("connected", true, conn.IsAccepted)
+		}(i)
+	}
+	wg.Wait()
+	close(quit)
+	<-scheduled
+
+	for i, reply := range replies {
+		test("request succeeded", true, reply.Success)
+		test("request done", 0, cm.currentRequest(i+1))
+		test("result", msg.Success, cm.lastResult(i+1).Val)
+	}
+	test("none pending", 0, cm.NumPending())
+}
+
+// A client can't start a second request while its first is queued.
+func TestOneRequestPerClient(tee *testing.T) {
+	t = tee
+	cm := NewClientManager("")
+	accepted := func(request msg.Request) bool {
+		c, _ := cm.submit(request)
+		return c != nil
+	}
+
+	first, err := cm.submit(msg.Request{ClientId: 1, RequestId: 1})
+	test("first accepted", true, first != nil && err == nil)
+	test("second refused", false, accepted(msg.Request{ClientId: 1, RequestId: 2}))
+	test("same one twice refused", false, accepted(msg.Request{ClientId: 1, RequestId: 1}))
+	test("other client accepted", true, accepted(msg.Request{ClientId: 2, RequestId: 1}))
+
+	status := cm.status(1)
+	test("queued", 1, status.QueuePosition)
+	test("queue length", 2, status.QueueLength)
+
+	request, _ := cm.GetRequest()
+	test("running", true, cm.status(request.ClientId).Running)
+	cm.CompletedRequest(request, msg.Result{Val: msg.Success, Request: request})
+	if request.ClientId == 1 {
+		<-first
+	}
+	test("new request accepted", true, accepted(msg.Request{ClientId: request.ClientId, RequestId: 2}))
+
+	// While shutting down, requests are refused, and the queue is kept
+	cm.StopAccepting()
+	_, err = cm.submit(msg.Request{ClientId: 3, RequestId: 1})
+	test("refused while stopping", errShuttingDown, err)
+	test("requests kept", 2, cm.Persist())
+}
@@ -0,0 +1,139 @@
+// Flow control and queue limits between the server and workers
+package main
+
+import (
+	"log"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//====================================================================
+// Each side of a worker connection may only send as many messages as the
+// other side has given it credits for. The receiver returns credits once it
+// has passed messages on, so a worker that sends faster than its job can keep
+// up with is held back, instead of the server's queues growing without bound.
+// Heartbeats and credits themselves don't need credits.
+
+// The sizes of the server's queues and flow control windows.
+type Limits struct {
+	WorkerWindow  int           // How many messages a worker may send before the server returns credits; 0 for no limit
+	WorkerQueue   int           // How many messages can be queued for each worker
+	JobQueue      int           // How many messages can be queued between a job and its workers, each way
+	StatsInterval time.Duration // How often to log the queue depths; 0 to never
+}
+
+// Set from the command line
+var limits = Limits{
+	WorkerWindow:  msg.DefaultWindow,
+	WorkerQueue:   1000,
+	JobQueue:      10000,
+	StatsInterval: 10 * time.Second,
+}
+
+// The flow control state of one connection to a worker.
+type connFlow struct {
+	sendWindow int      // How many messages the worker let us send it; 0 for no limit
+	recvWindow int      // How many messages we let the worker send us; 0 for no limit
+	returned   chan int // Credits the worker returned, for the Writer
+	grants     chan int // Credits to return to the worker, from the Reader
+	credits    int64    // How many more messages the Writer may send; accessed atomically
+}
+
+func newConnFlow(sendWindow int, recvWindow int) *connFlow {
+	return &connFlow{
+		sendWindow: sendWindow,
+		recvWindow: recvWindow,
+		returned:   make(chan int, 16),
+		grants:     make(chan int, 16),
+		credits:    int64(sendWindow),
+	}
+}
+
+// The flow control for a worker that connected with wcm. A worker without
+// msg.CapCredit is never sent a Credit, and is told its window is 0, so
+// neither side limits the other.
+func negotiateFlow(wcm msg.WorkerConnectionMsg) *connFlow {
+	if !msg.HasCapability(wcm.Capabilities, msg.CapCredit) {
+		return newConnFlow(0, 0)
+	}
+	return newConnFlow(wcm.Window, limits.WorkerWindow)
+}
+
+// Whether the Writer has to wait for credits before sending the next message.
+func (cf *connFlow) blocked() bool {
+	return cf.sendWindow > 0 && atomic.LoadInt64(&cf.credits) <= 0
+}
+
+func (cf *connFlow) add(credits int) {
+	atomic.AddInt64(&cf.credits, int64(credits))
+}
+
+//====================================================================
+// Queue depths, for spotting a worker or job that can't keep up.
+
+type QueueStat struct {
+	WorkerId    msg.WorkerId
+	Queued      int // Messages waiting to be sent to the worker
+	QueueCap    int
+	JobQueued   int // Messages from the workers waiting for the worker's job; shared by the job's workers
+	JobCap      int
+	Credits     int // How many more messages the server may send the worker, if it is limited
+	OutOfCredit bool
+}
+
+// The queue depths of all connected workers, ordered by WorkerId.
+func (wm *WorkerManager) QueueStats() []QueueStat {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	var stats []QueueStat
+	for _, data := range wm.workers {
+		if data.Conn == nil {
+			continue
+		}
+		stat := QueueStat{
+			WorkerId: data.WorkerId,
+			Queued:   len(data.cMsgOut),
+			QueueCap: cap(data.cMsgOut),
+		}
+		if data.job != nil {
+			stat.JobQueued = len(data.job.cIn)
+			stat.JobCap = cap(data.job.cIn)
+		}
+		if data.flow != nil {
+			stat.Credits = int(atomic.LoadInt64(&data.flow.credits))
+			stat.OutOfCredit = data.flow.blocked()
+		}
+		stats = append(stats, stat)
+	}
+	sort.Sort(byWorkerId(stats))
+	return stats
+}
+
+// Logs the queue depths of the busy workers every interval.
+func logQueueStats(wm *WorkerManager, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, stat := range wm.QueueStats() {
+			if stat.Queued == 0 && stat.JobQueued == 0 && !stat.OutOfCredit {
+				continue
+			}
+			log.Printf("Queues of worker %v: to worker %v/%v, to job %v/%v, credits %v\n",
+				stat.WorkerId, stat.Queued, stat.QueueCap, stat.JobQueued, stat.JobCap, stat.Credits)
+		}
+	}
+}
+
+// byWorkerId implements sort.Interface, ordering the stats by worker
+type byWorkerId []QueueStat
+
+func (bw byWorkerId) Len() int {
+	return len(bw)
+}
+func (bw byWorkerId) Swap(i, j int) {
+	bw[i], bw[j] = bw[j], bw[i]
+}
+func (bw byWorkerId) Less(i, j int) bool {
+	return bw[i].WorkerId < bw[j].WorkerId
+}
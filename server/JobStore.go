@@ -0,0 +1,87 @@
+// Durable storage for the server's job table, so that queued and running jobs
+// survive a server restart. The vertex checkpoints themselves are already
+// in the database; this only records which requests exist and which
+// checkpoint each running job can be resumed from.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+)
+
+// Everything needed to rebuild the ClientManager state after a restart.
+type jobTable struct {
+	Pending   []msg.Request      // Queued requests, in no particular order
+	Running   []msg.Request      // Running requests, as of their last checkpoint
+	Completed map[int]msg.Result // Last completed request per ClientId
+	Usage     map[int]int        // Completed jobs per ClientId, for fair share
+	NextSeq   int                // Next queue sequence number to hand out
+}
+
+// Writes the job table to a file. An empty path disables persistence.
+type JobStore struct {
+	path string
+}
+
+func NewJobStore(path string) *JobStore {
+	return &JobStore{path}
+}
+
+// Loads the job table. A missing file is an empty table.
+func (js *JobStore) Load() (jobTable, error) {
+	var table jobTable
+	if js.path == "" {
+		return table, nil
+	}
+
+	data, err := ioutil.ReadFile(js.path)
+	if os.IsNotExist(err) {
+		return table, nil
+	} else if err != nil {
+		return table, err
+	}
+	err = json.Unmarshal(data, &table)
+	return table, err
+}
+
+// Saves the job table. The table is written to a temporary file first and
+// renamed into place, so a crash during the write leaves the old table.
+func (js *JobStore) Save(table jobTable) {
+	if js.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		log.Printf("JobStore: could not encode job table: %v\n", err)
+		return
+	}
+	tmpPath := js.path + ".tmp"
+	err = writeFileSync(tmpPath, data)
+	if err == nil {
+		err = os.Rename(tmpPath, js.path)
+	}
+	if err != nil {
+		log.Printf("JobStore: could not save job table: %v\n", err)
+	}
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
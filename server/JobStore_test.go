@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"project_c9f7_i5l8_o0p4_p0j8/db"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"testing"
+)
+
+// A temporary directory for a job table, and the path of the table in it.
+func jobTablePath() (dir string, path string) {
+	dir, err := ioutil.TempDir("", "jobs")
+	checkErr(err)
+	return dir, filepath.Join(dir, "serverjobs.json")
+}
+
+func TestJobStore(tee *testing.T) {
+	t = tee
+	dir, path := jobTablePath()
+	defer os.RemoveAll(dir)
+	js := NewJobStore(path)
+
+	table, err := js.Load()
+	test("missing file", nil, err)
+	test("missing file is empty", 0, len(table.Pending)+len(table.Running))
+
+	saved := jobTable{
+		Pending:   []msg.Request{{ClientId: 1, RequestId: 2, QueueSeq: 3}},
+		Running:   []msg.Request{{ClientId: 4, RequestId: 5, QueueSeq: 1, CheckpointStep: 6}},
+		Completed: map[int]msg.Result{7: {Val: msg.Success}},
+		Usage:     map[int]int{7: 1},
+		NextSeq:   3,
+	}
+	js.Save(saved)
+	table, err = js.Load()
+	test("load", nil, err)
+	test("loaded", saved, table)
+	_, err = os.Stat(path + ".tmp")
+	test("temporary file renamed", true, os.IsNotExist(err))
+
+	// A crash while writing the next table leaves only the temporary file
+	// half written, and the last table whole
+	checkErr(ioutil.WriteFile(path+".tmp", []byte(`{"Pending":[{"Cli`), 0644))
+	table, err = js.Load()
+	test("half written table ignored", nil, err)
+	test("last table kept", saved, table)
+	js.Save(jobTable{NextSeq: 4})
+	table, _ = js.Load()
+	test("next save replaces it", 4, table.NextSeq)
+
+	// A table damaged some other way isn't taken for an empty one
+	checkErr(ioutil.WriteFile(path, []byte(`{"Pending":[{"Cli`), 0644))
+	_, err = js.Load()
+	test("truncated", true, err != nil)
+
+	disabled := NewJobStore("")
+	disabled.Save(saved)
+	table, err = disabled.Load()
+	test("disabled", nil, err)
+	test("nothing saved", 0, len(table.Pending))
+}
+
+// After a restart, queued requests are queued again, and running requests
+// are requeued to resume from their last checkpoint.
+func TestRecoverJobs(tee *testing.T) {
+	t = tee
+	dir, path := jobTablePath()
+	defer os.RemoveAll(dir)
+
+	cm := NewClientManager(path)
+	cm.submit(msg.Request{ClientId: 1, RequestId: 1, Priority: 1})
+	cm.submit(msg.Request{ClientId: 2, RequestId: 1})
+	running, _ := cm.GetRequest()
+	test("running", 1, running.ClientId)
+	running.Superstep = 7
+	running.CheckpointStep = 5
+	cm.UpdateRunning(running)
+	cm.submit(msg.Request{ClientId: 3, RequestId: 2})
+
+	recovered := NewClientManager(path)
+	test("all pending", 3, recovered.NumPending())
+	test("none running", 0, len(recovered.running))
+	for clientId, requestId := range map[int]int{1: 1, 2: 1, 3: 2} {
+		test("current request", requestId, recovered.currentRequest(clientId))
+	}
+
+	request, _ := recovered.GetRequest()
+	test("running one first", 1, request.ClientId)
+	test("resumes from its checkpoint", 5, request.Superstep)
+	test("checkpoint kept", 5, request.CheckpointStep)
+	request, _ = recovered.GetRequest()
+	test("then in queue order", 2, request.ClientId)
+
+	// The client reattaches to its recovered request
+	c, err := recovered.submit(msg.Request{ClientId: 3, RequestId: 2})
+	test("reattached", true, c != nil && err == nil)
+	test("not queued twice", 1, recovered.NumPending())
+}
+
+// A client only reattaches to a recovered request for the same graph, even if
+// it reuses the request id.
+func TestReattachOtherGraph(tee *testing.T) {
+	t = tee
+	dir, path := jobTablePath()
+	defer os.RemoveAll(dir)
+
+	cm := NewClientManager(path)
+	cm.submit(msg.Request{ClientId: 1, RequestId: 5, DBAccess: db.NewAccess("1-a", "1-a-2")})
+	running, _ := cm.GetRequest()
+	running.DBAccess.SwapKeys()
+	cm.UpdateRunning(running)
+
+	recovered := NewClientManager(path)
+	c, err := recovered.submit(msg.Request{ClientId: 1, RequestId: 5, DBAccess: db.NewAccess("1-b", "1-b-2")})
+	test("other graph refused", true, c == nil && err == nil)
+	c, err = recovered.submit(msg.Request{ClientId: 1, RequestId: 6, DBAccess: db.NewAccess("1-a", "1-a-2")})
+	test("other request refused", true, c == nil && err == nil)
+	c, err = recovered.submit(msg.Request{ClientId: 1, RequestId: 5, DBAccess: db.NewAccess("1-a", "1-a-2")})
+	test("same graph reattached", true, c != nil && err == nil)
+	test("not queued twice", 1, recovered.NumPending())
+}
+
+// A server won't start from a damaged job table, rather than forget its jobs.
+func TestRecoverTruncatedJobs(tee *testing.T) {
+	t = tee
+	dir, path := jobTablePath()
+	defer os.RemoveAll(dir)
+	checkErr(ioutil.WriteFile(path, []byte(`{"Pending":[`), 0644))
+
+	defer func() {
+		test("refused", true, recover() != nil)
+		data, _ := ioutil.ReadFile(path)
+		test("table left alone", `{"Pending":[`, string(data))
+	}()
+	NewClientManager(path)
+}
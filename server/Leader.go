@@ -0,0 +1,44 @@
+// Leader election between a primary and standby servers on the same machine.
+//
+// Every server is started with the same lock file (and the same -state file).
+// The server holding an exclusive lock on the lock file is the leader; the
+// others block until the lock is released. The operating system releases the
+// lock when the leader dies, however it dies, so there is no lease to renew.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// Kept open for as long as this server is the leader. Closing it, or exiting,
+// hands leadership over to a standby.
+var leaderLock *os.File
+
+// Blocks until this server is the leader. An empty path means there is no
+// standby, and this server leads straight away.
+func acquireLeadership(path string, clientAddr string, workerAddr string) {
+	if path == "" {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	checkErr(err)
+
+	log.Printf("Waiting for leadership on %v\n", path)
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	checkErr(err)
+	leaderLock = file
+
+	// Record who the leader is, for the benefit of whoever is debugging.
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%v %v %v\n", os.Getpid(), clientAddr, workerAddr)), 0)
+	}
+	if err != nil {
+		log.Printf("Could not record leader in %v: %v\n", path, err)
+	}
+	log.Printf("Became the leader (clients at %v, workers at %v)\n", clientAddr, workerAddr)
+}
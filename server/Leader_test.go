@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A standby blocks on the lock until the leader lets go of it, and then
+// takes over.
+func TestLeaderHandover(tee *testing.T) {
+	t = tee
+	dir, err := ioutil.TempDir("", "leader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.lock")
+
+	acquireLeadership(path, "client-1", "worker-1")
+	leader := leaderLock
+	data, _ := ioutil.ReadFile(path)
+	test("leader recorded", true, strings.HasSuffix(string(data), " client-1 worker-1\n"))
+
+	standby := make(chan bool)
+	go func() {
+		acquireLeadership(path, "client-2", "worker-2")
+		close(standby)
+	}()
+	select {
+	case <-standby:
+		t.Fatal("standby became the leader while the leader held the lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The lock goes with the leader's file, however the leader goes
+	leader.Close()
+	select {
+	case <-standby:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby did not take over")
+	}
+	data, _ = ioutil.ReadFile(path)
+	test("standby recorded", true, strings.HasSuffix(string(data), " client-2 worker-2\n"))
+	leaderLock.Close()
+}
+
+// Without a lock file, a server leads at once.
+func TestNoStandby(tee *testing.T) {
+	t = tee
+	leaderLock = nil
+	acquireLeadership("", "client", "worker")
+	test("no lock", true, leaderLock == nil)
+}
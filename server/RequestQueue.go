@@ -0,0 +1,132 @@
+// Pending request queue with priorities, per-client fair share and aging.
+package main
+
+import (
+	"sort"
+	"time"
+
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+)
+
+// A request gains one level of priority for every agingInterval it has been
+// waiting, so low priority work eventually runs.
+const agingInterval = 30 * time.Second
+
+// Clients can ask for priorities from -maxPriority to maxPriority, as set by
+// the -max-priority flag; anything outside is brought into that range. So no
+// client can ask for more than a job that has waited for maxPriority aging
+// intervals.
+var maxPriority = 10
+
+// Brings a priority asked for by a client into the allowed range.
+func clampPriority(priority int) int {
+	if priority > maxPriority {
+		return maxPriority
+	} else if priority < -maxPriority {
+		return -maxPriority
+	}
+	return priority
+}
+
+// The requests that are not yet scheduled. Requests are ordered by
+// (aged) priority, then by how many jobs their client has already had
+// completed, and finally by the order in which they were first submitted.
+// A requeued request keeps its original submission order and time.
+type RequestQueue struct {
+	requests []msg.Request
+	nextSeq  int
+	usage    map[int]int // Completed jobs per ClientId, for fair share
+}
+
+func (q *RequestQueue) Len() int {
+	return len(q.requests)
+}
+
+// Adds a request to the queue. A request that has been in the queue before
+// (i.e. it is being requeued) keeps its place. Its priority is clamped to
+// the allowed range.
+func (q *RequestQueue) Push(request msg.Request) {
+	request.Priority = clampPriority(request.Priority)
+	if request.QueueSeq == 0 {
+		q.nextSeq++
+		request.QueueSeq = q.nextSeq
+	}
+	if request.Submitted.IsZero() {
+		request.Submitted = time.Now()
+	}
+	q.requests = append(q.requests, request)
+}
+
+// Removes and returns the request that should run next.
+func (q *RequestQueue) Pop() (msg.Request, bool) {
+	if len(q.requests) == 0 {
+		return msg.Request{}, false
+	}
+	q.sort(time.Now())
+	request := q.requests[0]
+	q.requests = q.requests[1:]
+	return request, true
+}
+
+// Returns a copy of the queued requests, in no particular order.
+func (q *RequestQueue) Requests() []msg.Request {
+	requests := make([]msg.Request, len(q.requests))
+	copy(requests, q.requests)
+	return requests
+}
+
+// Records that a job for this client has finished, lowering the client's
+// share relative to the clients that have had less work done.
+func (q *RequestQueue) AddUsage(clientId int) {
+	if q.usage == nil {
+		q.usage = make(map[int]int)
+	}
+	q.usage[clientId]++
+}
+
+// Returns the 1-based position of the client's request in the queue,
+// or 0 if the client has no queued request.
+func (q *RequestQueue) Position(clientId int) int {
+	q.sort(time.Now())
+	for i, request := range q.requests {
+		if request.ClientId == clientId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// The priority of the request after aging.
+func effectivePriority(request msg.Request, now time.Time) int {
+	return request.Priority + int(now.Sub(request.Submitted)/agingInterval)
+}
+
+func (q *RequestQueue) sort(now time.Time) {
+	sort.Sort(byQueueOrder{q.requests, q.usage, now})
+}
+
+// byQueueOrder implements sort.Interface, putting the next request to run first
+type byQueueOrder struct {
+	requests []msg.Request
+	usage    map[int]int
+	now      time.Time
+}
+
+func (bq byQueueOrder) Len() int {
+	return len(bq.requests)
+}
+func (bq byQueueOrder) Swap(i, j int) {
+	bq.requests[i], bq.requests[j] = bq.requests[j], bq.requests[i]
+}
+func (bq byQueueOrder) Less(i, j int) bool {
+	a, b := bq.requests[i], bq.requests[j]
+	pa, pb := effectivePriority(a, bq.now), effectivePriority(b, bq.now)
+	if pa != pb {
+		return pa > pb
+	}
+	ua, ub := bq.usage[a.ClientId], bq.usage[b.ClientId]
+	if ua != ub {
+		return ua < ub
+	}
+	return a.QueueSeq < b.QueueSeq
+}
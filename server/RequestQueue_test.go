@@ -0,0 +1,105 @@
+package main
+
+import (
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"testing"
+	"time"
+)
+
+// The clients of the requests in the queue, in the order they would run.
+func queueOrder(q *RequestQueue, now time.Time) []int {
+	q.sort(now)
+	var clients []int
+	for _, request := range q.requests {
+		clients = append(clients, request.ClientId)
+	}
+	return clients
+}
+
+// Higher priorities run first, and requests of the same priority in the
+// order they were submitted.
+func TestQueuePriority(tee *testing.T) {
+	t = tee
+	q := &RequestQueue{}
+	now := time.Now()
+	q.Push(msg.Request{ClientId: 1, Submitted: now})
+	q.Push(msg.Request{ClientId: 2, Priority: 2, Submitted: now})
+	q.Push(msg.Request{ClientId: 3, Submitted: now})
+	q.Push(msg.Request{ClientId: 4, Priority: -1, Submitted: now})
+	q.Push(msg.Request{ClientId: 5, Priority: 2, Submitted: now})
+	test("order", []int{2, 5, 1, 3, 4}, queueOrder(q, now))
+	test("position", 3, q.Position(1))
+	test("not queued", 0, q.Position(6))
+
+	request, _ := q.Pop()
+	test("pop", 2, request.ClientId)
+	test("left", 4, q.Len())
+}
+
+// A client can't ask for more than maxPriority, so a request that has waited
+// long enough catches up with any other.
+func TestQueuePriorityClamped(tee *testing.T) {
+	t = tee
+	test("too high", maxPriority, clampPriority(1<<30))
+	test("too low", -maxPriority, clampPriority(-1<<30))
+	test("in range", 3, clampPriority(3))
+
+	q := &RequestQueue{}
+	now := time.Now()
+	old := now.Add(-time.Duration(maxPriority+1) * agingInterval)
+	q.Push(msg.Request{ClientId: 1, Priority: 1 << 30, Submitted: now})
+	q.Push(msg.Request{ClientId: 2, Submitted: old})
+	test("clamped", maxPriority, q.requests[0].Priority)
+	test("aged past the greedy client", []int{2, 1}, queueOrder(q, now))
+}
+
+// A waiting request gains a level of priority every agingInterval.
+func TestQueueAging(tee *testing.T) {
+	t = tee
+	now := time.Now()
+	request := msg.Request{Priority: 1, Submitted: now.Add(-2*agingInterval - time.Second)}
+	test("aged", 3, effectivePriority(request, now))
+	test("fresh", 1, effectivePriority(msg.Request{Priority: 1, Submitted: now}, now))
+
+	// A request of priority 0 overtakes a new one of priority 2 once it has
+	// waited three intervals
+	waited := func(intervals time.Duration) []int {
+		q := &RequestQueue{}
+		q.Push(msg.Request{ClientId: 1, Priority: 2, Submitted: now})
+		q.Push(msg.Request{ClientId: 2, Submitted: now.Add(-intervals * agingInterval)})
+		return queueOrder(q, now)
+	}
+	test("not yet", []int{1, 2}, waited(1))
+	test("tied, first queued first", []int{1, 2}, waited(2))
+	test("overtaken", []int{2, 1}, waited(3))
+}
+
+// Between requests of the same priority, clients that have had fewer jobs
+// completed go first.
+func TestQueueFairShare(tee *testing.T) {
+	t = tee
+	q := &RequestQueue{}
+	now := time.Now()
+	q.AddUsage(1)
+	q.AddUsage(1)
+	q.AddUsage(2)
+	q.Push(msg.Request{ClientId: 1, Submitted: now})
+	q.Push(msg.Request{ClientId: 2, Submitted: now})
+	q.Push(msg.Request{ClientId: 3, Submitted: now})
+	q.Push(msg.Request{ClientId: 4, Priority: 1, Submitted: now})
+	test("order", []int{4, 3, 2, 1}, queueOrder(q, now))
+}
+
+// A requeued request keeps its place, ahead of requests submitted after it.
+func TestQueueRequeue(tee *testing.T) {
+	t = tee
+	q := &RequestQueue{}
+	q.Push(msg.Request{ClientId: 1})
+	q.Push(msg.Request{ClientId: 2})
+	first, _ := q.Pop()
+	q.Push(msg.Request{ClientId: 3})
+	q.Push(first)
+	test("kept its place", []int{1, 2, 3}, queueOrder(q, time.Now()))
+	test("same sequence", first.QueueSeq, q.requests[0].QueueSeq)
+	test("same submission time", first.Submitted, q.requests[0].Submitted)
+}
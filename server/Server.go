@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"log"
-	"os"
+	"project_c9f7_i5l8_o0p4_p0j8/db"
 	"project_c9f7_i5l8_o0p4_p0j8/job"
 	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sync"
 	"time"
 	"github.com/arcaneiceman/GoVector/govec"
 )
@@ -32,80 +34,289 @@ func init() {
 }
 
 //============================================================
-// This function keeps pulling from PendingRequests and completes the jobs
-func work(clientManager *ClientManager, workerManager *WorkerManager) {
-	for {
-		// Assign workers for this task.
-		selectedWorkers := workerManager.SelectWorkers()
-		if len(selectedWorkers) == 0 {
+// Where the graphs of the jobs are, as given by -store
+var store db.GraphStore
+
+//============================================================
+// When a client does not ask for a number of workers, give each worker about
+// this many vertices of the graph.
+const verticesPerWorker = 100000
+
+// This function keeps pulling pending requests from the ClientManager, splits the idle workers
+// between the pending requests, and runs each job on its own set of workers.
+// It returns once the server starts shutting down.
+func work(clientManager *ClientManager, workerManager *WorkerManager, jobs *runningJobs) {
+	for !jobs.isStopping() {
+		idle := workerManager.NumIdleWorkers()
+		if idle == 0 {
 			log.Println("work(): No available workers.")
 			time.Sleep(time.Second)
 			continue
 		}
 
-		// Get a request.
-		request, ok := clientManager.GetRequest()
-		if ok == false {
+		pending := clientManager.NumPending()
+		if pending == 0 {
 			log.Println("work(): No pending requests.")
 			time.Sleep(time.Second)
-		} else {
-			log.Printf("work(): Handling request: %v with workers: %v\n", request, selectedWorkers)
-
-			// Create the message channels assigned for this request.
-			// TODO: check the size of these parameters.
-			cIn := make(chan msg.FromWorker, 10000)
-			cOut := make(chan msg.FromServer, 10000)
-			cResult := make(chan msg.Result)
-
-			workerManager.PrepareWorkers(selectedWorkers, cIn)
-
-			// Run the job.
-			jobResult := msg.Result{msg.Nil, msg.Request{}}
-			go job.Run(request, selectedWorkers, cIn, cOut, cResult)
-			for {
-				select {
-				case jobResult = <-cResult:
-					if jobResult.Val == msg.Success {
-						log.Printf("work(): Success - %v", msg.ResultStr(jobResult))
-						break
-					} else {
-						log.Printf("work(): Not Success yet: %v", msg.ResultStr(jobResult))
-					}
-
-				case msgOut := <-cOut:
-					log.Printf("work(): sending out message - %v\n", msgOut)
-					workerManager.SendMessageToWorker(msgOut)
-				}
-
-				if jobResult.Val != msg.Nil {
-					break // We only want to break when jobResult has been set.
-				}
-			}
+			continue
+		}
+
+		// Get a request.
+		request, ok := clientManager.GetRequest()
+		if !ok {
+			continue
+		}
+
+		// Assign workers for this task.
+		selectedWorkers := workerManager.SelectWorkers(numWorkersFor(request, idle, pending))
+		if len(selectedWorkers) == 0 {
+			// The workers we counted disappeared in the meantime.
+			clientManager.CompletedRequest(request, msg.Result{Val: msg.Incomplete, Request: request})
+			continue
+		}
+
+		go runJob(clientManager, workerManager, jobs, request, selectedWorkers)
+	}
+}
+
+// Decides how many of the idle workers a request gets. A request asking for a
+// specific number gets that many (if available). Otherwise the idle workers are
+// split evenly between the pending requests, and a small graph doesn't take
+// more workers than it needs.
+func numWorkersFor(request msg.Request, idle int, pending int) int {
+	if request.NumWorkers > 0 {
+		if request.NumWorkers < idle {
+			return request.NumWorkers
+		}
+		return idle
+	}
+
+	share := idle / pending
+	if share < 1 {
+		share = 1
+	}
+
+	numVertices, err := store.NumVertices(request.DBAccess.Key())
+	if err != nil {
+		return share
+	}
+	needed := (numVertices + verticesPerWorker - 1) / verticesPerWorker
+	if needed < 1 {
+		needed = 1
+	}
+	if needed < share {
+		return needed
+	}
+	return share
+}
+
+// The workers of a running job. At each checkpoint, the job grows onto idle
+// workers that joined since its last one, up to the number numWorkersFor
+// would give it now, but only if no request is waiting for them.
+type jobWorkers struct {
+	clientManager *ClientManager
+	workerManager *WorkerManager
+	request       msg.Request
+	inbox         *jobInbox
+	recoverable   bool // Only take workers that can recover partitions, if all of the job's can
+
+	lock    sync.Mutex
+	workers []msg.WorkerId // Not yet released
+	joins   int            // The workerManager's Joins when the job last looked
+}
+
+// MoreWorkers implements job.WorkerPool.
+func (jw *jobWorkers) MoreWorkers() map[msg.WorkerId]string {
+	jw.lock.Lock()
+	defer jw.lock.Unlock()
 
-			// Cleanup.
+	if !jw.workerManager.AnyJoined(jw.joins) || jw.clientManager.NumPending() > 0 {
+		return nil
+	}
+	jw.joins = jw.workerManager.Joins()
+	idle := jw.workerManager.NumIdleWorkers()
+	want := numWorkersFor(jw.request, idle+len(jw.workers), 1) - len(jw.workers)
+	if want <= 0 {
+		return nil
+	}
+
+	var added []msg.WorkerId
+	for _, worker := range jw.workerManager.SelectWorkers(want) {
+		if jw.recoverable && !jw.workerManager.AllCapable([]msg.WorkerId{worker}, msg.CapRecover) {
+			jw.workerManager.CloseWorkers([]msg.WorkerId{worker})
+			continue
+		}
+		added = append(added, worker)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	log.Printf("Request %v grows onto workers %v\n", jw.request.RequestId, added)
+	jw.workerManager.PrepareWorkers(added, jw.inbox)
+	jw.workers = append(jw.workers, added...)
+	return jw.workerManager.WorkerAddresses(added)
+}
+
+// Returns a worker the job no longer uses to the pool.
+func (jw *jobWorkers) release(worker msg.WorkerId) {
+	jw.lock.Lock()
+	defer jw.lock.Unlock()
+
+	for i, w := range jw.workers {
+		if w == worker {
+			jw.workers = append(jw.workers[:i], jw.workers[i+1:]...)
+			jw.workerManager.CloseWorkers([]msg.WorkerId{worker})
+			return
+		}
+	}
+}
+
+// Returns all of the job's workers to the pool.
+func (jw *jobWorkers) releaseAll() {
+	jw.lock.Lock()
+	defer jw.lock.Unlock()
+
+	jw.workerManager.CloseWorkers(jw.workers)
+	jw.workers = nil
+}
+
+// Runs a single request on the given workers, with its own message channels,
+// and returns the workers to the pool when it is done. Workers the job
+// releases early, because they are drained, are returned straight away.
+func runJob(clientManager *ClientManager, workerManager *WorkerManager, jobs *runningJobs, request msg.Request,
+	selectedWorkers []msg.WorkerId) {
+	log.Printf("runJob(): Handling request: %v with workers: %v\n", request, selectedWorkers)
+
+	// Refuse a graph that no job can run on, rather than fail on the
+	// workers. A graph uploaded by an older client is checked here first,
+	// which takes a pass over it, so the scheduler doesn't wait for it.
+	if _, err := db.Validate(store, request.DBAccess); err != nil {
+		if _, ok := err.(*db.InvalidGraphError); ok {
+			log.Printf("runJob(): Refusing request %v: %v\n", request.RequestId, err)
 			workerManager.CloseWorkers(selectedWorkers)
-			clientManager.CompletedRequest(request, jobResult)
-			close(cIn)
-			close(cOut)
-			close(cResult)
+			clientManager.CompletedRequest(request, msg.Result{Val: msg.Failure, Request: request})
+			return
+		}
+		log.Printf("runJob(): Could not check the graph of request %v: %v\n", request.RequestId, err)
+	}
+
+	// Create the message channels assigned for this request. The workers'
+	// windows keep what they send within limits.JobQueue, as long as it is
+	// bigger than all of their windows together.
+	inbox := newJobInbox(limits.JobQueue)
+	cOut := make(chan msg.FromServer, limits.JobQueue)
+	cResult := make(chan msg.Result)
+
+	if !jobs.add(inbox) {
+		// The server is shutting down, and the request is kept for the next one
+		workerManager.CloseWorkers(selectedWorkers)
+		clientManager.CompletedRequest(request, msg.Result{Val: msg.Incomplete, Request: request})
+		return
+	}
+	defer jobs.remove(inbox)
+
+	workerManager.PrepareWorkers(selectedWorkers, inbox)
 
-			log.Printf("work(): Finished handling request %v\n", request)
+	// Run the job.
+	jobResult := msg.Result{msg.Nil, msg.Request{}}
+	addresses := workerManager.WorkerAddresses(selectedWorkers)
+	// Workers from older versions may not be able to take over the
+	// partitions of one that dies, in which case the job is restarted instead
+	recoverable := workerManager.AllCapable(selectedWorkers, msg.CapRecover)
+	pool := &jobWorkers{
+		clientManager: clientManager,
+		workerManager: workerManager,
+		request:       request,
+		inbox:         inbox,
+		recoverable:   recoverable,
+		workers:       append([]msg.WorkerId(nil), selectedWorkers...),
+		joins:         workerManager.Joins(),
+	}
+	go job.Run(request, store, selectedWorkers, addresses, recoverable, pool, inbox.cIn, inbox.cControl, cOut, cResult)
+	for {
+		select {
+		case jobResult = <-cResult:
+			if jobResult.Val == msg.Success {
+				log.Printf("runJob(): Success - %v", msg.ResultStr(jobResult))
+				break
+			} else if jobResult.Val == msg.Checkpointed {
+				log.Printf("runJob(): Checkpoint at superstep %v", jobResult.Request.CheckpointStep)
+				clientManager.UpdateRunning(jobResult.Request)
+				jobResult.Val = msg.Nil
+			} else {
+				log.Printf("runJob(): Not Success yet: %v", msg.ResultStr(jobResult))
+			}
+
+		case msgOut := <-cOut:
+			if msgOut.Type == msg.Release {
+				log.Printf("runJob(): releasing worker %v\n", msgOut.DstWorker)
+				pool.release(msgOut.DstWorker)
+				break
+			}
+			log.Printf("runJob(): sending out message - %v\n", msgOut)
+			workerManager.SendMessageToWorker(msgOut)
+		}
+
+		if jobResult.Val != msg.Nil {
+			break // We only want to break when jobResult has been set.
 		}
 	}
+
+	// Cleanup.
+	pool.releaseAll()
+	clientManager.CompletedRequest(request, jobResult)
+	inbox.close()
+	close(cOut)
+	close(cResult)
+
+	log.Printf("runJob(): Finished handling request %v\n", request)
 }
 
 //============================================================
 // Entry point to the server.
+// Usage: server [-state file] [-lock file] [-cert file -key file -ca file] [-window n] [-worker-queue n] [-job-queue n] [-stats interval]
+//               [-max-priority n] [-shutdown-timeout duration] [-store uri] [-db-name name] [-db-timeout duration] [client connection address] [worker connection address]
+// On SIGINT or SIGTERM the server shuts down gracefully; a second signal stops it at once.
 func main() {
+	statePath := flag.String("state", "serverjobs.json", "file to persist the job table in, so jobs survive a restart (empty to disable)")
+	lockPath := flag.String("lock", "", "lock file shared with standby servers; the server holding it is the leader")
+	certFile := flag.String("cert", "", "PEM certificate of the server; enables TLS for clients and workers")
+	keyFile := flag.String("key", "", "PEM key of the server certificate")
+	caFile := flag.String("ca", "", "PEM certificate of the CA that signs client and worker certificates")
+	flag.IntVar(&limits.WorkerWindow, "window", limits.WorkerWindow, "how many messages a worker may send before the server returns credits (0 for no limit)")
+	flag.IntVar(&limits.WorkerQueue, "worker-queue", limits.WorkerQueue, "how many messages can be queued for each worker")
+	flag.IntVar(&limits.JobQueue, "job-queue", limits.JobQueue, "how many messages can be queued between a job and its workers")
+	flag.DurationVar(&limits.StatsInterval, "stats", limits.StatsInterval, "how often to log the depth of busy queues (0 to never)")
+	flag.IntVar(&maxPriority, "max-priority", maxPriority, "highest priority a client can ask for; priorities are clamped to [-max, max]")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Minute, "how long to wait for running jobs to checkpoint when shutting down")
+	dbConfig, err := db.ConfigFromEnv()
+	checkErr(err)
+	dbConfig.RegisterFlags()
+	flag.Parse()
+
 	log.SetFlags(log.Lshortfile)
 
-	clientServiceAddr := os.Args[1]
-	clientManager := new(ClientManager)
-	clientManager.Initialize(clientServiceAddr)
+	tlsConfig, err := msg.LoadTLS(*certFile, *keyFile, *caFile)
+	checkErr(err)
+	store, err = db.Open(dbConfig)
+	checkErr(err)
+
+	clientServiceAddr := flag.Arg(0)
+	workerServiceAddr := flag.Arg(1)
+
+	// A standby waits here until the leader goes away, and then picks up
+	// the jobs the leader persisted.
+	acquireLeadership(*lockPath, clientServiceAddr, workerServiceAddr)
+
+	workerManager := NewWorkerManager()
+	workerManager.Initialize(workerServiceAddr, tlsConfig)
+
+	clientManager := NewClientManager(*statePath)
+	clientManager.Initialize(clientServiceAddr, tlsConfig, workerManager)
 
-	workerServiceAddr := os.Args[2]
-	workerManager := new(WorkerManager)
-	workerManager.Initialize(workerServiceAddr)
+	jobs := newRunningJobs()
+	go work(clientManager, workerManager, jobs)
 
-	work(clientManager, workerManager)
+	waitForSignal()
+	shutdown(clientManager, workerManager, jobs, *shutdownTimeout)
 }
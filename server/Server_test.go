@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"project_c9f7_i5l8_o0p4_p0j8/db"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sort"
+	"testing"
+	"time"
+)
+
+// A store whose graphs all have numVertices vertices, or that can't count
+// them.
+type sizedStore struct {
+	db.GraphStore
+	numVertices int
+	err         error
+}
+
+func (s sizedStore) NumVertices(key string) (int, error) {
+	return s.numVertices, s.err
+}
+
+// Runs fn with the server's store set to s.
+func withStore(s db.GraphStore, fn func()) {
+	saved := store
+	store = s
+	defer func() { store = saved }()
+	fn()
+}
+
+// The idle workers are split evenly between the pending requests, but a
+// small graph only gets as many as it needs.
+func TestNumWorkersFor(tee *testing.T) {
+	t = tee
+	withStore(sizedStore{GraphStore: db.NewMemoryStore(), numVertices: 10 * verticesPerWorker}, func() {
+		test("even share", 4, numWorkersFor(msg.Request{}, 12, 3))
+		test("share rounds down", 3, numWorkersFor(msg.Request{}, 11, 3))
+		test("at least one", 1, numWorkersFor(msg.Request{}, 2, 3))
+		test("big graph takes the share", 10, numWorkersFor(msg.Request{}, 12, 1))
+
+		test("asked for fewer", 2, numWorkersFor(msg.Request{NumWorkers: 2}, 12, 3))
+		test("asked for more than idle", 3, numWorkersFor(msg.Request{NumWorkers: 5}, 3, 1))
+		test("asked for all idle", 3, numWorkersFor(msg.Request{NumWorkers: 3}, 3, 1))
+	})
+	withStore(sizedStore{GraphStore: db.NewMemoryStore(), numVertices: verticesPerWorker + 1}, func() {
+		test("small graph", 2, numWorkersFor(msg.Request{}, 12, 1))
+		test("small graph, small share", 1, numWorkersFor(msg.Request{}, 12, 12))
+		test("asked for more than the graph needs", 5, numWorkersFor(msg.Request{NumWorkers: 5}, 12, 1))
+	})
+	withStore(sizedStore{GraphStore: db.NewMemoryStore()}, func() {
+		test("empty graph", 1, numWorkersFor(msg.Request{}, 12, 1))
+	})
+	withStore(sizedStore{GraphStore: db.NewMemoryStore(), err: errors.New("unreachable")}, func() {
+		test("unknown size", 6, numWorkersFor(msg.Request{}, 12, 2))
+	})
+}
+
+// Jobs run on disjoint sets of workers, which go back to the pool when the
+// job is over, however it ends.
+func TestJobReleasesWorkers(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	cm := NewClientManager("")
+	for _, id := range []msg.WorkerId{"w1", "w2", "w3"} {
+		connectWorker(wm, id)
+	}
+
+	first := wm.SelectWorkers(2)
+	second := wm.SelectWorkers(2)
+	test("first job's workers", 2, len(first))
+	test("second job gets the rest", 1, len(second))
+	for _, worker := range second {
+		test("disjoint", false, worker == first[0] || worker == first[1])
+	}
+	test("none idle", 0, wm.NumIdleWorkers())
+
+	cm.submit(msg.Request{ClientId: 1, RequestId: 1})
+	request, _ := cm.GetRequest()
+	withStore(sizedStore{GraphStore: db.NewMemoryStore(), err: errors.New("unreachable")}, func() {
+		runJob(cm, wm, newRunningJobs(), request, first)
+	})
+	test("released", 2, wm.NumIdleWorkers())
+	test("result", msg.Failure, cm.lastResult(1).Val)
+	test("request done", 0, cm.currentRequest(1))
+
+	wm.CloseWorkers(second)
+	test("all idle", 3, wm.NumIdleWorkers())
+}
+
+// A job on a graph that can't run fails straight away, tells its client so,
+// and gives its workers back.
+func TestInvalidGraphJob(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	cm := NewClientManager("")
+	connectWorker(wm, "w1")
+	connectWorker(wm, "w2")
+
+	memory := db.NewMemoryStore()
+	access, _ := memory.CreateJob("job")
+	memory.Insert(access, []db.DbVertex{{VertexID: 0, Adjacent: []int{1 << 40}}, {VertexID: 1 << 40}})
+	replies := make(chan msg.ServerRequestResp, 1)
+	go func() {
+		var reply msg.ServerRequestResp
+		cs := &ClientService{cm: cm}
+		checkErr(cs.Request(&msg.ClientRequestMsg{ClientId: 1, RequestId: 1, DBAccess: access}, &reply))
+		replies <- reply
+	}()
+	for cm.NumPending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	request, _ := cm.GetRequest()
+	withStore(memory, func() {
+		runJob(cm, wm, newRunningJobs(), request, wm.SelectWorkers(2))
+	})
+	test("refused", msg.Failure, cm.lastResult(1).Val)
+	reply := <-replies
+	test("client told", false, reply.Success)
+	test("why", "Failure", reply.ReplyVal)
+	test("released", 2, wm.NumIdleWorkers())
+	test("request done", 0, cm.currentRequest(1))
+}
+
+// A running job grows onto workers that join, as far as its request allows.
+func TestJobGrows(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	cm := NewClientManager("")
+
+	connectWorker(wm, "w1")
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+	pool := &jobWorkers{
+		clientManager: cm,
+		workerManager: wm,
+		request:       msg.Request{ClientId: 1, RequestId: 1, NumWorkers: 3},
+		inbox:         inbox,
+		workers:       selected,
+		joins:         wm.Joins(),
+	}
+	test("no new workers", 0, len(pool.MoreWorkers()))
+
+	connectWorker(wm, "w2")
+	connectWorker(wm, "w3")
+	connectWorker(wm, "w4")
+	added := pool.MoreWorkers()
+	test("grew to the requested size", 2, len(added))
+	for worker, address := range added {
+		test("address", "peer-"+string(worker), address)
+	}
+	test("one left idle", 1, wm.NumIdleWorkers())
+	test("no more", 0, len(pool.MoreWorkers()))
+
+	// A worker that joins while a request is waiting is left for it
+	pool.release(selected[0])
+	test("released", 2, wm.NumIdleWorkers())
+	cm.submit(msg.Request{ClientId: 2, RequestId: 1})
+	test("left for the waiting request", 0, len(pool.MoreWorkers()))
+
+	pool.releaseAll()
+	test("all idle", 4, wm.NumIdleWorkers())
+	var statuses []string
+	for _, status := range wm.WorkerStatuses() {
+		test("not busy", false, status.Busy)
+		statuses = append(statuses, string(status.WorkerId))
+	}
+	test("sorted", true, sort.StringsAreSorted(statuses))
+}
@@ -0,0 +1,109 @@
+// Graceful shutdown. The server stops taking requests, has every running job
+// checkpoint and stop at its next barrier, so that it is requeued from there,
+// persists the job table, and tells the workers to go and find the next
+// leader. The server that leads next picks up where this one left off.
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The jobs the server is running, so that they can be stopped at shutdown.
+type runningJobs struct {
+	lock     sync.Mutex
+	inboxes  map[*jobInbox]bool
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{inboxes: make(map[*jobInbox]bool)}
+}
+
+// Records a job that is starting. Returns false if the server is shutting
+// down, in which case the job must not start.
+func (rj *runningJobs) add(inbox *jobInbox) bool {
+	rj.lock.Lock()
+	defer rj.lock.Unlock()
+
+	if rj.stopping {
+		return false
+	}
+	rj.inboxes[inbox] = true
+	rj.wg.Add(1)
+	return true
+}
+
+// Records that a job is over, and its request is back with the ClientManager.
+func (rj *runningJobs) remove(inbox *jobInbox) {
+	rj.lock.Lock()
+	defer rj.lock.Unlock()
+
+	delete(rj.inboxes, inbox)
+	rj.wg.Done()
+}
+
+func (rj *runningJobs) isStopping() bool {
+	rj.lock.Lock()
+	defer rj.lock.Unlock()
+	return rj.stopping
+}
+
+// Asks every running job to checkpoint and stop at its next barrier, and
+// waits up to timeout for them to. Returns whether they all stopped in time.
+// A job that didn't is resumed from its last checkpoint anyway.
+func (rj *runningJobs) stop(timeout time.Duration) bool {
+	rj.lock.Lock()
+	rj.stopping = true
+	log.Printf("Stopping %v running jobs\n", len(rj.inboxes))
+	for inbox := range rj.inboxes {
+		go inbox.control(msg.FromWorker{Type: msg.Stop})
+	}
+	rj.lock.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		rj.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Blocks until the server is asked to shut down. A second signal, while it
+// shuts down, stops it at once.
+func waitForSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down\n", sig)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v again, exiting now\n", sig)
+		os.Exit(1)
+	}()
+}
+
+// Shuts the server down, giving the running jobs up to timeout to stop, and
+// the workers as long again to disconnect.
+func shutdown(clientManager *ClientManager, workerManager *WorkerManager, jobs *runningJobs, timeout time.Duration) {
+	clientManager.StopAccepting()
+	if !jobs.stop(timeout) {
+		log.Printf("Jobs still running after %v; they resume from their last checkpoint\n", timeout)
+	}
+	left := clientManager.Persist()
+	log.Printf("Saved %v requests for the next server\n", left)
+
+	workerManager.Shutdown(timeout)
+	log.Println("Shut down")
+}
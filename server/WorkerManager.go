@@ -4,80 +4,347 @@ package main
 import (
 	// "bufio"
 	// "encoding/json"
-	"encoding/binary"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"sort"
+	"sync"
+	"time"
 	// "github.com/arcaneiceman/GoVector/govec"
 )
 
 //====================================================================
 // Data Structures
 
-type Channels struct {
-	cIn  chan msg.FromWorker
-	cOut chan msg.FromServer
+// Where the workers of a job deliver their messages, and the server asks the
+// job to stop or drain a worker. done is closed once the job is over, after
+// which messages for it are dropped instead of blocking.
+type jobInbox struct {
+	cIn      chan msg.FromWorker
+	cControl chan msg.FromWorker
+	done     chan struct{}
+}
+
+func newJobInbox(size int) *jobInbox {
+	return &jobInbox{
+		cIn:      make(chan msg.FromWorker, size),
+		cControl: make(chan msg.FromWorker, 16),
+		done:     make(chan struct{}),
+	}
+}
+
+// Passes a message to the job, waiting while its queue is full. Returns false
+// if the job is over.
+func (ji *jobInbox) deliver(fw msg.FromWorker) bool {
+	select {
+	case <-ji.done:
+		return false
+	default:
+	}
+	select {
+	case ji.cIn <- fw:
+		return true
+	case <-ji.done:
+		return false
+	}
+}
+
+// Asks the job to stop, or to drain a worker, at its next barrier. Returns
+// false if the job is over.
+func (ji *jobInbox) control(fw msg.FromWorker) bool {
+	select {
+	case ji.cControl <- fw:
+		return true
+	case <-ji.done:
+		return false
+	}
+}
+
+func (ji *jobInbox) close() {
+	close(ji.done)
 }
 
 // Represents the state of a worker in the system. Stores the connection state and the work state of the worker.
+// Conn is nil while a worker in a running job is disconnected and may still rejoin.
 type WorkerMetadata struct {
-	WorkerId  msg.WorkerId
-	Conn      net.Conn
-	RequestId int
-	cMsgOut   chan msg.FromServer
-	cMsgIn    chan msg.FromWorker
-	cQuit     chan int
+	WorkerId     msg.WorkerId
+	Address      string // Where other workers send it vertex messages
+	Conn         net.Conn
+	codec        msg.Codec // How messages on Conn are encoded
+	flow         *connFlow // Flow control on Conn; unlimited both ways for workers without msg.CapCredit
+	protocol     int       // The protocol version the worker connected with
+	Capabilities []string  // What the worker can do, from its connection message
+	RequestId    int
+	State        WorkerState
+	LastSeen     time.Time // When we last heard anything from the worker
+	Draining     bool      // Given no new jobs, so it can be taken out of service
+	cMsgOut      chan msg.FromServer
+	job          *jobInbox // The job the worker is in, if any
+	cQuit        chan int  // Closed when Conn is replaced or dropped, to stop its Writer
+	rejoinToken  string    // Given to the worker when it joined; needed to replace a healthy Conn
+}
+
+// The liveness of a worker, judged by how recently we heard from it.
+type WorkerState int
+
+const (
+	Healthy WorkerState = iota // Heard from within suspectAfter
+	Suspect                    // Missed some heartbeats; not given new jobs
+	Dead                       // Missed too many heartbeats; about to be deleted
+)
+
+func WorkerStateStr(s WorkerState) string {
+	switch s {
+	case Healthy:
+		return "Healthy"
+	case Suspect:
+		return "Suspect"
+	case Dead:
+		return "Dead"
+	default:
+		return fmt.Sprintf("Illegal WorkerState: %v", int(s))
+	}
+}
+
+// How long a worker can be silent before it is suspected, and then declared dead.
+const suspectAfter = 3 * msg.HeartbeatInterval
+const deadAfter = 6 * msg.HeartbeatInterval
+
+// How long a worker in a running job has to reconnect before it is declared
+// dead. Tests shorten it.
+var rejoinGrace = 10 * time.Second
+
+//====================================================================
+// Events
+
+// What happened to a worker. Every change to the set of workers, or to how
+// they are doing, is published as an event to the subscribers.
+type WorkerEventType int
+
+const (
+	WorkerJoined       WorkerEventType = iota // Connected, and not in a running job
+	WorkerRejoined                            // Reconnected in time to carry on with its running job
+	WorkerDisconnected                        // Lost its connection while in a job; has rejoinGrace to come back
+	WorkerSuspected                           // Missed some heartbeats
+	WorkerRecovered                           // Heard from again after being suspected
+	WorkerRemoved                             // Gone for good
+	WorkerDraining                            // Given no new jobs; waiting for its job to release it
+	WorkerDrained                             // Draining, and in no job
+)
+
+func WorkerEventStr(t WorkerEventType) string {
+	switch t {
+	case WorkerJoined:
+		return "Joined"
+	case WorkerRejoined:
+		return "Rejoined"
+	case WorkerDisconnected:
+		return "Disconnected"
+	case WorkerSuspected:
+		return "Suspected"
+	case WorkerRecovered:
+		return "Recovered"
+	case WorkerRemoved:
+		return "Removed"
+	case WorkerDraining:
+		return "Draining"
+	case WorkerDrained:
+		return "Drained"
+	default:
+		return fmt.Sprintf("Illegal WorkerEventType: %v", int(t))
+	}
 }
 
-// Store all the data related to workers.
-var WorkerData map[msg.WorkerId]WorkerMetadata
-var LastSelectedWorkers map[msg.WorkerId]bool
+type WorkerEvent struct {
+	Type     WorkerEventType
+	WorkerId msg.WorkerId
+}
 
 //====================================================================
-type WorkerManager int
+// Keeps track of the connected workers, and which job each is in. It is used
+// by the worker connections, the heartbeat monitor, and every running job at
+// once, so all of its state is behind lock.
+type WorkerManager struct {
+	lock sync.RWMutex
+
+	// Store all the data related to workers.
+	workers map[msg.WorkerId]WorkerMetadata
+
+	// The workers currently handed out to a running job. A worker is in at
+	// most one job at a time, and is removed from here when its job finishes.
+	selected map[msg.WorkerId]bool
 
-func (wm *WorkerManager) Initialize(serviceAddr string) {
-	// Initialize data structures.
-	WorkerData = make(map[msg.WorkerId]WorkerMetadata)
-	LastSelectedWorkers = make(map[msg.WorkerId]bool)
+	subscribers []chan WorkerEvent
+
+	// How many times a worker joined the pool of idle workers, by connecting
+	// or by being released by its job.
+	joins int
+
+	listener net.Listener
+	closing  bool // Shutting down; no more workers are accepted
+}
 
+func NewWorkerManager() *WorkerManager {
+	return &WorkerManager{
+		workers:  make(map[msg.WorkerId]WorkerMetadata),
+		selected: make(map[msg.WorkerId]bool),
+	}
+}
+
+// Listens for workers at serviceAddr. If tlsConfig is not nil, workers must
+// connect over TLS with a certificate for the WorkerId they claim.
+func (wm *WorkerManager) Initialize(serviceAddr string, tlsConfig *msg.TLS) {
 	// Create the worker service.
-	workerListener, err := net.Listen("tcp", serviceAddr)
+	workerListener, err := tlsConfig.Listen(serviceAddr)
 	checkErr(err)
 	fmt.Println("Listening for Workers at %v", serviceAddr)
-	go handleWorkers(workerListener.(*net.TCPListener))
+	wm.lock.Lock()
+	wm.listener = workerListener
+	wm.lock.Unlock()
+	go wm.handleWorkers(workerListener)
+	go wm.monitorWorkers()
+	if limits.StatsInterval > 0 {
+		go logQueueStats(wm, limits.StatsInterval)
+	}
 }
 
-// TODO
-// While it's true that we could just reque our request, that would require
-// reassigning all workers, and have them read from the database, after each
-// checkpoint, even if the set of workers hasn't changed.
-func (wm *WorkerManager) AnyJoined() bool {
-	return true
+// Subscribe returns a channel that gets every WorkerEvent from now on. If the
+// subscriber falls more than size events behind, the newer events are
+// dropped for it.
+func (wm *WorkerManager) Subscribe(size int) <-chan WorkerEvent {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	events := make(chan WorkerEvent, size)
+	wm.subscribers = append(wm.subscribers, events)
+	return events
+}
+
+// Must be called with lock held, so that every subscriber sees the events in
+// the order they happened.
+func (wm *WorkerManager) publish(event WorkerEvent) {
+	log.Printf("Worker %v: %v\n", event.WorkerId, WorkerEventStr(event.Type))
+	for _, events := range wm.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Dropping worker event %v for a slow subscriber\n", WorkerEventStr(event.Type))
+		}
+	}
+}
+
+// The number of times a worker has joined the pool of idle workers so far.
+func (wm *WorkerManager) Joins() int {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	return wm.joins
+}
+
+// Whether any worker joined the pool of idle workers after Joins returned
+// since. A running job checks this at its checkpoints, so that it only
+// redistributes onto new workers when there are some.
+func (wm *WorkerManager) AnyJoined(since int) bool {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	return wm.joins > since
+}
+
+// Whether the worker can be given to a new job. Must be called with lock held.
+func (wm *WorkerManager) isIdle(data WorkerMetadata) bool {
+	return !wm.selected[data.WorkerId] && data.Conn != nil && data.State == Healthy && !data.Draining
+}
+
+// The number of connected, healthy workers that are not assigned to any job.
+func (wm *WorkerManager) NumIdleWorkers() int {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	idle := 0
+	for _, data := range wm.workers {
+		if wm.isIdle(data) {
+			idle++
+		}
+	}
+	return idle
 }
 
-func (wm *WorkerManager) SelectWorkers() []msg.WorkerId {
-	// if (len(LastSelectedWorkers) != 0) {
-	// log.Fatal("SelectWorkers() called with populated LastSelectedWorkers")
-	// }
+// Selects up to max idle workers and marks them as busy. They stay out of the
+// pool until CloseWorkers is called on them.
+func (wm *WorkerManager) SelectWorkers(max int) []msg.WorkerId {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
 
 	var selectedWorkers []msg.WorkerId
-	for key := range WorkerData {
-		selectedWorkers = append(selectedWorkers, key)
-		LastSelectedWorkers[key] = true
+	for key, data := range wm.workers {
+		if len(selectedWorkers) >= max {
+			break
+		}
+		if wm.isIdle(data) {
+			selectedWorkers = append(selectedWorkers, key)
+			wm.selected[key] = true
+		}
 	}
 
 	return selectedWorkers
 }
 
-func Writer(worker WorkerMetadata) {
-	defer capturePanic(worker.WorkerId)
+// The addresses at which the given workers accept vertex messages from each other.
+func (wm *WorkerManager) WorkerAddresses(workers []msg.WorkerId) map[msg.WorkerId]string {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	addresses := make(map[msg.WorkerId]string)
+	for _, worker := range workers {
+		addresses[worker] = wm.workers[worker].Address
+	}
+	return addresses
+}
+
+// Whether all the given workers have the capability.
+func (wm *WorkerManager) AllCapable(workers []msg.WorkerId, capability string) bool {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	for _, worker := range workers {
+		if !msg.HasCapability(wm.workers[worker].Capabilities, capability) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends the messages queued for the worker, as far as its credits allow, and
+// a heartbeat every msg.HeartbeatInterval, for as long as the connection lasts.
+func (wm *WorkerManager) Writer(worker WorkerMetadata) {
+	defer wm.capturePanic(worker.WorkerId, worker.Conn)
+
+	heartbeat := time.NewTicker(msg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	flow := worker.flow
 
 	for {
+		// Without credits, the messages wait in the queue until the worker
+		// returns some
+		cMsgOut := worker.cMsgOut
+		if flow.blocked() {
+			cMsgOut = nil
+		}
 		select {
-		case msg := <-worker.cMsgOut:
-			SendMessage(worker.Conn, msg)
+		case fs := <-cMsgOut:
+			SendMessage(worker.Conn, worker.codec, fs)
+			if flow.sendWindow > 0 {
+				flow.add(-1)
+			}
+		case credits := <-flow.returned:
+			flow.add(credits)
+		case credits := <-flow.grants:
+			SendMessage(worker.Conn, worker.codec, msg.NewCredit(credits, worker.WorkerId))
+		case <-heartbeat.C:
+			SendMessage(worker.Conn, worker.codec, msg.NewHeartbeat(worker.WorkerId))
 		case <-worker.cQuit:
 			log.Printf("Writer %v terminating\n", worker.WorkerId)
 			return
@@ -85,53 +352,84 @@ func Writer(worker WorkerMetadata) {
 	}
 }
 
-func Reader(workerId msg.WorkerId, conn *net.TCPConn) {
-	defer capturePanic(workerId)
+// Passes the worker's messages on to its job, and returns credits to the
+// worker as it does.
+func (wm *WorkerManager) Reader(worker WorkerMetadata) {
+	workerId, conn, flow := worker.WorkerId, worker.Conn, worker.flow
+	defer wm.capturePanic(workerId, conn)
 
-	log.Printf("Reader() %v started conn: %v\n", workerId, conn)
+	log.Printf("Reader() %v started conn: %v\n", workerId, conn.RemoteAddr())
 	// reader := bufio.NewReader(conn)
+	passedOn := 0
 	for {
-		msg := ReadMessage(conn)
-		log.Printf("Reader() %v received message %v\n", workerId, msg)
-
-		// LOCK
-		for {
-			workerData, ok := WorkerData[workerId]
-			if !ok {
-				log.Printf("Reader read for non-existent worker %v\n", workerId)
+		fw := ReadMessage(conn, worker.codec)
+		wm.heardFrom(workerId, conn)
+		if isHeartbeat(fw) {
+			continue
+		}
+		if msg.IsInternal(fw.Type) {
+			log.Printf("Reader() %v, dropping internal message %v from the network\n", workerId, msg.TypeStr(fw.Type))
+			continue
+		}
+		if fw.Type == msg.Credit {
+			select {
+			case flow.returned <- fw.Credits:
+			case <-worker.cQuit:
 				return
-			} else if workerData.cMsgIn == nil {
-				log.Printf("Reader() %v, no cMsgIn\n", workerId)
-			} else {
-				workerData.cMsgIn <- msg
-				break
+			}
+			continue
+		}
+		log.Printf("Reader() %v received message %v\n", workerId, fw)
+
+		wm.lock.RLock()
+		workerData, ok := wm.workers[workerId]
+		wm.lock.RUnlock()
+		if !ok {
+			log.Printf("Reader read for non-existent worker %v\n", workerId)
+			return
+		} else if workerData.job == nil || !workerData.job.deliver(fw) {
+			// Left over from a job that has finished
+			log.Printf("Reader() %v, no job, dropping %v\n", workerId, msg.TypeStr(fw.Type))
+		}
+
+		// Once the worker has used up half of its window, let it send that
+		// many more
+		if flow.recvWindow > 0 {
+			passedOn++
+			if passedOn >= (flow.recvWindow+1)/2 {
+				select {
+				case flow.grants <- passedOn:
+				case <-worker.cQuit:
+					return
+				}
+				passedOn = 0
 			}
 		}
 	}
 }
 
-func (wm *WorkerManager) PrepareWorkers(workers []msg.WorkerId, cIn chan msg.FromWorker) {
-	// TODO: acquire lock
+// Attaches the workers to the job with the given inbox.
+func (wm *WorkerManager) PrepareWorkers(workers []msg.WorkerId, inbox *jobInbox) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
 	for _, worker := range workers {
-		data, ok := WorkerData[worker]
+		data, ok := wm.workers[worker]
 		if !ok {
 			log.Printf("Preparing a non-existent worker.\n")
 		} else {
-			data.cMsgIn = cIn
-			data.cMsgOut = make(chan msg.FromServer, 1000)
-			data.cQuit = make(chan int)
-			WorkerData[worker] = data
-			go Writer(data)
-			log.Printf("Worker prepared %v\n", data)
+			data.job = inbox
+			wm.workers[worker] = data
+			log.Printf("Worker prepared %v\n", data.WorkerId)
 		}
 	}
 }
 
-// TODO:
-func capturePanic(workerId msg.WorkerId) {
+// Recovers from a failure on the worker's connection conn.
+func (wm *WorkerManager) capturePanic(workerId msg.WorkerId, conn net.Conn) {
 	if r := recover(); r != nil {
 		log.Printf("Recovered %v\n", r)
-		DeleteWorker(workerId)
+		wm.disconnected(workerId, conn)
 		// var ok bool
 		// _, ok = r.(error)
 		// if !ok {
@@ -140,125 +438,485 @@ func capturePanic(workerId msg.WorkerId) {
 	}
 }
 
-func (wm *WorkerManager) SendMessageToWorker(msg msg.FromServer) {
-	defer capturePanic(msg.DstWorker)
+// Handles a lost connection to a worker. An idle worker is deleted straight
+// away. A worker in a running job gets rejoinGrace to reconnect, so that a
+// transient network failure doesn't cost the job its worker.
+// Failures on a connection the worker has already replaced are ignored.
+func (wm *WorkerManager) disconnected(workerId msg.WorkerId, conn net.Conn) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	data, ok := wm.workers[workerId]
+	if !ok || data.Conn == nil || data.Conn != conn {
+		return
+	}
+	conn.Close()
+	close(data.cQuit)
+
+	if !wm.selected[workerId] {
+		data.Conn = nil
+		wm.removed(data)
+		return
+	}
+
+	log.Printf("Worker %v disconnected, waiting %v for it to rejoin\n", workerId, rejoinGrace)
+	data.Conn = nil
+	wm.workers[workerId] = data
+	wm.publish(WorkerEvent{WorkerDisconnected, workerId})
+	time.AfterFunc(rejoinGrace, func() {
+		wm.lock.Lock()
+		defer wm.lock.Unlock()
+		if data, ok := wm.workers[workerId]; ok && data.Conn == nil {
+			log.Printf("Worker %v did not rejoin.\n", workerId)
+			wm.removed(data)
+		}
+	})
+}
+
+// Removes a worker that is gone for good. If it was in a running job, the job
+// is told straight away rather than waiting for a timeout.
+// Must be called with lock held.
+func (wm *WorkerManager) removed(data WorkerMetadata) {
+	log.Printf("Deleting worker %v\n", data.WorkerId)
+	if data.Conn != nil {
+		data.Conn.Close()
+		close(data.cQuit)
+	}
+	delete(wm.workers, data.WorkerId)
+	wm.publish(WorkerEvent{WorkerRemoved, data.WorkerId})
+
+	if wm.selected[data.WorkerId] && data.job != nil {
+		go data.job.deliver(msg.FromWorker{Type: msg.WorkerDied, SrcWorker: data.WorkerId})
+	}
+}
+
+// Records that a message arrived from the worker on conn.
+func (wm *WorkerManager) heardFrom(workerId msg.WorkerId, conn net.Conn) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	data, ok := wm.workers[workerId]
+	if !ok || data.Conn != conn {
+		return
+	}
+	if data.State != Healthy {
+		wm.publish(WorkerEvent{WorkerRecovered, workerId})
+	}
+	data.LastSeen = time.Now()
+	data.State = Healthy
+	wm.workers[workerId] = data
+}
+
+func isHeartbeat(fw msg.FromWorker) bool {
+	return fw.Type == msg.Heartbeat
+}
 
-	// TODO: acquire lock
-	workerData, ok := WorkerData[msg.DstWorker]
+// Periodically checks when each worker was last heard from.
+func (wm *WorkerManager) monitorWorkers() {
+	for range time.Tick(msg.HeartbeatInterval) {
+		wm.checkHeartbeats(time.Now())
+	}
+}
+
+// Marks workers that have been silent for too long as Suspect, or as Dead.
+// Disconnected workers are left to the rejoin grace period.
+func (wm *WorkerManager) checkHeartbeats(now time.Time) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	for workerId, data := range wm.workers {
+		if data.Conn == nil {
+			continue
+		}
+		silence := now.Sub(data.LastSeen)
+		if silence > deadAfter {
+			log.Printf("Worker %v silent for %v: %v\n", workerId, silence, WorkerStateStr(Dead))
+			data.State = Dead
+			wm.removed(data)
+		} else if silence > suspectAfter && data.State == Healthy {
+			log.Printf("Worker %v silent for %v: %v\n", workerId, silence, WorkerStateStr(Suspect))
+			data.State = Suspect
+			wm.workers[workerId] = data
+			wm.publish(WorkerEvent{WorkerSuspected, workerId})
+		}
+	}
+}
+
+// Queues a message for its worker, waiting while the worker's queue is full.
+// It gives up if the worker's connection goes away meanwhile: the job rolls
+// back if the worker rejoins, and hears that it died if it doesn't.
+func (wm *WorkerManager) SendMessageToWorker(msg msg.FromServer) {
+	wm.lock.RLock()
+	workerData, ok := wm.workers[msg.DstWorker]
+	wm.lock.RUnlock()
 	if ok == false {
 		log.Printf("Sending message %v non-existent worker.\n", msg)
-	} else {
-		workerData.cMsgOut <- msg
+		return
+	}
+
+	select {
+	case workerData.cMsgOut <- msg:
+	default:
+		if workerData.Conn == nil {
+			// Nobody is draining the queue until the worker rejoins, and the
+			// job rolls back when it does, so don't block the job on it.
+			log.Printf("Dropping message %v for disconnected worker.\n", msg)
+			return
+		}
+		select {
+		case workerData.cMsgOut <- msg:
+		case <-workerData.cQuit:
+			log.Printf("Dropping message %v, worker connection closed.\n", msg)
+		}
 	}
 }
 
+// Detaches the given workers from their job and returns them to the pool of
+// idle workers.
 func (wm *WorkerManager) CloseWorkers(workers []msg.WorkerId) {
-	// Since the superstep is done, we want to kill the listener processes we created above.
-	log.Println("work(): deleting workers.")
+	log.Println("CloseWorkers(): releasing workers.")
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
 	for _, worker := range workers {
-		data, ok := WorkerData[worker]
+		data, ok := wm.workers[worker]
+		delete(wm.selected, worker)
 		if !ok {
-			log.Println("work(): deleting worker doesn't exist.")
-		} else {
-			data.cQuit <- 1
+			log.Println("CloseWorkers(): released worker doesn't exist.")
+			continue
+		}
+		data.job = nil
+		wm.workers[worker] = data
+		if data.Draining {
+			wm.publish(WorkerEvent{WorkerDrained, worker})
+		} else if data.Conn != nil {
+			wm.joins++
+		}
+
+		// Don't send what the job left behind to the worker's next job.
+		for drained := false; !drained; {
+			select {
+			case <-data.cMsgOut:
+			default:
+				drained = true
+			}
+		}
+	}
+}
+
+// Takes a worker out of service: it is given no new jobs, and if it is in a
+// job, the job is asked to move its partitions to its other workers at the
+// next barrier, and to release it. Returns whether the worker is in a job.
+func (wm *WorkerManager) Drain(workerId msg.WorkerId) (bool, error) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	data, ok := wm.workers[workerId]
+	if !ok {
+		return false, fmt.Errorf("no worker %v", workerId)
+	}
+	inJob := wm.selected[workerId] && data.job != nil
+	if data.Draining {
+		return inJob, nil
+	}
+	data.Draining = true
+	wm.workers[workerId] = data
+	wm.publish(WorkerEvent{WorkerDraining, workerId})
+
+	if inJob {
+		go data.job.control(msg.FromWorker{Type: msg.Drain, SrcWorker: workerId})
+	} else {
+		wm.publish(WorkerEvent{WorkerDrained, workerId})
+	}
+	return inJob, nil
+}
+
+// The status of every worker, ordered by WorkerId.
+func (wm *WorkerManager) WorkerStatuses() []msg.WorkerStatus {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	var statuses []msg.WorkerStatus
+	for _, data := range wm.workers {
+		state := WorkerStateStr(data.State)
+		if data.Conn == nil {
+			state = "Disconnected"
+		}
+		statuses = append(statuses, msg.WorkerStatus{
+			WorkerId: data.WorkerId,
+			Address:  data.Address,
+			State:    state,
+			Busy:     wm.selected[data.WorkerId],
+			Draining: data.Draining,
+		})
+	}
+	sort.Sort(statusesById(statuses))
+	return statuses
+}
+
+// statusesById implements sort.Interface, ordering the statuses by worker
+type statusesById []msg.WorkerStatus
+
+func (bw statusesById) Len() int {
+	return len(bw)
+}
+func (bw statusesById) Swap(i, j int) {
+	bw[i], bw[j] = bw[j], bw[i]
+}
+func (bw statusesById) Less(i, j int) bool {
+	return bw[i].WorkerId < bw[j].WorkerId
+}
+
+// Stops accepting workers, asks the connected ones to disconnect, and waits
+// up to timeout for them to. They go on to reconnect to whichever server
+// leads next. Returns whether they all disconnected in time.
+func (wm *WorkerManager) Shutdown(timeout time.Duration) bool {
+	wm.lock.Lock()
+	wm.closing = true
+	if wm.listener != nil {
+		wm.listener.Close()
+	}
+	for _, data := range wm.workers {
+		if data.Conn == nil {
+			continue
+		}
+		if data.protocol < msg.DisconnectVersion {
+			data.Conn.Close()
+			continue
+		}
+		select {
+		case data.cMsgOut <- msg.NewDisconnect(data.WorkerId):
+		default:
+			// Too far behind to get the message any time soon
+			data.Conn.Close()
+		}
+	}
+	wm.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for wm.numConnected() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("%v workers still connected after %v\n", wm.numConnected(), timeout)
+			return false
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
+	return true
+}
 
-	// Create a new map here,
-	LastSelectedWorkers = make(map[msg.WorkerId]bool)
+func (wm *WorkerManager) isClosing() bool {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	return wm.closing
+}
+
+func (wm *WorkerManager) numConnected() int {
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+
+	connected := 0
+	for _, data := range wm.workers {
+		if data.Conn != nil {
+			connected++
+		}
+	}
+	return connected
 }
 
 //============================================================
-func handleWorkers(l *net.TCPListener) {
+func (wm *WorkerManager) handleWorkers(l net.Listener) {
 	for {
 		conn, err := l.Accept()
+		if err != nil && wm.isClosing() {
+			return
+		}
 		checkErr(err)
-		go handleWorkerConn(conn)
+		go wm.handleWorkerConn(conn)
 	}
 }
 
 //====================================================================
-func handleWorkerConn(conn net.Conn) {
+func (wm *WorkerManager) handleWorkerConn(conn net.Conn) {
 	var wcm msg.WorkerConnectionMsg
 	var resp msg.WorkerConnectionResp
+	var writer WorkerMetadata
+	var rejoinedJob *jobInbox
 
-	var inBuf [512]byte
-	n, err := conn.Read(inBuf[0:])
-	checkErr(err)
-	Logger.UnpackReceive("Worker-Conn", inBuf[0:n], &wcm)
+	if wm.isClosing() {
+		// Let it find the next leader instead
+		conn.Close()
+		return
+	}
+	inBuf, err := msg.ReadFrame(conn)
 	if err == nil {
-		// Refuse a connection if this worker in the current selection.
-		_, ok := LastSelectedWorkers[wcm.WorkerId] // TODO: lock
-		if ok {
-			log.Printf("Refusing conn from Worker %v. Already in current selection.\n", wcm.WorkerId)
-			resp.WorkerId = wcm.WorkerId
-			resp.IsAccepted = false
-		} else {
-			// Since this worker is not in the current selection, we can add it to map.
-			var workerData WorkerMetadata
-			workerData.WorkerId = wcm.WorkerId
-			workerData.Conn = conn
-			WorkerData[wcm.WorkerId] = workerData
-			resp.IsAccepted = true
-			tcpconn := conn.(*net.TCPConn)
-			go Reader(wcm.WorkerId, tcpconn)
-			log.Printf("Added worker %v.\n", workerData.WorkerId)
-		}
+		err = msg.HandshakeCodec.Decode(inBuf, &wcm)
+	}
+	if err != nil {
+		log.Printf("Could not read connection message from %v (a worker older than protocol version %v?): %v\n",
+			conn.RemoteAddr(), msg.MinProtocolVersion, err)
+		conn.Close()
+		return
+	}
+	// The rest of the connection is encoded the way the worker asked for
+	codec, codecErr := msg.CodecByName(wcm.Codec)
+	if codecErr == nil && wcm.VectorClocks {
+		codec = msg.LoggingCodec{Logger: Logger}
+	}
+	refusal := msg.CheckWorkerProtocol(wcm)
+	if refusal == nil {
+		refusal = codecErr
+	}
+	if refusal == nil {
+		refusal = checkWorkerCert(conn, wcm.WorkerId)
+	}
+	if wcm.WorkerId != "" && refusal == nil {
+		writer, rejoinedJob, refusal = wm.joined(wcm, conn, codec)
+	}
+	resp.ProtocolVersion = msg.ProtocolVersion
+	if wcm.WorkerId != "" && refusal != nil {
+		log.Printf("Refusing worker %v and closing Connection: %v\n", wcm.WorkerId, refusal)
+		resp.WorkerId = wcm.WorkerId
+		resp.IsAccepted = false
+		resp.Reason = refusal.Error()
+		resp.Retry = refusal == errDuplicateWorker || refusal == errWorkerInJob
+	} else if wcm.WorkerId != "" {
+		resp.WorkerId = wcm.WorkerId
+		resp.IsAccepted = true
+		resp.Window = writer.flow.recvWindow
+		resp.RejoinToken = writer.rejoinToken
+		go wm.Reader(writer)
+		log.Printf("Added worker %v.\n", writer.WorkerId)
 	} else {
 		log.Println("Worker did not send a WorkerConnectionMsg as its first msg. Refusing and closing Connection.")
 		resp.WorkerId = "Badconnectionparam"
 		resp.IsAccepted = false
+		resp.Reason = "no worker id"
 	}
 
-	outBuf := Logger.PrepareSend("Sending-Resp-To-Worker", resp)
-	n, err = conn.Write(outBuf)
-	checkErr(err)
+	outBuf, err := msg.HandshakeCodec.Encode(resp)
+	if err == nil {
+		err = msg.WriteFrame(conn, outBuf)
+	}
+	if err != nil {
+		log.Printf("Could not send connection response to worker %v: %v\n", wcm.WorkerId, err)
+		wm.disconnected(wcm.WorkerId, conn)
+		return
+	}
 
-	if n != len(outBuf) || err != nil {
-		DeleteWorker(wcm.WorkerId)
+	if !resp.IsAccepted {
+		conn.Close()
+		return
+	}
+	// Only start writing once the worker has its response.
+	go wm.Writer(writer)
+	if rejoinedJob != nil {
+		log.Printf("Worker %v rejoined its running job.\n", wcm.WorkerId)
+		rejoinedJob.deliver(msg.FromWorker{Type: msg.Rejoined, SrcWorker: wcm.WorkerId})
 	}
 	return
 }
 
-func DeleteWorker(workerId msg.WorkerId) {
-	// TODO: lock
-	log.Printf("Deleting worker %v\n", workerId)
-	delete(WorkerData, workerId)
+// Records a worker that connected with wcm. If it is rejoining its running
+// job, returns the job's inbox; its new writer picks up the queue of messages
+// the job left for it. A connection can only take over the id of a healthy
+// worker, or of one in a job, if it has the rejoin token the worker was
+// given; otherwise it is refused.
+func (wm *WorkerManager) joined(wcm msg.WorkerConnectionMsg, conn net.Conn,
+	codec msg.Codec) (WorkerMetadata, *jobInbox, error) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	workerData, exists := wm.workers[wcm.WorkerId]
+	if exists && wcm.RejoinToken != workerData.rejoinToken {
+		if workerData.State == Healthy {
+			return WorkerMetadata{}, nil, errDuplicateWorker
+		}
+		if wm.selected[wcm.WorkerId] && workerData.job != nil {
+			return WorkerMetadata{}, nil, errWorkerInJob
+		}
+	}
+	if exists && workerData.Conn != nil {
+		// The worker reconnected before we noticed that its old
+		// connection failed. Don't let the old one be used any more.
+		log.Printf("Worker %v reconnected, closing its old connection.\n", wcm.WorkerId)
+		workerData.Conn.Close()
+		close(workerData.cQuit)
+	}
+	if !exists {
+		workerData.rejoinToken = newRejoinToken()
+	}
+	workerData.WorkerId = wcm.WorkerId
+	workerData.Address = wcm.WorkerAddress
+	workerData.Conn = conn
+	workerData.codec = codec
+	workerData.Capabilities = wcm.Capabilities
+	workerData.flow = negotiateFlow(wcm)
+	workerData.protocol = wcm.ProtocolVersion
+	workerData.State = Healthy
+	workerData.LastSeen = time.Now()
+	workerData.cQuit = make(chan int)
+	if workerData.cMsgOut == nil {
+		workerData.cMsgOut = make(chan msg.FromServer, limits.WorkerQueue)
+	}
+	wm.workers[wcm.WorkerId] = workerData
+
+	if wm.selected[wcm.WorkerId] && workerData.job != nil {
+		wm.publish(WorkerEvent{WorkerRejoined, wcm.WorkerId})
+		return workerData, workerData.job, nil
+	}
+	wm.joins++
+	wm.publish(WorkerEvent{WorkerJoined, wcm.WorkerId})
+	return workerData, nil, nil
 }
 
-//====================================================================
-// Worker TCP Service
-// TODO: We should be resilient to connection failures in Send() and Read(). At the moment we fail straight away.
-func SendMessage(conn net.Conn, message msg.FromServer) {
-	log.Printf("SendMessage() to addr: %v Worker:%v\n", conn.RemoteAddr().String(), message.DstWorker)
-	outBuf := Logger.PrepareSend(fmt.Sprintf("Sending-%v-Message", msg.TypeStr(message.Type)), message)
-	// log.Printf("%v\n", outBuf)
-	var msgSize uint16
-	msgSize = uint16(len(outBuf))
-	sizeBuf := make([]byte, 2)
-	binary.LittleEndian.PutUint16(sizeBuf, uint16(msgSize))
-	outBuf = append(sizeBuf, outBuf...)
-	size, err := conn.Write(outBuf)
-	checkErr(err)
-	if size != len(outBuf) {
-		log.Fatal("size of message out != size written")
+// Refuses a worker until the one connected with its id goes away, so the
+// worker is told to try again.
+var errDuplicateWorker = errors.New("a healthy worker is already connected with this id")
+
+// Refuses a worker until the job that the worker with its id is in lets the
+// id go.
+var errWorkerInJob = errors.New("a worker in a running job has this id")
+
+// A token that only the worker it is given to knows.
+func newRejoinToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Panicf("Could not make a rejoin token: %v", err)
 	}
+	return hex.EncodeToString(token)
 }
 
-// func ReadMessage(reader *bufio.Reader) msg.FromWorker {
-func ReadMessage(conn *net.TCPConn) msg.FromWorker {
-	var msg msg.FromWorker
-	var inBuf [512]byte
+// Over TLS, a worker can only connect as the worker its certificate is for.
+func checkWorkerCert(conn net.Conn, workerId msg.WorkerId) error {
+	certName, err := msg.CertName(conn)
+	if err != nil {
+		return err
+	}
+	if certName != "" && certName != msg.WorkerCertName(workerId) {
+		return fmt.Errorf("certificate is for %v, not %v", certName, msg.WorkerCertName(workerId))
+	}
+	return nil
+}
 
-	var sizeBuf [2]byte
-	_, sizeErr := conn.Read(sizeBuf[:])
-	// log.Println("Size Buf contains:", sizeBuf)
-	checkErr(sizeErr)
-	msgSize := binary.LittleEndian.Uint16(sizeBuf[:])
+//====================================================================
+// Worker TCP Service
+// Both panic on a connection failure, which the Reader and Writer recover from
+// by disconnecting the worker.
+func SendMessage(conn net.Conn, codec msg.Codec, message msg.FromServer) {
+	if message.Type != msg.Heartbeat {
+		log.Printf("SendMessage() to addr: %v Worker:%v\n", conn.RemoteAddr().String(), message.DstWorker)
+	}
+	outBuf, err := codec.Encode(message)
+	checkErr(err)
+	err = msg.WriteFrame(conn, outBuf)
+	checkErr(err)
+}
 
-	n, err := conn.Read(inBuf[0:msgSize])
-	// log.Println("WMAN: Reading", n, "bytes from connection.")
+func ReadMessage(conn net.Conn, codec msg.Codec) msg.FromWorker {
+	var fw msg.FromWorker
+	inBuf, err := msg.ReadFrame(conn)
+	checkErr(err)
+	err = codec.Decode(inBuf, &fw)
 	checkErr(err)
-	Logger.UnpackReceive("Reading-Message", inBuf[0:n], &msg)
-	return msg
+	return fw
 }
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+var t *testing.T
+
+func test(summary string, expect, actual interface{}) {
+	if !reflect.DeepEqual(expect, actual) {
+		_, _, line, _ := runtime.Caller(1)
+		t.Errorf("Line %d:: %s: Expected %v, Actual %v", line, summary, expect, actual)
+	}
+}
+
+// The worker end of a connection to the WorkerManager
+type fakeWorker struct {
+	id    msg.WorkerId
+	conn  net.Conn
+	codec msg.Codec
+	token string // The rejoin token the server gave it
+}
+
+// The connection message of a current worker with the given id
+func workerConnectionMsg(id msg.WorkerId) msg.WorkerConnectionMsg {
+	return msg.WorkerConnectionMsg{
+		WorkerId:        id,
+		WorkerAddress:   "peer-" + string(id),
+		Codec:           msg.DefaultCodec,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.Capabilities,
+	}
+}
+
+// Connects to the WorkerManager with wcm, and returns the connection and the
+// server's response.
+func dialWorker(wm *WorkerManager, wcm msg.WorkerConnectionMsg) (net.Conn, msg.WorkerConnectionResp) {
+	client, server := net.Pipe()
+	go wm.handleWorkerConn(server)
+
+	outBuf, err := msg.HandshakeCodec.Encode(wcm)
+	checkErr(err)
+	checkErr(msg.WriteFrame(client, outBuf))
+	var resp msg.WorkerConnectionResp
+	inBuf, err := msg.ReadFrame(client)
+	checkErr(err)
+	checkErr(msg.HandshakeCodec.Decode(inBuf, &resp))
+	return client, resp
+}
+
+// Connects a worker with the given id, and keeps reading what the server
+// sends it until the connection is closed, or the server asks it to
+// disconnect.
+func connectWorker(wm *WorkerManager, id msg.WorkerId) *fakeWorker {
+	return reconnectWorker(wm, workerConnectionMsg(id))
+}
+
+// Connects a worker with wcm, like connectWorker.
+func reconnectWorker(wm *WorkerManager, wcm msg.WorkerConnectionMsg) *fakeWorker {
+	client, resp := dialWorker(wm, wcm)
+	if !resp.IsAccepted {
+		panic(resp.Reason)
+	}
+
+	codec, _ := msg.CodecByName(msg.DefaultCodec)
+	go func() {
+		for {
+			inBuf, err := msg.ReadFrame(client)
+			if err != nil {
+				return
+			}
+			var fs msg.FromServer
+			if codec.Decode(inBuf, &fs) == nil && fs.Type == msg.Disconnect {
+				client.Close()
+				return
+			}
+		}
+	}()
+	return &fakeWorker{wcm.WorkerId, client, codec, resp.RejoinToken}
+}
+
+// Connects worker again, with the rejoin token it was given, as a worker
+// does after it loses its connection.
+func rejoinWorker(wm *WorkerManager, worker *fakeWorker) *fakeWorker {
+	wcm := workerConnectionMsg(worker.id)
+	wcm.RejoinToken = worker.token
+	return reconnectWorker(wm, wcm)
+}
+
+func (fw *fakeWorker) send(m msg.FromWorker) {
+	outBuf, err := fw.codec.Encode(m)
+	checkErr(err)
+	checkErr(msg.WriteFrame(fw.conn, outBuf))
+}
+
+// Waits for the next event, failing if it takes too long.
+func nextEvent(events <-chan WorkerEvent) WorkerEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Errorf("No worker event")
+		return WorkerEvent{}
+	}
+}
+
+// Waits for a message from the workers to reach the job.
+func nextJobMessage(inbox *jobInbox) msg.FromWorker {
+	select {
+	case fw := <-inbox.cIn:
+		return fw
+	case <-time.After(5 * time.Second):
+		t.Errorf("No message for the job")
+		return msg.FromWorker{}
+	}
+}
+
+func TestWorkerEvents(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	worker := connectWorker(wm, "w1")
+	test("joined", WorkerEvent{WorkerJoined, "w1"}, nextEvent(events))
+	test("idle", 1, wm.NumIdleWorkers())
+
+	wm.checkHeartbeats(time.Now().Add(suspectAfter + time.Second))
+	test("suspected", WorkerEvent{WorkerSuspected, "w1"}, nextEvent(events))
+	test("suspect workers are not idle", 0, wm.NumIdleWorkers())
+
+	worker.send(msg.FromWorker{Type: msg.Heartbeat, SrcWorker: "w1"})
+	test("recovered", WorkerEvent{WorkerRecovered, "w1"}, nextEvent(events))
+	test("idle again", 1, wm.NumIdleWorkers())
+
+	wm.checkHeartbeats(time.Now().Add(deadAfter + time.Second))
+	test("removed", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	test("gone", 0, wm.NumIdleWorkers())
+}
+
+func TestWorkerRejoinsJob(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	worker := connectWorker(wm, "w1")
+	nextEvent(events)
+	selected := wm.SelectWorkers(1)
+	test("selected", []msg.WorkerId{"w1"}, selected)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+
+	worker.send(msg.FromWorker{Type: msg.Done, SrcWorker: "w1"})
+	test("message for the job", msg.Done, nextJobMessage(inbox).Type)
+
+	worker.conn.Close()
+	test("disconnected", WorkerEvent{WorkerDisconnected, "w1"}, nextEvent(events))
+	rejoinWorker(wm, worker)
+	test("rejoined", WorkerEvent{WorkerRejoined, "w1"}, nextEvent(events))
+	test("job told", msg.Rejoined, nextJobMessage(inbox).Type)
+
+	// The job hears about its dead workers; once it is over, they are dropped
+	wm.checkHeartbeats(time.Now().Add(deadAfter + time.Second))
+	test("removed", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	test("job told of death", msg.WorkerDied, nextJobMessage(inbox).Type)
+	inbox.close()
+	test("after the job", false, inbox.deliver(msg.FromWorker{Type: msg.Done}))
+	wm.CloseWorkers(selected)
+}
+
+// Workers join, run jobs, and die all at once.
+func TestConcurrentWorkers(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	const numWorkers = 40
+	events := wm.Subscribe(10 * numWorkers)
+
+	workers := make([]*fakeWorker, numWorkers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workers[i] = connectWorker(wm, msg.WorkerId(fmt.Sprintf("w%v", i)))
+		}(i)
+	}
+	wg.Wait()
+	test("all joined", numWorkers, wm.NumIdleWorkers())
+
+	// Jobs take workers while others are looking at them
+	jobs := make([][]msg.WorkerId, 4)
+	inboxes := make([]*jobInbox, len(jobs))
+	for j := range jobs {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			jobs[j] = wm.SelectWorkers(5)
+			inboxes[j] = newJobInbox(100)
+			wm.PrepareWorkers(jobs[j], inboxes[j])
+			wm.WorkerAddresses(jobs[j])
+			wm.AllCapable(jobs[j], msg.CapRecover)
+			wm.QueueStats()
+		}(j)
+	}
+	wg.Wait()
+	busy := make(map[msg.WorkerId]bool)
+	for _, job := range jobs {
+		test("job size", 5, len(job))
+		for _, worker := range job {
+			test("worker in one job", false, busy[worker])
+			busy[worker] = true
+		}
+	}
+	test("idle", numWorkers-20, wm.NumIdleWorkers())
+
+	// The workers of the jobs talk to them while the idle workers drop out
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker *fakeWorker) {
+			defer wg.Done()
+			if busy[worker.id] {
+				worker.send(msg.FromWorker{Type: msg.Done, SrcWorker: worker.id})
+			} else {
+				worker.conn.Close()
+			}
+		}(worker)
+	}
+	for j := range jobs {
+		for range jobs[j] {
+			test("message for the job", msg.Done, nextJobMessage(inboxes[j]).Type)
+		}
+	}
+	wg.Wait()
+
+	// And then the workers of the jobs die, as the jobs finish
+	wm.checkHeartbeats(time.Now().Add(deadAfter + time.Second))
+	for j := range jobs {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			for range jobs[j] {
+				test("job told of death", msg.WorkerDied, nextJobMessage(inboxes[j]).Type)
+			}
+			inboxes[j].close()
+			wm.CloseWorkers(jobs[j])
+		}(j)
+	}
+	wg.Wait()
+
+	counts := make(map[WorkerEventType]int)
+	for i := 0; i < 2*numWorkers; i++ {
+		counts[nextEvent(events).Type]++
+	}
+	test("joined events", numWorkers, counts[WorkerJoined])
+	test("removed events", numWorkers, counts[WorkerRemoved])
+	test("none left", 0, len(wm.QueueStats()))
+}
+
+func TestDrainWorker(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(20)
+
+	connectWorker(wm, "w1")
+	connectWorker(wm, "w2")
+	connectWorker(wm, "w3")
+	nextEvent(events)
+	nextEvent(events)
+	nextEvent(events)
+
+	// An idle worker is drained straight away
+	inJob, err := wm.Drain("w3")
+	test("drain error", nil, err)
+	test("idle", false, inJob)
+	test("draining", WorkerEvent{WorkerDraining, "w3"}, nextEvent(events))
+	test("drained", WorkerEvent{WorkerDrained, "w3"}, nextEvent(events))
+	test("not schedulable", 2, wm.NumIdleWorkers())
+
+	// A worker in a job waits for the job to release it
+	selected := wm.SelectWorkers(2)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+	inJob, err = wm.Drain(selected[0])
+	test("drain error", nil, err)
+	test("in job", true, inJob)
+	test("draining in job", WorkerEvent{WorkerDraining, selected[0]}, nextEvent(events))
+	select {
+	case fw := <-inbox.cControl:
+		test("job asked to drain", msg.FromWorker{Type: msg.Drain, SrcWorker: selected[0]}, fw)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Job not asked to drain")
+	}
+	wm.CloseWorkers(selected[:1])
+	test("released", WorkerEvent{WorkerDrained, selected[0]}, nextEvent(events))
+	test("still not schedulable", 0, wm.NumIdleWorkers())
+
+	statuses := wm.WorkerStatuses()
+	test("statuses", 3, len(statuses))
+	for _, status := range statuses {
+		test("draining "+string(status.WorkerId), status.WorkerId != selected[1], status.Draining)
+		test("busy "+string(status.WorkerId), status.WorkerId == selected[1], status.Busy)
+	}
+
+	_, err = wm.Drain("w4")
+	test("unknown worker", true, err != nil)
+}
+
+func TestShutdown(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	jobs := newRunningJobs()
+
+	connectWorker(wm, "w1")
+	connectWorker(wm, "w2")
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10)
+	test("job added", true, jobs.add(inbox))
+	wm.PrepareWorkers(selected, inbox)
+
+	// The job checkpoints and stops when it is asked to
+	go func() {
+		fw := <-inbox.cControl
+		test("job asked to stop", msg.Stop, fw.Type)
+		inbox.close()
+		wm.CloseWorkers(selected)
+		jobs.remove(inbox)
+	}()
+	test("jobs stopped", true, jobs.stop(5*time.Second))
+	test("no new jobs", false, jobs.add(newJobInbox(10)))
+
+	test("workers disconnected", true, wm.Shutdown(5*time.Second))
+	test("none left", 0, len(wm.WorkerStatuses()))
+}
+
+// A worker in a job that reconnects within rejoinGrace goes back to the same
+// job, and stays in it past the end of the grace period. One that doesn't
+// reconnect is removed once the grace period is over, and the job is told.
+func TestWorkerRejoinGrace(tee *testing.T) {
+	t = tee
+	saved := rejoinGrace
+	rejoinGrace = 300 * time.Millisecond
+	defer func() { rejoinGrace = saved }()
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	worker := connectWorker(wm, "w1")
+	nextEvent(events)
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+
+	worker.conn.Close()
+	test("disconnected", WorkerEvent{WorkerDisconnected, "w1"}, nextEvent(events))
+	test("not idle while away", 0, wm.NumIdleWorkers())
+
+	time.Sleep(rejoinGrace / 2)
+	worker = rejoinWorker(wm, worker)
+	test("rejoined", WorkerEvent{WorkerRejoined, "w1"}, nextEvent(events))
+	test("job told", msg.Rejoined, nextJobMessage(inbox).Type)
+
+	time.Sleep(rejoinGrace)
+	worker.send(msg.FromWorker{Type: msg.Done, SrcWorker: "w1"})
+	test("same job", msg.Done, nextJobMessage(inbox).Type)
+	select {
+	case event := <-events:
+		t.Errorf("Rejoined worker had event %v", WorkerEventStr(event.Type))
+	default:
+	}
+	test("still there", 1, len(wm.WorkerStatuses()))
+
+	// This time it stays away
+	worker.conn.Close()
+	test("disconnected again", WorkerEvent{WorkerDisconnected, "w1"}, nextEvent(events))
+	test("removed after grace", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	test("job told of death", msg.WorkerDied, nextJobMessage(inbox).Type)
+	test("gone", 0, len(wm.WorkerStatuses()))
+	inbox.close()
+	wm.CloseWorkers(selected)
+}
+
+// An idle worker that disconnects has no job to rejoin, and is removed at
+// once.
+func TestIdleWorkerDisconnects(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	worker := connectWorker(wm, "w1")
+	nextEvent(events)
+	worker.conn.Close()
+	test("removed", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	test("gone", 0, len(wm.WorkerStatuses()))
+}
+
+// A worker in a job that misses its heartbeats is suspected, but stays in the
+// job; once it has missed enough to be declared dead, the job is told.
+func TestWorkerMissesHeartbeats(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	connectWorker(wm, "w1")
+	nextEvent(events)
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+
+	wm.checkHeartbeats(time.Now().Add(suspectAfter / 2))
+	test("healthy", WorkerStateStr(Healthy), wm.WorkerStatuses()[0].State)
+	wm.checkHeartbeats(time.Now().Add(suspectAfter + time.Second))
+	test("suspected", WorkerEvent{WorkerSuspected, "w1"}, nextEvent(events))
+	test("suspect", WorkerStateStr(Suspect), wm.WorkerStatuses()[0].State)
+	select {
+	case fw := <-inbox.cIn:
+		t.Errorf("Job told %v about a suspect worker", fw)
+	default:
+	}
+
+	wm.checkHeartbeats(time.Now().Add(deadAfter + time.Second))
+	test("removed", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	test("job told of death", msg.FromWorker{Type: msg.WorkerDied, SrcWorker: "w1"}, nextJobMessage(inbox))
+	test("gone", 0, len(wm.WorkerStatuses()))
+	inbox.close()
+	wm.CloseWorkers(selected)
+}
+
+// Only the worker that was given the rejoin token can take over a healthy
+// worker's connection; anyone else with its id is refused.
+func TestDuplicateWorkerId(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	worker := connectWorker(wm, "w1")
+	nextEvent(events)
+	test("token", true, worker.token != "")
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10)
+	wm.PrepareWorkers(selected, inbox)
+
+	conn, resp := dialWorker(wm, workerConnectionMsg("w1"))
+	conn.Close()
+	test("refused without the token", false, resp.IsAccepted)
+	test("for now", true, resp.Retry)
+	wcm := workerConnectionMsg("w1")
+	wcm.RejoinToken = "guess"
+	conn, resp = dialWorker(wm, wcm)
+	conn.Close()
+	test("refused with the wrong token", false, resp.IsAccepted)
+	worker.send(msg.FromWorker{Type: msg.Done, SrcWorker: "w1"})
+	test("still connected", msg.Done, nextJobMessage(inbox).Type)
+
+	wcm.RejoinToken = worker.token
+	replacement := reconnectWorker(wm, wcm)
+	test("taken over", WorkerEvent{WorkerRejoined, "w1"}, nextEvent(events))
+	test("job told", msg.Rejoined, nextJobMessage(inbox).Type)
+	test("same token", worker.token, replacement.token)
+	replacement.send(msg.FromWorker{Type: msg.Done, SrcWorker: "w1"})
+	test("same job", msg.Done, nextJobMessage(inbox).Type)
+
+	// Nor can it take over a suspect worker in a job without the token
+	wm.checkHeartbeats(time.Now().Add(suspectAfter + time.Second))
+	test("suspected", WorkerEvent{WorkerSuspected, "w1"}, nextEvent(events))
+	conn, resp = dialWorker(wm, workerConnectionMsg("w1"))
+	conn.Close()
+	test("suspect refused without the token", false, resp.IsAccepted)
+	test("suspect refused for now", true, resp.Retry)
+	reconnectWorker(wm, wcm)
+	test("suspect rejoined", WorkerEvent{WorkerRejoined, "w1"}, nextEvent(events))
+	inbox.close()
+	wm.CloseWorkers(selected)
+
+	// Once out of the job, a suspect worker may have been restarted, losing
+	// its token
+	wm.checkHeartbeats(time.Now().Add(suspectAfter + time.Second))
+	test("suspected again", WorkerEvent{WorkerSuspected, "w1"}, nextEvent(events))
+	connectWorker(wm, "w1")
+	test("replaced", WorkerEvent{WorkerJoined, "w1"}, nextEvent(events))
+}
+
+// A worker from before flow control is never limited, never sent a Credit,
+// and never sent a Disconnect, which it wouldn't understand.
+func TestOldWorker(tee *testing.T) {
+	t = tee
+	wm := NewWorkerManager()
+	wcm := workerConnectionMsg("w1")
+	wcm.ProtocolVersion = 1
+	wcm.Capabilities = []string{msg.CapBatch, msg.CapPeers}
+	wcm.Window = 4
+	conn, resp := dialWorker(wm, wcm)
+	test("accepted", true, resp.IsAccepted)
+	test("no window", 0, resp.Window)
+
+	codec, _ := msg.CodecByName(msg.DefaultCodec)
+	received := make(chan msg.Type, 100)
+	go func() {
+		defer close(received)
+		for {
+			inBuf, err := msg.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			var fs msg.FromServer
+			checkErr(codec.Decode(inBuf, &fs))
+			received <- fs.Type
+		}
+	}()
+
+	selected := wm.SelectWorkers(1)
+	inbox := newJobInbox(10 * limits.WorkerWindow)
+	wm.PrepareWorkers(selected, inbox)
+	for i := 0; i < 2*wcm.Window; i++ {
+		wm.SendMessageToWorker(msg.FromServer{Type: msg.Superstep, DstWorker: "w1"})
+	}
+	worker := &fakeWorker{"w1", conn, codec, resp.RejoinToken}
+	for i := 0; i < 2*limits.WorkerWindow; i++ {
+		worker.send(msg.FromWorker{Type: msg.Done, SrcWorker: "w1"})
+	}
+	for i := 0; i < 2*limits.WorkerWindow; i++ {
+		nextJobMessage(inbox)
+	}
+	// Everything arrives, and there are no Credits among it
+	nextType := func() msg.Type {
+		for {
+			select {
+			case typ := <-received:
+				if typ != msg.Heartbeat {
+					return typ
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("No message for the worker")
+				return msg.NilType
+			}
+		}
+	}
+	for i := 0; i < 2*wcm.Window; i++ {
+		test("sent past its window", msg.Superstep, nextType())
+	}
+	inbox.close()
+	wm.CloseWorkers(selected)
+
+	test("disconnected", true, wm.Shutdown(5*time.Second))
+	for typ := range received {
+		test("nothing else", msg.Heartbeat, typ)
+	}
+}
+
+// A job sending to a worker whose queue is full waits, but not past the end
+// of the worker's connection.
+func TestSendToStuckWorker(tee *testing.T) {
+	t = tee
+	saved := limits.WorkerQueue
+	limits.WorkerQueue = 2
+	defer func() { limits.WorkerQueue = saved }()
+	wm := NewWorkerManager()
+	events := wm.Subscribe(10)
+
+	// A worker that never reads, nor returns credits
+	wcm := workerConnectionMsg("w1")
+	wcm.Window = 1
+	conn, resp := dialWorker(wm, wcm)
+	test("accepted", true, resp.IsAccepted)
+	nextEvent(events)
+
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 2+limits.WorkerQueue; i++ {
+			wm.SendMessageToWorker(msg.FromServer{Type: msg.Superstep, DstWorker: "w1"})
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Errorf("Queued more than the worker's queue holds")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	wm.checkHeartbeats(time.Now().Add(deadAfter + time.Second))
+	test("removed", WorkerEvent{WorkerRemoved, "w1"}, nextEvent(events))
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Still waiting to send to a removed worker")
+	}
+	conn.Close()
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+// batcher collects outgoing vertex messages into one V2VBatch message per
+// destination worker, so that the per message overhead is paid once for many
+// vertex messages. A batch is sent when it is full, when the superstep
+// changes, or when flush is called.
+type batcher struct {
+	wID     msg.WorkerId
+	stepNum int
+	batches map[msg.WorkerId][]msg.VertexMsg
+
+	// Finds the worker a vertex message goes to, and sends a batch to it
+	route func(vid int) msg.WorkerId
+	send  func(dstWorker msg.WorkerId, batch msg.FromWorker)
+}
+
+// newBatcher creates a batcher that sends every batch to the server, which
+// passes the messages on.
+func newBatcher(wID msg.WorkerId, outMsgChan chan msg.FromWorker) *batcher {
+	return newPeerBatcher(wID,
+		func(vid int) msg.WorkerId { return "" },
+		func(dstWorker msg.WorkerId, batch msg.FromWorker) { outMsgChan <- batch })
+}
+
+// newPeerBatcher creates a batcher that sends each batch with send to the
+// worker that route finds.
+func newPeerBatcher(wID msg.WorkerId, route func(vid int) msg.WorkerId,
+	send func(dstWorker msg.WorkerId, batch msg.FromWorker)) *batcher {
+	return &batcher{
+		wID:     wID,
+		batches: make(map[msg.WorkerId][]msg.VertexMsg),
+		route:   route,
+		send:    send,
+	}
+}
+
+func (b *batcher) add(vToVMsg vertices.VertexMessage) {
+	if vToVMsg.Superstep != b.stepNum {
+		b.flush()
+	}
+	b.stepNum = vToVMsg.Superstep
+	dstWorker := b.route(vToVMsg.ToID)
+	b.batches[dstWorker] = append(b.batches[dstWorker], msg.VertexMsg{
+		Src: msg.VertexId(vToVMsg.FromID),
+		Dst: msg.VertexId(vToVMsg.ToID),
+		Val: vToVMsg.Value,
+	})
+	if len(b.batches[dstWorker]) >= msg.MaxBatchSize {
+		b.flushTo(dstWorker)
+	}
+}
+
+// flush sends the messages collected so far, if there are any.
+func (b *batcher) flush() {
+	for dstWorker := range b.batches {
+		b.flushTo(dstWorker)
+	}
+}
+
+func (b *batcher) flushTo(dstWorker msg.WorkerId) {
+	batch := b.batches[dstWorker]
+	if len(batch) == 0 {
+		return
+	}
+	batchMsg := msg.FromWorker{
+		Type:      msg.V2VBatch,
+		SrcWorker: b.wID,
+		DstWorker: dstWorker,
+		StepNum:   b.stepNum,
+		Batch:     batch,
+	}
+	b.send(dstWorker, batchMsg)
+	delete(b.batches, dstWorker)
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+var t *testing.T
+
+func test(summary string, expect, actual interface{}) {
+	if !reflect.DeepEqual(expect, actual) {
+		_, _, line, _ := runtime.Caller(1)
+		t.Errorf("Line %d:: %s: Expected %v, Actual %v", line, summary, expect, actual)
+	}
+}
+
+// A batcher that routes even vertices to w2 and odd ones to w3, and keeps
+// what it sends.
+func recordingBatcher() (*batcher, *[]msg.FromWorker) {
+	var sent []msg.FromWorker
+	route := func(vid int) msg.WorkerId {
+		if vid%2 == 0 {
+			return "w2"
+		}
+		return "w3"
+	}
+	b := newPeerBatcher("w1", route, func(dstWorker msg.WorkerId, batch msg.FromWorker) {
+		if dstWorker != batch.DstWorker {
+			t.Errorf("Batch for %v sent to %v", batch.DstWorker, dstWorker)
+		}
+		sent = append(sent, batch)
+	})
+	return b, &sent
+}
+
+// The vertex messages of the batches sent to dstWorker, in the order sent
+func sentTo(sent []msg.FromWorker, dstWorker msg.WorkerId) []msg.VertexMsg {
+	var vms []msg.VertexMsg
+	for _, batch := range sent {
+		if batch.DstWorker == dstWorker {
+			vms = append(vms, batch.Batch...)
+		}
+	}
+	return vms
+}
+
+// The vertex message that would have been sent on its own, as a V2V message
+func unbatched(vm vertices.VertexMessage) msg.VertexMsg {
+	v2v := msg.FromWorker{
+		Type:      msg.V2V,
+		SrcVertex: msg.VertexId(vm.FromID),
+		DstVertex: msg.VertexId(vm.ToID),
+		Msg:       vm.Value,
+	}
+	return msg.VertexMsg{Src: v2v.SrcVertex, Dst: v2v.DstVertex, Val: v2v.Msg}
+}
+
+// Nothing is held back past the end of a superstep, and a batch only holds
+// messages of one superstep.
+func TestBatchFlushesEachSuperstep(tee *testing.T) {
+	t = tee
+	b, sent := recordingBatcher()
+	b.flush()
+	test("nothing to flush", 0, len(*sent))
+
+	b.add(vertices.VertexMessage{FromID: 1, ToID: 2, Value: 0.5, Superstep: 1})
+	b.add(vertices.VertexMessage{FromID: 1, ToID: 3, Value: 0.5, Superstep: 1})
+	test("held until the superstep ends", 0, len(*sent))
+
+	b.add(vertices.VertexMessage{FromID: 2, ToID: 4, Value: 0.25, Superstep: 2})
+	test("next superstep flushes the last", 2, len(*sent))
+	for _, batch := range *sent {
+		test("type", msg.V2VBatch, batch.Type)
+		test("source", msg.WorkerId("w1"), batch.SrcWorker)
+		test("superstep", 1, batch.StepNum)
+		test("one message", 1, len(batch.Batch))
+	}
+
+	b.flush()
+	test("end of superstep", 3, len(*sent))
+	last := (*sent)[2]
+	test("its superstep", 2, last.StepNum)
+	test("its messages", []msg.VertexMsg{{Src: 2, Dst: 4, Val: 0.25}}, last.Batch)
+	b.flush()
+	test("flushed once", 3, len(*sent))
+}
+
+// A full batch goes out straight away.
+func TestBatchFull(tee *testing.T) {
+	t = tee
+	b, sent := recordingBatcher()
+	for i := 0; i < msg.MaxBatchSize+1; i++ {
+		b.add(vertices.VertexMessage{FromID: i, ToID: 0, Value: float64(i)})
+	}
+	test("one full batch", 1, len(*sent))
+	test("full", msg.MaxBatchSize, len((*sent)[0].Batch))
+	b.flush()
+	test("rest", 1, len((*sent)[1].Batch))
+}
+
+// Each worker gets its messages in the order they would have gone one at a
+// time.
+func TestBatchOrder(tee *testing.T) {
+	t = tee
+	b, sent := recordingBatcher()
+	var toW2, toW3 []msg.VertexMsg
+	for i := 0; i < 3*msg.MaxBatchSize; i++ {
+		vm := vertices.VertexMessage{FromID: i, ToID: (i * 7) % 11, Value: float64(i) / 3, Superstep: 4}
+		b.add(vm)
+		if vm.ToID%2 == 0 {
+			toW2 = append(toW2, unbatched(vm))
+		} else {
+			toW3 = append(toW3, unbatched(vm))
+		}
+	}
+	b.flush()
+	test("to w2", toW2, sentTo(*sent, "w2"))
+	test("to w3", toW3, sentTo(*sent, "w3"))
+}
+
+// Messages that go through the server are batched all the same.
+func TestServerBatcher(tee *testing.T) {
+	t = tee
+	out := make(chan msg.FromWorker, 10)
+	b := newBatcher("w1", out)
+	b.add(vertices.VertexMessage{FromID: 1, ToID: 2, Value: 1, Superstep: 3})
+	b.add(vertices.VertexMessage{FromID: 1, ToID: 5, Value: 2, Superstep: 3})
+	b.flush()
+	test("one batch", 1, len(out))
+	batch := <-out
+	test("to the server", msg.WorkerId(""), batch.DstWorker)
+	test("messages", []msg.VertexMsg{{Src: 1, Dst: 2, Val: 1}, {Src: 1, Dst: 5, Val: 2}}, batch.Batch)
+}
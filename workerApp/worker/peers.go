@@ -0,0 +1,337 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"project_c9f7_i5l8_o0p4_p0j8/vertices"
+)
+
+// How long a worker waits for the vertex messages its peers say they sent it
+const deliveryTimeout = 5 * time.Second
+
+// How long a worker tries to connect to a peer before dropping its messages
+const peerDialTimeout = 2 * time.Second
+
+// Peers sends vertex messages straight to the workers that own their
+// destination vertices, and holds on to the ones sent to this worker until
+// the superstep they were sent in is over. The server only relays the counts,
+// so every worker knows how many messages to wait for.
+type Peers struct {
+	wID   msg.WorkerId
+	codec msg.Codec // How this worker encodes the batches it sends
+	tls   *msg.TLS  // nil for plaintext
+
+	lock    sync.Mutex
+	arrived *sync.Cond
+	round   int64 // The assignment the peers and messages belong to
+	peers   map[msg.WorkerId]msg.Peer
+	owners  []partitionOwner // Sorted by the start of the partition
+
+	// The vertex messages received for each superstep, until collected
+	inbox     map[int][]peerMessage
+	collected int // The latest superstep collected; older messages are stale
+
+	sendLock sync.Mutex
+	conns    map[msg.WorkerId]net.Conn
+	sent     map[int]map[msg.WorkerId]int // Messages sent in each superstep
+}
+
+type partitionOwner struct {
+	partition msg.Partition
+	worker    msg.WorkerId
+}
+
+type peerMessage struct {
+	src     msg.WorkerId
+	message vertices.VertexMessage
+}
+
+// NewPeers creates the peers of the worker with the given id, which sends
+// its batches encoded with codec. If tlsConfig is not nil, the workers talk
+// over TLS, and each must have a certificate for its WorkerId.
+func NewPeers(wID msg.WorkerId, codec msg.Codec, tlsConfig *msg.TLS) *Peers {
+	peers := &Peers{
+		wID:       wID,
+		codec:     codec,
+		tls:       tlsConfig,
+		peers:     make(map[msg.WorkerId]msg.Peer),
+		inbox:     make(map[int][]peerMessage),
+		collected: -1,
+		conns:     make(map[msg.WorkerId]net.Conn),
+		sent:      make(map[int]map[msg.WorkerId]int),
+	}
+	peers.arrived = sync.NewCond(&peers.lock)
+	return peers
+}
+
+// Listen accepts connections from other workers at addr.
+func (p *Peers) Listen(addr string) error {
+	listener, err := p.tls.Listen(addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Peers: listening for workers at", addr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("Peers: stopped listening:", err)
+				return
+			}
+			go p.receive(conn)
+		}
+	}()
+	return nil
+}
+
+// SetPeers replaces the partition map. For a new assignment round,
+// everything received or sent so far is forgotten. Otherwise only the
+// messages received from workers that are no longer peers are dropped.
+func (p *Peers) SetPeers(peers []msg.Peer, round int64) {
+	p.lock.Lock()
+	newAssignment := round != p.round
+	p.round = round
+	p.peers = make(map[msg.WorkerId]msg.Peer)
+	p.owners = nil
+	for _, peer := range peers {
+		p.peers[peer.Worker] = peer
+		for _, partition := range peer.Partitions {
+			p.owners = append(p.owners, partitionOwner{partition, peer.Worker})
+		}
+	}
+	sort.Sort(byPartitionStart(p.owners))
+
+	if newAssignment {
+		p.inbox = make(map[int][]peerMessage)
+		p.collected = -1
+	} else {
+		for step, msgs := range p.inbox {
+			kept := msgs[:0]
+			for _, pm := range msgs {
+				if _, ok := p.peers[pm.src]; ok {
+					kept = append(kept, pm)
+				}
+			}
+			p.inbox[step] = kept
+		}
+	}
+	p.lock.Unlock()
+
+	p.sendLock.Lock()
+	if newAssignment {
+		p.sent = make(map[int]map[msg.WorkerId]int)
+	}
+	for wID, conn := range p.conns {
+		if peer, ok := p.peers[wID]; !ok || peer.Address != conn.RemoteAddr().String() {
+			conn.Close()
+			delete(p.conns, wID)
+		}
+	}
+	p.sendLock.Unlock()
+}
+
+// Round returns the current assignment round.
+func (p *Peers) Round() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.round
+}
+
+// Owner returns the worker that owns the vertex, or "" if no one does.
+func (p *Peers) Owner(vid int) msg.WorkerId {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	i := sort.Search(len(p.owners), func(i int) bool {
+		return p.owners[i].partition.EndIdx > vid
+	})
+	if i < len(p.owners) && p.owners[i].partition.StartIdx <= vid {
+		return p.owners[i].worker
+	}
+	return ""
+}
+
+// Send sends a V2VBatch to the worker dst. The messages are counted as sent
+// even if they could not be, so that dst notices they are missing.
+func (p *Peers) Send(dst msg.WorkerId, batch msg.FromWorker) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	if p.sent[batch.StepNum] == nil {
+		p.sent[batch.StepNum] = make(map[msg.WorkerId]int)
+	}
+	p.sent[batch.StepNum][dst] += len(batch.Batch)
+	p.lock.Lock()
+	batch.Round = p.round
+	p.lock.Unlock()
+
+	conn, err := p.connect(dst)
+	if err == nil {
+		var data []byte
+		data, err = p.codec.Encode(batch)
+		if err == nil {
+			err = msg.WriteFrame(conn, data)
+		}
+		if err != nil {
+			conn.Close()
+			delete(p.conns, dst)
+		}
+	}
+	if err != nil {
+		log.Printf("Peers: could not send %v messages to %v: %v\n", len(batch.Batch), dst, err)
+	}
+}
+
+// Must be called with sendLock held.
+func (p *Peers) connect(dst msg.WorkerId) (net.Conn, error) {
+	if conn, ok := p.conns[dst]; ok {
+		return conn, nil
+	}
+	p.lock.Lock()
+	peer, ok := p.peers[dst]
+	p.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v is not a peer", dst)
+	}
+
+	conn, err := p.tls.Dial(peer.Address, msg.WorkerCertName(dst), peerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	data, err := msg.HandshakeCodec.Encode(msg.PeerConnectionMsg{WorkerId: p.wID, Codec: p.codec.Name()})
+	if err == nil {
+		err = msg.WriteFrame(conn, data)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.conns[dst] = conn
+	return conn, nil
+}
+
+// TakeSent returns how many messages were sent to each peer during the
+// superstep, and forgets about them.
+func (p *Peers) TakeSent(stepNum int) map[msg.WorkerId]int {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	sent := p.sent[stepNum]
+	delete(p.sent, stepNum)
+	return sent
+}
+
+func (p *Peers) receive(conn net.Conn) {
+	defer conn.Close()
+
+	data, err := msg.ReadFrame(conn)
+	var hello msg.PeerConnectionMsg
+	var codec msg.Codec
+	if err == nil {
+		err = msg.HandshakeCodec.Decode(data, &hello)
+	}
+	if err == nil {
+		// Each peer's batches are decoded the way that peer encodes them
+		codec, err = msg.CodecByName(hello.Codec)
+	}
+	if err == nil {
+		var certName string
+		certName, err = msg.CertName(conn)
+		if err == nil && certName != "" && certName != msg.WorkerCertName(hello.WorkerId) {
+			err = fmt.Errorf("certificate is for %v, not %v", certName, msg.WorkerCertName(hello.WorkerId))
+		}
+	}
+	if err != nil {
+		log.Println("Peers: bad connection from", conn.RemoteAddr(), err)
+		return
+	}
+	log.Println("Peers: connected to", hello.WorkerId)
+
+	for {
+		data, err := msg.ReadFrame(conn)
+		if err != nil {
+			log.Printf("Peers: lost connection to %v: %v\n", hello.WorkerId, err)
+			return
+		}
+		var batch msg.FromWorker
+		if err := codec.Decode(data, &batch); err != nil {
+			log.Printf("Peers: bad message from %v: %v\n", hello.WorkerId, err)
+			return
+		}
+
+		p.lock.Lock()
+		if _, ok := p.peers[hello.WorkerId]; !ok || batch.Round != p.round || batch.StepNum <= p.collected {
+			log.Printf("Peers: dropping %v stale messages from %v\n", len(batch.Batch), hello.WorkerId)
+		} else {
+			for _, vm := range batch.Batch {
+				p.inbox[batch.StepNum] = append(p.inbox[batch.StepNum], peerMessage{
+					src: hello.WorkerId,
+					message: vertices.VertexMessage{
+						FromID:    vm.Src.Int(),
+						Value:     vm.Val,
+						ToID:      vm.Dst.Int(),
+						Superstep: batch.StepNum,
+					},
+				})
+			}
+			p.arrived.Broadcast()
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Collect waits until the expected number of messages for the superstep has
+// arrived, and returns them. A superstep can only be collected once; after
+// that it returns nothing.
+func (p *Peers) Collect(stepNum int, expected int) ([]vertices.VertexMessage, error) {
+	timedOut := false
+	timer := time.AfterFunc(deliveryTimeout, func() {
+		p.lock.Lock()
+		timedOut = true
+		p.arrived.Broadcast()
+		p.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if stepNum <= p.collected {
+		return nil, nil
+	}
+	for len(p.inbox[stepNum]) < expected && !timedOut {
+		p.arrived.Wait()
+	}
+	if len(p.inbox[stepNum]) < expected {
+		return nil, fmt.Errorf("received %v of %v messages for superstep %v",
+			len(p.inbox[stepNum]), expected, stepNum)
+	}
+
+	var msgs []vertices.VertexMessage
+	for _, pm := range p.inbox[stepNum] {
+		msgs = append(msgs, pm.message)
+	}
+	for step := range p.inbox {
+		if step <= stepNum {
+			delete(p.inbox, step)
+		}
+	}
+	p.collected = stepNum
+	return msgs, nil
+}
+
+// byPartitionStart implements sort.Interface, ordering partitions by their first vertex
+type byPartitionStart []partitionOwner
+
+func (bp byPartitionStart) Len() int {
+	return len(bp)
+}
+func (bp byPartitionStart) Swap(i, j int) {
+	bp[i], bp[j] = bp[j], bp[i]
+}
+func (bp byPartitionStart) Less(i, j int) bool {
+	return bp[i].partition.StartIdx < bp[j].partition.StartIdx
+}
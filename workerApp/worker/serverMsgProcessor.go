@@ -2,7 +2,9 @@ package worker
 
 import (
 	"log"
+	"time"
 
+	"project_c9f7_i5l8_o0p4_p0j8/db"
 	"project_c9f7_i5l8_o0p4_p0j8/msg"
 	"project_c9f7_i5l8_o0p4_p0j8/vertices"
 )
@@ -16,15 +18,19 @@ type ServerMsgProcessor struct {
 	inactiveMsgChan chan vertices.ActiveMessage
 	wID             msg.WorkerId
 	stepDoneChan    chan int
+	peers           *Peers
 }
 
 // NewServerMsgProcessor creates a new message processor and worker to
-// send the messages to.
-func NewServerMsgProcessor(wID msg.WorkerId, outMsgChan chan msg.FromWorker) *ServerMsgProcessor {
+// send the messages to. The vertex messages sent straight to other workers
+// are encoded with codec, over TLS unless tlsConfig is nil. The worker loads
+// and saves its vertices in store.
+func NewServerMsgProcessor(wID msg.WorkerId, codec msg.Codec, tlsConfig *msg.TLS,
+	store db.GraphStore, outMsgChan chan msg.FromWorker) *ServerMsgProcessor {
 	vtoVMsgChan := make(chan vertices.VertexMessage)
 	inactiveMsgChan := make(chan vertices.ActiveMessage)
 	stepDoneChan := make(chan int)
-	worker := NewWorker(vtoVMsgChan, inactiveMsgChan, stepDoneChan)
+	worker := NewWorker(store, vtoVMsgChan, inactiveMsgChan, stepDoneChan)
 
 	smp := &ServerMsgProcessor{
 		worker:          worker,
@@ -33,10 +39,31 @@ func NewServerMsgProcessor(wID msg.WorkerId, outMsgChan chan msg.FromWorker) *Se
 		inactiveMsgChan: inactiveMsgChan,
 		stepDoneChan:    stepDoneChan,
 		wID:             wID,
+		peers:           NewPeers(wID, codec, tlsConfig),
 	}
 	return smp
 }
 
+// ListenForPeers accepts vertex messages sent directly by other workers at
+// addr, the worker address given to the server.
+func (smp *ServerMsgProcessor) ListenForPeers(addr string) error {
+	return smp.peers.Listen(addr)
+}
+
+// Hands the messages the peers sent during the superstep before to the
+// worker, once they have all arrived. Returns false if they didn't.
+func (smp *ServerMsgProcessor) collectPeerMessages(serverMsg msg.FromServer) bool {
+	vertexMsgs, err := smp.peers.Collect(serverMsg.ExpectedStep, serverMsg.Expected)
+	if err != nil {
+		log.Println("SMP: Missing messages from peers:", err)
+		return false
+	}
+	for _, vertexMsg := range vertexMsgs {
+		smp.worker.ReceiveNetVertexMessage(vertexMsg)
+	}
+	return true
+}
+
 // Process accepts a pregel.Message and processes it into
 func (smp *ServerMsgProcessor) Process(serverMsg msg.FromServer) {
 	switch serverMsg.Type {
@@ -50,24 +77,23 @@ func (smp *ServerMsgProcessor) Process(serverMsg msg.FromServer) {
 		}
 		smp.worker.ReceiveNetVertexMessage(vertexMsg)
 		break
+	case msg.V2VBatch:
+		log.Println("SMP: Received a batch of", len(serverMsg.Batch), "vertex messages.")
+		for _, vm := range serverMsg.Batch {
+			vertexMsg := vertices.VertexMessage{
+				FromID:    vm.Src.Int(),
+				Value:     vm.Val,
+				ToID:      vm.Dst.Int(),
+				Superstep: serverMsg.StepNum,
+			}
+			smp.worker.ReceiveNetVertexMessage(vertexMsg)
+		}
+		break
 	case msg.Assign:
 		log.Println("SMP: Received an assign/load message.")
 		jobName := serverMsg.DBKey
-
-		var workerPartitions = []struct {
-			min int
-			max int
-		}{}
-		for _, partition := range serverMsg.Partitions {
-			minID := partition.Start().Int()
-			maxID := partition.End().Int()
-			workerPartition := struct {
-				min int
-				max int
-			}{minID, maxID}
-			workerPartitions = append(workerPartitions, workerPartition)
-		}
-		err := smp.worker.LoadVertices(jobName, workerPartitions)
+		smp.peers.SetPeers(serverMsg.Peers, serverMsg.Round)
+		err := smp.worker.LoadVertices(jobName, toWorkerPartitions(serverMsg.Partitions))
 		ackMsg := msg.FromWorker{
 			Type:      msg.PartitionAck,
 			SrcWorker: smp.wID,
@@ -84,7 +110,7 @@ func (smp *ServerMsgProcessor) Process(serverMsg msg.FromServer) {
 	case msg.SaveCheckpoint:
 		log.Println("SMP: Received a save vertices message.")
 		jobName := serverMsg.DBKey
-		success := smp.worker.SaveVertices(jobName)
+		success := smp.collectPeerMessages(serverMsg) && smp.worker.SaveVertices(jobName)
 		ackMsg := msg.FromWorker{
 			Type:      msg.SaveCheckpointAck,
 			SrcWorker: smp.wID,
@@ -120,29 +146,34 @@ func (smp *ServerMsgProcessor) Process(serverMsg msg.FromServer) {
 
 	case msg.Superstep:
 		log.Println("SMP: Received a start superstep message.")
+		if !smp.collectPeerMessages(serverMsg) {
+			// Without a Done, the server gives up on the superstep
+			break
+		}
 		smp.worker.PrepareSuperstep()
 		go smp.worker.Superstep(serverMsg.StepNum)
 		go func() {
+			batch := newPeerBatcher(smp.wID, smp.peers.Owner, smp.peers.Send)
+			flush := time.NewTicker(msg.BatchFlushInterval)
+			defer flush.Stop()
 			for {
 				select {
 				case step := <-smp.stepDoneChan:
+					// Every vertex message goes out before the Done
+					batch.flush()
 					ackMsg := msg.FromWorker{
 						Type:      msg.Done,
 						SrcWorker: smp.wID,
 						StepNum:   step,
+						Sent:      smp.peers.TakeSent(step),
 					}
 					smp.outMsgChan <- ackMsg
 					return
 				case vToVMsg := <-smp.vToVMsgChan:
-					ackMsg := msg.FromWorker{
-						Type:      msg.V2V,
-						SrcWorker: smp.wID,
-						StepNum:   vToVMsg.Superstep,
-						SrcVertex: msg.VertexId(vToVMsg.FromID),
-						DstVertex: msg.VertexId(vToVMsg.ToID),
-						Msg:       vToVMsg.Value,
-					}
-					smp.outMsgChan <- ackMsg
+					batch.add(vToVMsg)
+					break
+				case <-flush.C:
+					batch.flush()
 					break
 				case inactiveMsg := <-smp.inactiveMsgChan:
 					ackMsg := msg.FromWorker{
@@ -157,8 +188,49 @@ func (smp *ServerMsgProcessor) Process(serverMsg msg.FromServer) {
 			}
 		}()
 		break
+	case msg.Recover:
+		log.Println("SMP: Received a recover message.")
+		smp.peers.SetPeers(serverMsg.Peers, smp.peers.Round())
+		err := smp.worker.Recover(serverMsg.DBKey, toWorkerPartitions(serverMsg.Partitions),
+			toWorkerPartitions(serverMsg.LostPartitions), serverMsg.StepNum)
+		ackMsg := msg.FromWorker{
+			Type:      msg.RecoverAck,
+			SrcWorker: smp.wID,
+		}
+		if err == nil {
+			log.Println("SMP: Successfully loaded recovered vertices.")
+			ackMsg.Msg = 1.0
+		} else {
+			log.Println("SMP: Failed to load recovered vertices.")
+			ackMsg.Msg = 0.0
+		}
+		smp.outMsgChan <- ackMsg
+		break
+	case msg.Replay:
+		log.Println("SMP: Received a replay message.")
+		batch := newBatcher(smp.wID, smp.outMsgChan)
+		for _, vToVMsg := range smp.worker.Replay(serverMsg.StepNum) {
+			batch.add(vToVMsg)
+		}
+		batch.flush()
+		ackMsg := msg.FromWorker{
+			Type:      msg.ReplayDone,
+			SrcWorker: smp.wID,
+			StepNum:   serverMsg.StepNum,
+		}
+		smp.outMsgChan <- ackMsg
+		break
 	default:
 		log.Panic("SMP: Unrecognized message type: ", serverMsg.Type)
 
 	}
 }
+
+func toWorkerPartitions(partitions []msg.Partition) []Partition {
+	workerPartitions := []Partition{}
+	for _, partition := range partitions {
+		workerPartitions = append(workerPartitions,
+			NewPartition(partition.Start().Int(), partition.End().Int()))
+	}
+	return workerPartitions
+}
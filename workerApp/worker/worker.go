@@ -21,11 +21,43 @@ type Worker struct {
 	inactiveVertexChan  chan vertices.ActiveMessage
 	serverVtoVChan      chan vertices.VertexMessage
 	hasStarted          bool
+	store               db.GraphStore
+
+	// The messages sent to other workers in each superstep since the last
+	// checkpoint, so they can be sent again if their destination is lost.
+	msgLog map[int][]vertices.VertexMessage
+
+	// Vertices taken over from a dead worker, which are being replayed up to
+	// recoverEndStep before they join the engines.
+	recovering     map[int]vertices.Vertex
+	recoveryInbox  map[int][]vertices.VertexMessage
+	recoverEndStep int
+	lost           []Partition
+}
+
+// Partition is a range of vertex ids, from min up to but not including max.
+type Partition struct {
+	min int
+	max int
+}
+
+// NewPartition creates a Partition of the ids from min up to max.
+func NewPartition(min int, max int) Partition {
+	return Partition{min, max}
+}
+
+func inPartitions(partitions []Partition, id int) bool {
+	for _, p := range partitions {
+		if p.min <= id && id < p.max {
+			return true
+		}
+	}
+	return false
 }
 
 // NewWorker allows a new worker to be constructed with a particular batch
-// size for network communication
-func NewWorker(serverVtoVChan chan vertices.VertexMessage, inactiveVertexChan chan vertices.ActiveMessage, stepDoneChan chan int) *Worker {
+// size for network communication. It loads and saves its vertices in store.
+func NewWorker(store db.GraphStore, serverVtoVChan chan vertices.VertexMessage, inactiveVertexChan chan vertices.ActiveMessage, stepDoneChan chan int) *Worker {
 	numEngines := runtime.NumCPU()
 	worker := &Worker{
 		messages:            make(map[int][]vertices.VertexMessage),
@@ -36,6 +68,8 @@ func NewWorker(serverVtoVChan chan vertices.VertexMessage, inactiveVertexChan ch
 		stepDoneChan:        stepDoneChan,
 		stopChan:            make(chan bool),
 		stopReceiver:        make(chan bool),
+		msgLog:              make(map[int][]vertices.VertexMessage),
+		store:               store,
 	}
 	return worker
 }
@@ -89,6 +123,7 @@ func (w *Worker) receiveLocalMsgs(stepNum int) {
 					w.msgDistributionChan <- msg
 				} else {
 					log.Println("Worker: Sending out id: ", msg.ToID)
+					w.msgLog[stepNum] = append(w.msgLog[stepNum], msg)
 					w.serverVtoVChan <- msg
 				}
 			} else {
@@ -159,7 +194,10 @@ func (w *Worker) RunReceiver() {
 // channel.
 func (w *Worker) ReceiveNetVertexMessage(msg vertices.VertexMessage) {
 	log.Print("Worker: Received outside message, id:", msg.ToID)
-	if w.hasStarted {
+	if _, ok := w.recovering[msg.ToID]; ok && msg.Superstep < w.recoverEndStep {
+		// Replayed input for a vertex that is catching up
+		w.recoveryInbox[msg.ToID] = append(w.recoveryInbox[msg.ToID], msg)
+	} else if w.hasStarted {
 		if _, vok := w.vertexMap[msg.ToID]; vok {
 			w.msgDistributionChan <- msg
 		} else {
@@ -173,34 +211,17 @@ func (w *Worker) ReceiveNetVertexMessage(msg vertices.VertexMessage) {
 
 // LoadVertices loads vertices into the engines.
 // TODO: Add type of job from server
-func (w *Worker) LoadVertices(jobName string, partitions []struct {
-	min int
-	max int
-}) error {
-	allBaseVertices := make(map[int]vertices.BaseVertex)
+func (w *Worker) LoadVertices(jobName string, partitions []Partition) error {
 	log.Println("Worker: Loading vertices with name: ", jobName, "Partitions:", partitions)
-	for _, partition := range partitions {
-		minID := partition.min
-		maxID := partition.max
-
-		partitionBaseVertices, err := db.BatchGet(jobName, minID, maxID)
-		if err != nil {
-			return err
-		}
-		for bvid, bv := range partitionBaseVertices {
-			allBaseVertices[bvid] = bv
-			log.Print("Node Id:", bvid)
-		}
-	}
-	log.Println("Worker: Loaded", len(allBaseVertices), "vertices.")
-
-	numVertices, err := db.NumVertices(jobName)
+	loaded, err := w.loadPartitions(jobName, partitions)
 	if err != nil {
 		return err
 	}
 	w.StopReceiver()
 	w.clearMessages()
-	w.vertexMap = w.getVertices(numVertices, allBaseVertices, vertices.PageRank)
+	w.msgLog = make(map[int][]vertices.VertexMessage)
+	w.recovering = nil
+	w.vertexMap = loaded
 
 	engineMaps := make([]map[int]vertices.Vertex, len(w.engines))
 	for id := 0; id < len(w.engines); id++ {
@@ -223,6 +244,121 @@ func (w *Worker) LoadVertices(jobName string, partitions []struct {
 	return nil
 }
 
+func (w *Worker) loadPartitions(jobName string, partitions []Partition) (map[int]vertices.Vertex, error) {
+	allBaseVertices := make(map[int]vertices.BaseVertex)
+	for _, partition := range partitions {
+		minID := partition.min
+		maxID := partition.max
+
+		partitionBaseVertices, err := w.store.BatchGet(jobName, minID, maxID)
+		if err != nil {
+			return nil, err
+		}
+		for bvid, bv := range partitionBaseVertices {
+			allBaseVertices[bvid] = bv
+			log.Print("Node Id:", bvid)
+		}
+	}
+	log.Println("Worker: Loaded", len(allBaseVertices), "vertices.")
+
+	numVertices, err := w.store.NumVertices(jobName)
+	if err != nil {
+		return nil, err
+	}
+	return w.getVertices(numVertices, allBaseVertices, vertices.PageRank), nil
+}
+
+// Recover takes over the given partitions of a dead worker from the last
+// checkpoint in jobName. The messages that the dead worker sent during
+// endStep are dropped, since its vertices will send them again when they are
+// replayed up to endStep.
+func (w *Worker) Recover(jobName string, gained []Partition, lost []Partition, endStep int) error {
+	log.Println("Worker: Recovering partitions: ", gained, "up to superstep", endStep)
+	loaded, err := w.loadPartitions(jobName, gained)
+	if err != nil {
+		return err
+	}
+	w.StopReceiver()
+	for vid, msgs := range w.messages {
+		kept := msgs[:0]
+		for _, msg := range msgs {
+			if !inPartitions(lost, msg.FromID) {
+				kept = append(kept, msg)
+			}
+		}
+		w.messages[vid] = kept
+	}
+
+	w.lost = lost
+	w.recoverEndStep = endStep
+	w.recovering = loaded
+	w.recoveryInbox = make(map[int][]vertices.VertexMessage)
+	for vid, vertex := range loaded {
+		w.vertexMap[vid] = vertex
+		w.recoveryInbox[vid] = vertex.GetMessages()
+	}
+	go w.RunReceiver()
+	return nil
+}
+
+// Replay runs superstep stepNum again for the recovering vertices, and sends
+// again the logged messages of that superstep that went to the lost vertices.
+// Messages for the recovering vertices on this worker are kept for the next
+// replayed superstep; the ones for other workers are returned to be sent.
+// Until the final superstep, messages for vertices that were not lost have
+// already been received and are dropped. After the final superstep the
+// recovering vertices join the engines.
+func (w *Worker) Replay(stepNum int) []vertices.VertexMessage {
+	log.Println("Worker: Replaying superstep #:", stepNum)
+	inbox := w.recoveryInbox
+	w.recoveryInbox = make(map[int][]vertices.VertexMessage)
+
+	var outgoing []vertices.VertexMessage
+	deliver := func(msg vertices.VertexMessage) {
+		if _, ok := w.vertexMap[msg.ToID]; !ok {
+			outgoing = append(outgoing, msg)
+		} else if _, ok := w.recovering[msg.ToID]; ok && stepNum < w.recoverEndStep {
+			w.recoveryInbox[msg.ToID] = append(w.recoveryInbox[msg.ToID], msg)
+		} else {
+			w.msgDistributionChan <- msg
+		}
+	}
+
+	for _, msg := range w.msgLog[stepNum] {
+		if inPartitions(w.lost, msg.ToID) {
+			deliver(msg)
+		}
+	}
+
+	for vid, vertex := range w.recovering {
+		vertex.ReceiveMessages(inbox[vid])
+		vertexMsgChan := make(chan vertices.VertexMessage)
+		go func() {
+			vertex.Update(stepNum, vertexMsgChan)
+			close(vertexMsgChan)
+		}()
+		for msg := range vertexMsgChan {
+			if _, local := w.vertexMap[msg.ToID]; !local {
+				w.msgLog[stepNum] = append(w.msgLog[stepNum], msg)
+			}
+			if stepNum == w.recoverEndStep || inPartitions(w.lost, msg.ToID) {
+				deliver(msg)
+			}
+		}
+	}
+
+	if stepNum == w.recoverEndStep {
+		for vid, vertex := range w.recovering {
+			w.engines[vid%len(w.engines)].vertexMap[vid] = vertex
+		}
+		w.recovering = nil
+		w.recoveryInbox = nil
+		w.lost = nil
+		log.Println("Worker: Recovered vertices have caught up.")
+	}
+	return outgoing
+}
+
 // SaveVertices saves the current vertex information of this worker in the
 // database under the provided jobName.
 func (w *Worker) SaveVertices(jobName string) bool {
@@ -236,10 +372,13 @@ func (w *Worker) SaveVertices(jobName string) bool {
 		}
 	}
 
-	err := db.BatchUpdate(jobName, allVertices)
+	err := w.store.BatchUpdate(jobName, allVertices)
 	success := true
 	if err != nil {
 		success = false
+	} else {
+		// The checkpoint has everything the log was kept for
+		w.msgLog = make(map[int][]vertices.VertexMessage)
 	}
 	return success
 }
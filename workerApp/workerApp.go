@@ -3,21 +3,30 @@ package main
 import (
 	// "bufio"
 	// "encoding/json"
-	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"project_c9f7_i5l8_o0p4_p0j8/db"
 	"project_c9f7_i5l8_o0p4_p0j8/msg"
 	"project_c9f7_i5l8_o0p4_p0j8/workerApp/worker"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/arcaneiceman/GoVector/govec"
 )
 
-// Logger is a GoVector logger for distributed logging
+// Logger is a GoVector logger for distributed logging. It is only set up
+// when the worker is started with -govec.
 var Logger *govec.GoLog
 
+// How the messages to and from the server are encoded, after the connection
+// messages
+var wireCodec msg.Codec
+
 func checkErr(err error) {
 	_, _, line, _ := runtime.Caller(1)
 	if err != nil {
@@ -25,88 +34,284 @@ func checkErr(err error) {
 	}
 }
 
+// If nothing, not even a heartbeat, arrives from the server for this long,
+// the connection is considered dead and the worker reconnects. Tests shorten
+// it.
+var serverTimeout = 6 * msg.HeartbeatInterval
+
+// The flow control state of one connection to the server. Each side may only
+// send as many messages as the other has given it credits for, apart from
+// heartbeats and credits.
+type serverFlow struct {
+	sendWindow int      // How many messages the server let us send it; 0 for no limit
+	recvWindow int      // How many messages we let the server send us; 0 for no limit
+	returned   chan int // Credits the server returned, for runSender
+	grants     chan int // Credits to return to the server, from handleTasks
+}
+
+func newServerFlow(sendWindow int, recvWindow int) *serverFlow {
+	return &serverFlow{
+		sendWindow: sendWindow,
+		recvWindow: recvWindow,
+		returned:   make(chan int, 16),
+		grants:     make(chan int, 16),
+	}
+}
+
 // HandleTasks receives tasks from the server and sends to the
-// ServerMsgProcessor to be passed on to the Worker.
-func handleTasks(conn net.Conn, msgProcessor *worker.ServerMsgProcessor) {
-	var inBuf [512]byte
+// ServerMsgProcessor to be passed on to the Worker, returning credits to the
+// server as it goes. It returns when the connection to the server fails or
+// goes silent, the sender stops, or the server asks the worker to disconnect.
+func handleTasks(conn net.Conn, msgProcessor *worker.ServerMsgProcessor, flow *serverFlow, senderDone chan bool) error {
 	var localAddr = conn.LocalAddr().String()
 	log.Println("Waiting at addr: ", localAddr)
 
 	var inMsg msg.FromServer
 	// reader := bufio.NewReader(conn)
+	processed := 0
 	for {
-		var sizeBuf [2]byte
-		_, sizeErr := conn.Read(sizeBuf[:])
-		// log.Println("Size Buf contains:", sizeBuf)
-		checkErr(sizeErr)
-		msgSize := binary.LittleEndian.Uint16(sizeBuf[:])
-
-		n, err := conn.Read(inBuf[0:msgSize])
-		checkErr(err)
-		Logger.UnpackReceive("Received-Message", inBuf[0:n], &inMsg)
+		conn.SetReadDeadline(time.Now().Add(serverTimeout))
+		inBuf, err := msg.ReadFrame(conn)
+		if err != nil {
+			return err
+		}
+		inMsg = msg.FromServer{}
+		if err := wireCodec.Decode(inBuf, &inMsg); err != nil {
+			return err
+		}
+		if inMsg.Type == msg.Heartbeat {
+			continue
+		}
+		if inMsg.Type == msg.Disconnect {
+			return errors.New("server is shutting down")
+		}
+		if inMsg.Type == msg.Credit {
+			select {
+			case flow.returned <- inMsg.Credits:
+			case <-senderDone:
+				return errors.New("sender stopped")
+			}
+			continue
+		}
 		log.Printf("WConn: Received message %v\n", inMsg)
 		msgProcessor.Process(inMsg)
+
+		// Once the server has used up half of its window, let it send that
+		// many more
+		if flow.recvWindow > 0 {
+			processed++
+			if processed >= (flow.recvWindow+1)/2 {
+				select {
+				case flow.grants <- processed:
+				case <-senderDone:
+					return errors.New("sender stopped")
+				}
+				processed = 0
+			}
+		}
 	}
 
 }
 
-func runSender(conn net.Conn, outMsgChan chan msg.FromWorker) {
+// runSender sends the worker's messages, as far as its credits allow, and a
+// heartbeat every msg.HeartbeatInterval, to the server until quit is closed
+// or a write fails. done is closed when it returns.
+func runSender(conn net.Conn, wID msg.WorkerId, outMsgChan chan msg.FromWorker, flow *serverFlow,
+	quit chan bool, done chan bool) {
+	defer close(done)
+
+	heartbeat := time.NewTicker(msg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	heartbeatMsg := msg.FromWorker{Type: msg.Heartbeat, SrcWorker: wID}
+	credits := flow.sendWindow
+
 	for {
+		// Without credits, the messages wait until the server returns some
+		queue := outMsgChan
+		if flow.sendWindow > 0 && credits <= 0 {
+			queue = nil
+		}
+
+		var outMsg msg.FromWorker
 		select {
-		case outMsg := <-outMsgChan:
-			outBuf := Logger.PrepareSend(fmt.Sprintf("Sending-%v-Message", msg.TypeStr(outMsg.Type)), outMsg)
-			var size uint16
-			size = uint16(len(outBuf))
-			sizeBuf := make([]byte, 2)
-			binary.LittleEndian.PutUint16(sizeBuf, uint16(size))
-			outBuf = append(sizeBuf, outBuf...)
-			// log.Print("Adding sizeBuf to message with size: ", len(sizeBuf), "Msg size:", size, sizeBuf)
-			n, err := conn.Write(outBuf)
-			checkErr(err)
-			log.Printf("WConn: Sent message %v, with %v bytes.\n", outMsg, n)
+		case outMsg = <-queue:
+			if flow.sendWindow > 0 {
+				credits--
+				if credits == 0 {
+					log.Printf("WConn: Out of credits, %v messages queued\n", len(outMsgChan))
+				}
+			}
+		case returned := <-flow.returned:
+			credits += returned
+			continue
+		case granted := <-flow.grants:
+			outMsg = msg.FromWorker{Type: msg.Credit, SrcWorker: wID, Credits: granted}
+		case <-heartbeat.C:
+			outMsg = heartbeatMsg
+		case <-quit:
+			return
+		}
+
+		outBuf, err := wireCodec.Encode(outMsg)
+		if err == nil {
+			err = msg.WriteFrame(conn, outBuf)
+		}
+		if err != nil {
+			log.Printf("WConn: Failed to send message %v: %v\n", outMsg, err)
+			conn.Close() // so that handleTasks notices too
+			return
+		}
+		if msg.NeedsCredit(outMsg.Type) {
+			log.Printf("WConn: Sent message %v, with %v bytes.\n", outMsg, len(outBuf))
+		}
+	}
+}
+
+// Bounds for the wait between rounds of connection attempts. The wait doubles
+// after every failed round. Tests shorten them.
+var minReconnectWait = 100 * time.Millisecond
+var maxReconnectWait = 10 * time.Second
+
+// How long to wait for a server to accept a connection
+const serverDialTimeout = 5 * time.Second
+
+// connectToServer tries each of the server addresses in turn until one of
+// them accepts this worker, backing off between rounds. Only the leader
+// listens for workers, so after a failover the worker ends up connected to
+// the new leader. The worker identifies itself with the same WorkerId every
+// time, so a server with a job running on it takes it back into the job.
+func connectToServer(serverAddrs []string, tlsConfig *msg.TLS,
+	connMsg msg.WorkerConnectionMsg) (net.Conn, msg.WorkerConnectionResp) {
+	wait := minReconnectWait
+	for {
+		for _, serverAddr := range serverAddrs {
+			conn, err := tlsConfig.Dial(serverAddr, "", serverDialTimeout)
+			if err != nil {
+				log.Printf("Could not connect to server %v: %v\n", serverAddr, err)
+				continue
+			}
+
+			outBuf, err := msg.HandshakeCodec.Encode(connMsg)
+			if err == nil {
+				err = msg.WriteFrame(conn, outBuf)
+			}
+			if err != nil {
+				log.Printf("Could not send connection message to %v: %v\n", serverAddr, err)
+				conn.Close()
+				continue
+			}
+
+			// Get the response from the server
+			var response msg.WorkerConnectionResp
+			inBuf, err := msg.ReadFrame(conn)
+			if err == nil {
+				err = msg.HandshakeCodec.Decode(inBuf, &response)
+			}
+			if err != nil {
+				log.Printf("No connection response from %v: %v\n", serverAddr, err)
+				conn.Close()
+				continue
+			}
+			log.Printf("Received response %v\n", response)
+
+			if !response.IsAccepted && response.Retry {
+				// Another connection holds our id for now
+				log.Printf("Server %v refused connection for now: %v\n", serverAddr, response.Reason)
+				conn.Close()
+				continue
+			}
+			if !response.IsAccepted {
+				log.Printf("Server refused connection: %v\n", response.Reason)
+				os.Exit(1)
+			}
+			log.Printf("Server %v accepted connection, protocol version %v.\n", serverAddr, response.ProtocolVersion)
+			return conn, response
+		}
+		log.Printf("Retrying connection in %v\n", wait)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxReconnectWait {
+			wait = maxReconnectWait
 		}
 	}
 }
 
+// Usage: workerApp [-codec name] [-govec] [-cert file -key file -ca file] [-window n] [-out-queue n] [-store uri] [-db-name name] [-db-timeout duration] [server address[,standby address...]] [worker address] [worker id]
 func main() {
 	// Parse Arguments:
-	serverAddr := os.Args[1]
-	myAddr := os.Args[2]
-	myID := string(os.Args[3])
+	codecName := flag.String("codec", msg.DefaultCodec,
+		fmt.Sprintf("how messages are encoded, one of %v", msg.CodecNames()))
+	vectorClocks := flag.Bool("govec", false,
+		"log every message to and from the server with GoVector vector clocks (slow)")
+	certFile := flag.String("cert", "", "PEM certificate of this worker, for worker-<id>; enables TLS")
+	keyFile := flag.String("key", "", "PEM key of the worker certificate")
+	caFile := flag.String("ca", "", "PEM certificate of the CA that signs the server and worker certificates")
+	window := flag.Int("window", msg.DefaultWindow, "how many messages the server may send before this worker returns credits (0 for no limit)")
+	outQueue := flag.Int("out-queue", 256, "how many messages can wait to be sent to the server")
+	dbConfig, err := db.ConfigFromEnv()
+	checkErr(err)
+	dbConfig.RegisterFlags()
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	serverAddrs := strings.Split(flag.Arg(0), ",")
+	myAddr := flag.Arg(1)
+	myID := flag.Arg(2)
 
 	log.SetFlags(log.Lshortfile)
 
-	// Initialize the Govec.
-	Logger = govec.Initialize("worker"+myID, "workerlogfile"+myID)
-
-	// Open connection to Server.
-	conn, err := net.Dial("tcp", serverAddr)
+	codec, err := msg.CodecByName(*codecName)
 	checkErr(err)
+	tlsConfig, err := msg.LoadTLS(*certFile, *keyFile, *caFile)
+	checkErr(err)
+	store, err := db.Open(dbConfig)
+	checkErr(err)
+	wireCodec = codec
+	if *vectorClocks {
+		// Initialize the Govec.
+		Logger = govec.Initialize("worker"+myID, "workerlogfile"+myID)
+		wireCodec = msg.LoggingCodec{Logger: Logger}
+	}
+
 	var connMsg msg.WorkerConnectionMsg
 	connMsg.WorkerId = msg.WorkerId(myID)
 	connMsg.WorkerAddress = myAddr
-	outBuf := Logger.PrepareSend("Worker-Connecting", connMsg)
-	_, err = conn.Write(outBuf)
-	checkErr(err)
+	connMsg.Codec = codec.Name()
+	connMsg.VectorClocks = *vectorClocks
+	connMsg.ProtocolVersion = msg.ProtocolVersion
+	connMsg.Capabilities = msg.Capabilities
+	connMsg.Window = *window
 
-	// Get the response from the server
-	var inBuf [512]byte
-	var response msg.WorkerConnectionResp
-	_, err = conn.Read(inBuf[0:])
-	checkErr(err)
-	Logger.UnpackReceive("Received-Conn-Response", inBuf[0:], &response)
-	log.Printf("Received response %v\n", response)
-
-	if !response.IsAccepted {
-		log.Println("Server refused connection.")
-		os.Exit(1)
-	} else {
-		log.Println("Server accepted connection.")
-	}
+	outMsgChan := make(chan msg.FromWorker, *outQueue)
+	smp := worker.NewServerMsgProcessor(msg.WorkerId(myID), codec, tlsConfig, store, outMsgChan)
+	// Other workers send vertex messages straight to this worker's address
+	checkErr(smp.ListenForPeers(myAddr))
+
+	// Keep serving whichever server is the leader. The vertices loaded by the
+	// worker are kept across reconnects, but the server will reassign
+	// partitions before it uses them again.
+	for {
+		conn, response := connectToServer(serverAddrs, tlsConfig, connMsg)
+		// Lets the next connection take over from this one, should the server
+		// not have noticed that this one failed
+		connMsg.RejoinToken = response.RejoinToken
+		recvWindow := connMsg.Window
+		if response.ProtocolVersion < msg.CreditVersion {
+			// The server couldn't read our credits
+			recvWindow = 0
+		}
+		flow := newServerFlow(response.Window, recvWindow)
+
+		quit := make(chan bool)
+		senderDone := make(chan bool)
+		go runSender(conn, connMsg.WorkerId, outMsgChan, flow, quit, senderDone)
+		err := handleTasks(conn, smp, flow, senderDone)
+		log.Printf("Lost connection to server: %v\n", err)
 
-	outMsgChan := make(chan msg.FromWorker)
-	smp := worker.NewServerMsgProcessor(msg.WorkerId(myID), outMsgChan)
-	// Handle the tasks given to the
-	go runSender(conn, outMsgChan)
-	handleTasks(conn, smp)
+		close(quit)
+		conn.Close()
+		<-senderDone
+	}
 }
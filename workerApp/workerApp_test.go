@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"project_c9f7_i5l8_o0p4_p0j8/msg"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t *testing.T
+
+func test(summary string, expect, actual interface{}) {
+	if !reflect.DeepEqual(expect, actual) {
+		_, _, line, _ := runtime.Caller(1)
+		t.Errorf("Line %d:: %s: Expected %v, Actual %v", line, summary, expect, actual)
+	}
+}
+
+// Accepts one worker on l, the way the server does, and returns the id it
+// connected with.
+func acceptWorker(l net.Listener) <-chan msg.WorkerId {
+	ids := make(chan msg.WorkerId, 1)
+	go func() {
+		defer close(ids)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var wcm msg.WorkerConnectionMsg
+		inBuf, err := msg.ReadFrame(conn)
+		if err != nil || msg.HandshakeCodec.Decode(inBuf, &wcm) != nil {
+			return
+		}
+		resp := msg.WorkerConnectionResp{WorkerId: wcm.WorkerId, IsAccepted: true, ProtocolVersion: msg.ProtocolVersion}
+		outBuf, _ := msg.HandshakeCodec.Encode(resp)
+		msg.WriteFrame(conn, outBuf)
+		ids <- wcm.WorkerId
+	}()
+	return ids
+}
+
+// Refuses one worker on l for now, the way the server does while another
+// connection holds the worker's id.
+func refuseWorker(l net.Listener) {
+	conn, err := l.Accept()
+	checkErr(err)
+	defer conn.Close()
+	_, err = msg.ReadFrame(conn)
+	checkErr(err)
+	resp := msg.WorkerConnectionResp{Reason: "busy", Retry: true, ProtocolVersion: msg.ProtocolVersion}
+	outBuf, _ := msg.HandshakeCodec.Encode(resp)
+	checkErr(msg.WriteFrame(conn, outBuf))
+}
+
+// An address that nothing listens on
+func deadAddress() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	l.Close()
+	return l.Addr().String()
+}
+
+// Shortens the wait between rounds of connection attempts for fn.
+func withFastReconnect(fn func()) {
+	savedMin, savedMax := minReconnectWait, maxReconnectWait
+	minReconnectWait, maxReconnectWait = 10*time.Millisecond, 50*time.Millisecond
+	defer func() { minReconnectWait, maxReconnectWait = savedMin, savedMax }()
+	fn()
+}
+
+// A worker moves on to the next server when one is down.
+func TestConnectFailsOver(tee *testing.T) {
+	t = tee
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	defer l.Close()
+	ids := acceptWorker(l)
+
+	conn, resp := connectToServer([]string{deadAddress(), l.Addr().String()}, nil,
+		msg.WorkerConnectionMsg{WorkerId: "w1", ProtocolVersion: msg.ProtocolVersion})
+	defer conn.Close()
+	test("accepted", true, resp.IsAccepted)
+	test("connected to the standby", "w1", string(<-ids))
+}
+
+// A worker keeps trying until a server comes back, with the same id.
+func TestConnectRetries(tee *testing.T) {
+	t = tee
+	addr := deadAddress()
+	ids := make(chan (<-chan msg.WorkerId), 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		checkErr(err)
+		ids <- acceptWorker(l)
+	}()
+
+	withFastReconnect(func() {
+		start := time.Now()
+		conn, resp := connectToServer([]string{addr}, nil,
+			msg.WorkerConnectionMsg{WorkerId: "w1", ProtocolVersion: msg.ProtocolVersion})
+		defer conn.Close()
+		test("accepted", true, resp.IsAccepted)
+		test("waited for the server", true, time.Since(start) >= 200*time.Millisecond)
+		test("same id", "w1", string(<-<-ids))
+	})
+}
+
+// A worker that is refused for now tries again later.
+func TestConnectRetriesRefusal(tee *testing.T) {
+	t = tee
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	defer l.Close()
+	ids := make(chan (<-chan msg.WorkerId), 1)
+	go func() {
+		refuseWorker(l)
+		ids <- acceptWorker(l)
+	}()
+
+	withFastReconnect(func() {
+		conn, resp := connectToServer([]string{l.Addr().String()}, nil,
+			msg.WorkerConnectionMsg{WorkerId: "w1", ProtocolVersion: msg.ProtocolVersion})
+		defer conn.Close()
+		test("accepted", true, resp.IsAccepted)
+		test("same id", "w1", string(<-<-ids))
+	})
+}
+
+// A worker gives up on a server it hears nothing from, not even heartbeats,
+// so that it can reconnect.
+func TestServerGoesSilent(tee *testing.T) {
+	t = tee
+	saved := serverTimeout
+	serverTimeout = 200 * time.Millisecond
+	defer func() { serverTimeout = saved }()
+	wireCodec, _ = msg.CodecByName(msg.DefaultCodec)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- handleTasks(client, nil, newServerFlow(0, 0), make(chan bool))
+	}()
+
+	// Heartbeats keep it connected
+	heartbeat, _ := wireCodec.Encode(msg.FromServer{Type: msg.Heartbeat})
+	for i := 0; i < 3; i++ {
+		time.Sleep(serverTimeout / 2)
+		checkErr(msg.WriteFrame(server, heartbeat))
+	}
+	select {
+	case err := <-done:
+		t.Errorf("Gave up on a server that sent heartbeats: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-done:
+		test("timed out", true, err != nil && strings.Contains(err.Error(), "timeout"))
+	case <-time.After(5 * time.Second):
+		t.Errorf("Still waiting for a silent server")
+	}
+}